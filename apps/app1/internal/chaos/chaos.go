@@ -0,0 +1,174 @@
+package chaos
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	myotel "app1/internal/otel"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Chaos directives can be sent either as plain request headers or as members
+// of the W3C baggage header, using the same names in both places.
+var (
+	CHAOS_DELAY_HEADER  = "x-chaos-delay"
+	CHAOS_STATUS_HEADER = "x-chaos-status"
+	CHAOS_TARGET_HEADER = "x-chaos-target"
+	BAGGAGE_HEADER      = "baggage"
+)
+
+type Directive struct {
+	Target string
+	Delay  time.Duration
+	Status int
+}
+
+func (d Directive) Empty() bool {
+	return d.Delay == 0 && d.Status == 0
+}
+
+// Parse reads the chaos directives of a request. Headers take precedence over
+// baggage members so a single hop can be overridden without rewriting baggage.
+func Parse(r *http.Request) (Directive, error) {
+	return parse(lookup(r.Header.Get))
+}
+
+// lookup returns the raw chaos directives read by get from request headers or
+// gRPC metadata, plain keys taking precedence over baggage members.
+func lookup(get func(key string) string) map[string]string {
+	values := map[string]string{}
+	if b, err := baggage.Parse(get(BAGGAGE_HEADER)); err == nil {
+		for _, key := range []string{CHAOS_DELAY_HEADER, CHAOS_STATUS_HEADER, CHAOS_TARGET_HEADER} {
+			if v := b.Member(key).Value(); v != "" {
+				values[key] = v
+			}
+		}
+	}
+	for _, key := range []string{CHAOS_DELAY_HEADER, CHAOS_STATUS_HEADER, CHAOS_TARGET_HEADER} {
+		if v := get(key); v != "" {
+			values[key] = v
+		}
+	}
+	return values
+}
+
+func parse(values map[string]string) (Directive, error) {
+	d := Directive{Target: strings.TrimSpace(values[CHAOS_TARGET_HEADER])}
+	if v := values[CHAOS_DELAY_HEADER]; v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil || delay < 0 {
+			return Directive{}, fmt.Errorf("invalid %s [%s]", CHAOS_DELAY_HEADER, v)
+		}
+		d.Delay = delay
+	}
+	if v := values[CHAOS_STATUS_HEADER]; v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 400 || status > 599 {
+			return Directive{}, fmt.Errorf("invalid %s [%s], expected 400 to 599", CHAOS_STATUS_HEADER, v)
+		}
+		d.Status = status
+	}
+	return d, nil
+}
+
+// Forward copies the chaos directives and baggage of an incoming request to an
+// outgoing one so they can reach the hop they are targeted at.
+func Forward(from *http.Request, to *http.Request) {
+	for _, key := range []string{CHAOS_DELAY_HEADER, CHAOS_STATUS_HEADER, CHAOS_TARGET_HEADER, BAGGAGE_HEADER} {
+		if v := from.Header.Get(key); v != "" {
+			to.Header.Set(key, v)
+		}
+	}
+}
+
+// Middleware injects the faults described by the request chaos directives when
+// they target this service, leaving every other request untouched.
+func Middleware(service string, otc *myotel.OtelClient, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, err := Parse(r)
+		if err != nil {
+			otc.Logger.Warn(
+				fmt.Sprintf("Ignoring chaos directives for [%s]: %s", r.URL.Path, err),
+				slog.String("TraceId", r.Header.Get(myotel.OTEL_TRACE_HEADER)),
+			)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if d.Empty() || !strings.EqualFold(d.Target, service) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The fault is recorded on the SERVER span of the request. The HTTP
+		// handlers start theirs after this middleware, so without one in the
+		// request context it is started here: the handler does not run when
+		// a status is injected, and only runs after the delay.
+		traceId := r.Header.Get(myotel.OTEL_TRACE_HEADER)
+		span := trace.SpanFromContext(r.Context())
+		owned := !span.IsRecording()
+		if owned {
+			spanID, _ := trace.SpanIDFromHex(r.Header.Get(myotel.OTEL_SPAN_HEADER))
+			traceID, _ := trace.TraceIDFromHex(traceId)
+			ctx := trace.ContextWithSpanContext(r.Context(), trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    traceID,
+				SpanID:     spanID,
+				TraceFlags: trace.FlagsSampled,
+				Remote:     true,
+			}))
+			_, span = otc.Tracer.Tracer("opentelemetry.io/sdk").Start(
+				ctx,
+				fmt.Sprintf("%s %s", r.Method, r.URL.Path),
+				trace.WithSpanKind(trace.SpanKindServer),
+			)
+		}
+		end := func() {
+			if owned {
+				span.End()
+			}
+		}
+		span.SetAttributes(
+			attribute.String("chaos.target", d.Target),
+			attribute.String("chaos.path", r.URL.Path),
+			attribute.Int64("chaos.delay_ms", d.Delay.Milliseconds()),
+			attribute.Int("chaos.status", d.Status),
+		)
+
+		if d.Delay > 0 {
+			select {
+			case <-time.After(d.Delay):
+			case <-r.Context().Done():
+				span.SetStatus(codes.Error, r.Context().Err().Error())
+				end()
+				return
+			}
+		}
+
+		otc.Logger.Warn(
+			fmt.Sprintf("Injected chaos on [%s]: delay %d miliseconds, status %d", r.URL.Path, d.Delay.Milliseconds(), d.Status),
+			slog.String("TraceId", traceId),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		)
+
+		if d.Status != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", d.Status))
+			if d.Status >= 500 {
+				span.SetStatus(codes.Error, fmt.Sprintf("Injected status [%d]", d.Status))
+			}
+			end()
+			w.WriteHeader(d.Status)
+			io.WriteString(w, fmt.Sprintf("chaos: injected status %d at %s\n", d.Status, service))
+			return
+		}
+		end()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,171 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	STATUS_OK   = "ok"
+	STATUS_FAIL = "fail"
+)
+
+// CHECK_TIMEOUT bounds every readiness check, so a hung dependency fails its
+// check instead of the probe.
+var CHECK_TIMEOUT = 2 * time.Second
+
+// Check reports whether a dependency can be used, it must return once ctx is
+// done.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check in the body of /readyz.
+type Result struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Report is the body of /readyz: ok when every check is.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// Checker runs the readiness checks of a service. The health.check.status
+// gauge holds the result of the last run per check: 1 for ok, 0 for fail.
+type Checker struct {
+	names  []string
+	checks map[string]Check
+
+	mu   sync.Mutex
+	last map[string]bool
+}
+
+func NewChecker(meter metric.Meter) (*Checker, error) {
+	c := &Checker{
+		checks: map[string]Check{},
+		last:   map[string]bool{},
+	}
+	_, err := meter.Int64ObservableGauge(
+		"health.check.status",
+		metric.WithDescription("1 when the last readiness check of the dependency passed, 0 otherwise"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for name, ok := range c.last {
+				v := int64(0)
+				if ok {
+					v = 1
+				}
+				o.Observe(v, metric.WithAttributes(attribute.String("check", name)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Add registers check under name. Checks are reported in the order they are
+// added.
+func (c *Checker) Add(name string, check Check) {
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Run runs every check concurrently, each with CHECK_TIMEOUT.
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: STATUS_OK, Checks: make([]Result, len(c.names))}
+	var wg sync.WaitGroup
+	for i, name := range c.names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, CHECK_TIMEOUT)
+			defer cancel()
+			start := time.Now()
+			err := c.checks[name](ctx)
+			result := Result{
+				Name:       name,
+				Status:     STATUS_OK,
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = STATUS_FAIL
+				result.Error = err.Error()
+			}
+			report.Checks[i] = result
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, result := range report.Checks {
+		c.last[result.Name] = result.Status == STATUS_OK
+		if result.Status != STATUS_OK {
+			report.Status = STATUS_FAIL
+		}
+	}
+	return report
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// RegisterRoutes exposes the checker over HTTP:
+//
+//	GET /livez   200 while the process serves requests
+//	GET /readyz  200 when every check passes, 503 otherwise, with the Report
+func (c *Checker) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Report{Status: STATUS_OK, Checks: []Result{}})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+		status := http.StatusOK
+		if report.Status != STATUS_OK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+}
+
+// HTTPCheck returns a check that GETs url, e.g. the /readyz of another
+// service, and expects a 2xx. It bypasses the OtelClient so probes do not
+// start traces.
+func HTTPCheck(url string) Check {
+	client := &http.Client{}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s answered %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
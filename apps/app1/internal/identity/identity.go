@@ -0,0 +1,136 @@
+// Package identity reads the end user, session and book a request is made
+// for, so they can be recorded on spans and logs. The load client sets them
+// both as plain request headers and as members of the W3C baggage header.
+package identity
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+var (
+	ENDUSER_HEADER = "x-enduser-id"
+	SESSION_HEADER = "x-session-id"
+	BOOK_HEADER    = "x-book-id"
+	BAGGAGE_HEADER = "baggage"
+)
+
+// Baggage member keys, also used as span and log attribute keys.
+var (
+	ENDUSER_KEY = "enduser.id"
+	SESSION_KEY = "session.id"
+	BOOK_KEY    = "book.id"
+)
+
+type Identity struct {
+	EndUser string
+	Session string
+	Book    string
+}
+
+func (i Identity) Empty() bool {
+	return i.EndUser == "" && i.Session == "" && i.Book == ""
+}
+
+// Parse reads the identity of a request. Headers take precedence over
+// baggage members, as they do for the chaos directives.
+func Parse(r *http.Request) Identity {
+	i := Identity{}
+	if b, err := baggage.Parse(r.Header.Get(BAGGAGE_HEADER)); err == nil {
+		i = fromBaggage(b)
+	}
+	if v := r.Header.Get(ENDUSER_HEADER); v != "" {
+		i.EndUser = v
+	}
+	if v := r.Header.Get(SESSION_HEADER); v != "" {
+		i.Session = v
+	}
+	if v := r.Header.Get(BOOK_HEADER); v != "" {
+		i.Book = v
+	}
+	return i
+}
+
+// FromContext reads the identity from the baggage of ctx, set by Middleware or
+// extracted from gRPC metadata and messages.
+func FromContext(ctx context.Context) Identity {
+	return fromBaggage(baggage.FromContext(ctx))
+}
+
+func fromBaggage(b baggage.Baggage) Identity {
+	return Identity{
+		EndUser: b.Member(ENDUSER_KEY).Value(),
+		Session: b.Member(SESSION_KEY).Value(),
+		Book:    b.Member(BOOK_KEY).Value(),
+	}
+}
+
+// ContextWith returns ctx with the identity added to its baggage, so it is
+// propagated to the gRPC calls and messages sent under ctx.
+func ContextWith(ctx context.Context, i Identity) context.Context {
+	b := baggage.FromContext(ctx)
+	for key, value := range map[string]string{ENDUSER_KEY: i.EndUser, SESSION_KEY: i.Session, BOOK_KEY: i.Book} {
+		if value == "" {
+			continue
+		}
+		m, err := baggage.NewMemberRaw(key, value)
+		if err != nil {
+			continue
+		}
+		if next, err := b.SetMember(m); err == nil {
+			b = next
+		}
+	}
+	return baggage.ContextWithBaggage(ctx, b)
+}
+
+// Middleware adds the identity of every request to the baggage of its
+// context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := Parse(r); !i.Empty() {
+			r = r.WithContext(ContextWith(r.Context(), i))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Forward copies the identity headers of an incoming request to an outgoing
+// one. The baggage header is forwarded by chaos.Forward.
+func Forward(from *http.Request, to *http.Request) {
+	for _, key := range []string{ENDUSER_HEADER, SESSION_HEADER, BOOK_HEADER} {
+		if v := from.Header.Get(key); v != "" {
+			to.Header.Set(key, v)
+		}
+	}
+}
+
+// Attributes returns the span attributes of the identity, leaving out the
+// parts that are not set.
+func (i Identity) Attributes() []attribute.KeyValue {
+	attrs := []attribute.KeyValue{}
+	if i.EndUser != "" {
+		attrs = append(attrs, attribute.String(ENDUSER_KEY, i.EndUser))
+	}
+	if i.Session != "" {
+		attrs = append(attrs, attribute.String(SESSION_KEY, i.Session))
+	}
+	if i.Book != "" {
+		attrs = append(attrs, attribute.String(BOOK_KEY, i.Book))
+	}
+	return attrs
+}
+
+// LogAttrs returns the identity as slog attributes, to be appended to the
+// TraceId and SpanId ones.
+func (i Identity) LogAttrs() []any {
+	attrs := []any{}
+	for _, a := range i.Attributes() {
+		attrs = append(attrs, slog.String(string(a.Key), a.Value.AsString()))
+	}
+	return attrs
+}
@@ -0,0 +1,79 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("messaging: subscriber queue full")
+
+// MemoryBus delivers messages to the subscribers of the same process. Each
+// subscription has a buffered queue drained by its own goroutine, so a slow
+// handler only delays its own subscription. Publish fails with ErrQueueFull
+// rather than block when a queue is full.
+type MemoryBus struct {
+	Logger    *slog.Logger
+	QueueSize int
+
+	mu   sync.RWMutex
+	subs map[string][]chan Message
+}
+
+func NewMemoryBus(logger *slog.Logger) *MemoryBus {
+	return &MemoryBus{Logger: logger, QueueSize: 100, subs: map[string][]chan Message{}}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, topic string, msg Message) error {
+	if msg.ID == "" {
+		msg.ID = newID()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, queue := range b.subs[topic] {
+		select {
+		case queue <- msg:
+		default:
+			return fmt.Errorf("%w on topic %s", ErrQueueFull, topic)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	queue := make(chan Message, b.QueueSize)
+	b.mu.Lock()
+	b.subs[topic] = append(b.subs[topic], queue)
+	b.mu.Unlock()
+
+	go func() {
+		defer b.unsubscribe(topic, queue)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-queue:
+				if err := handler(ctx, topic, msg); err != nil {
+					b.Logger.Error(fmt.Sprintf("Handling message %s from [%s] failed with [%s]", msg.ID, topic, err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *MemoryBus) unsubscribe(topic string, queue chan Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := b.subs[topic]
+	for i, q := range subs {
+		if q == queue {
+			b.subs[topic] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package messaging is a small publish/subscribe abstraction with an
+// in-memory backend and a Postgres LISTEN/NOTIFY backend.
+//
+// Wrap a backend with NewPublisher and NewSubscriber to get PRODUCER and
+// CONSUMER spans: the publisher injects the W3C trace context and baggage in
+// the message headers and the subscriber continues the trace from them.
+package messaging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "messaging"
+
+var PROPAGATOR = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+type Message struct {
+	ID      string            `json:"id"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body"`
+}
+
+// Handler processes one message. Backends log handler errors, they do not
+// redeliver.
+type Handler func(ctx context.Context, topic string, msg Message) error
+
+type Publisher interface {
+	Publish(ctx context.Context, topic string, msg Message) error
+}
+
+type Subscriber interface {
+	// Subscribe delivers the messages published on topic to handler until
+	// ctx is done. It returns once the subscription is established.
+	Subscribe(ctx context.Context, topic string, handler Handler) error
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type tracedPublisher struct {
+	next   Publisher
+	system string
+	tracer trace.Tracer
+}
+
+// NewPublisher instruments p, whose messaging.system is system.
+func NewPublisher(p Publisher, system string, tp trace.TracerProvider) Publisher {
+	return &tracedPublisher{next: p, system: system, tracer: tp.Tracer(instrumentationName)}
+}
+
+func (p *tracedPublisher) Publish(ctx context.Context, topic string, msg Message) error {
+	if msg.ID == "" {
+		msg.ID = newID()
+	}
+	ctx, span := p.tracer.Start(ctx,
+		fmt.Sprintf("%s send", topic),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attributes(p.system, topic, msg)...),
+	)
+	defer span.End()
+
+	headers := make(map[string]string, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	PROPAGATOR.Inject(ctx, propagation.MapCarrier(headers))
+	msg.Headers = headers
+
+	err := p.next.Publish(ctx, topic, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+type tracedSubscriber struct {
+	next   Subscriber
+	system string
+	tracer trace.Tracer
+}
+
+// NewSubscriber instruments s, whose messaging.system is system.
+func NewSubscriber(s Subscriber, system string, tp trace.TracerProvider) Subscriber {
+	return &tracedSubscriber{next: s, system: system, tracer: tp.Tracer(instrumentationName)}
+}
+
+func (s *tracedSubscriber) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	return s.next.Subscribe(ctx, topic, func(ctx context.Context, topic string, msg Message) error {
+		ctx = PROPAGATOR.Extract(ctx, propagation.MapCarrier(msg.Headers))
+		ctx, span := s.tracer.Start(ctx,
+			fmt.Sprintf("%s process", topic),
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(append(attributes(s.system, topic, msg), semconv.MessagingOperationProcess)...),
+		)
+		defer span.End()
+
+		err := handler(ctx, topic, msg)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	})
+}
+
+func attributes(system string, topic string, msg Message) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingSystemKey.String(system),
+		semconv.MessagingDestinationKey.String(topic),
+		semconv.MessagingDestinationKindTopic,
+		semconv.MessagingMessageIDKey.String(msg.ID),
+		semconv.MessagingMessagePayloadSizeBytesKey.Int(len(msg.Body)),
+	}
+}
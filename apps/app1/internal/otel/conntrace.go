@@ -0,0 +1,160 @@
+package otel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CONN_TRACE_ENV set to false disables the connection lifecycle events of
+// RoundTrip, which add a few allocations per request.
+var CONN_TRACE_ENV = "HTTP_CONN_TRACE"
+
+// connMetrics count the connections of the transport: http.client.connections
+// by reused, so the reuse ratio is reused="true" over the total, and
+// http.client.open_connections.
+type connMetrics struct {
+	acquired metric.Int64Counter
+	open     metric.Int64UpDownCounter
+}
+
+func newConnMetrics(meter metric.Meter) (*connMetrics, error) {
+	acquired, err := meter.Int64Counter("http.client.connections",
+		metric.WithDescription("Connections acquired by outbound requests, by reused"))
+	if err != nil {
+		return nil, err
+	}
+	open, err := meter.Int64UpDownCounter("http.client.open_connections",
+		metric.WithDescription("Connections dialed by the transport and not closed yet"))
+	if err != nil {
+		return nil, err
+	}
+	return &connMetrics{acquired: acquired, open: open}, nil
+}
+
+func connTraceEnabled() bool {
+	return os.Getenv(CONN_TRACE_ENV) != "false"
+}
+
+// countingDial wraps dial so http.client.open_connections follows the
+// connections it opens.
+func (m *connMetrics) countingDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		m.open.Add(context.Background(), 1)
+		return &countedConn{Conn: conn, open: m.open}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	open metric.Int64UpDownCounter
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.open.Add(context.Background(), -1) })
+	return c.Conn.Close()
+}
+
+func (m *connMetrics) gotConn(info httptrace.GotConnInfo) {
+	m.acquired.Add(context.Background(), 1, metric.WithAttributes(attribute.Bool("reused", info.Reused)))
+}
+
+// withConnTrace returns ctx with the httptrace hooks that add the DNS lookup,
+// connect, TLS handshake, connection and first byte events of a request to
+// span, timed from start.
+func (m *connMetrics) withConnTrace(ctx context.Context, span trace.Span, start time.Time) context.Context {
+	var mu sync.Mutex
+	var getConn, dnsStart, connectStart, tlsStart time.Time
+	since := func(t *time.Time) float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return float64(time.Since(*t).Microseconds()) / 1000
+	}
+	mark := func(t *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*t = time.Now()
+	}
+	withErr := func(attrs []attribute.KeyValue, err error) []attribute.KeyValue {
+		if err != nil {
+			attrs = append(attrs, attribute.String("error", err.Error()))
+		}
+		return attrs
+	}
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:  func(string) { mark(&getConn) },
+		DNSStart: func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			span.AddEvent("http.dns", trace.WithAttributes(withErr([]attribute.KeyValue{
+				attribute.Float64("duration_ms", since(&dnsStart)),
+				attribute.Int("addresses", len(info.Addrs)),
+			}, info.Err)...))
+		},
+		ConnectStart: func(string, string) { mark(&connectStart) },
+		ConnectDone: func(network, addr string, err error) {
+			span.AddEvent("http.connect", trace.WithAttributes(withErr([]attribute.KeyValue{
+				attribute.Float64("duration_ms", since(&connectStart)),
+				attribute.String("net.peer.addr", addr),
+			}, err)...))
+		},
+		TLSHandshakeStart: func() { mark(&tlsStart) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			span.AddEvent("http.tls", trace.WithAttributes(withErr([]attribute.KeyValue{
+				attribute.Float64("duration_ms", since(&tlsStart)),
+				attribute.String("tls.version", tls.VersionName(state.Version)),
+				attribute.Bool("tls.resumed", state.DidResume),
+			}, err)...))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.SetAttributes(attribute.Bool("http.conn.reused", info.Reused))
+			span.AddEvent("http.conn", trace.WithAttributes(
+				attribute.Float64("wait_ms", since(&getConn)),
+				attribute.Bool("reused", info.Reused),
+				attribute.Bool("was_idle", info.WasIdle),
+				attribute.Int64("idle_ms", info.IdleTime.Milliseconds()),
+			))
+			m.gotConn(info)
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("http.first_byte", trace.WithAttributes(
+				attribute.Float64("ttfb_ms", float64(time.Since(start).Microseconds())/1000),
+			))
+		},
+	})
+}
+
+// roundTrip sends req with Base, or http.DefaultTransport when it is nil, and,
+// with ConnTrace, adds the connection events of the request to span. The
+// connection metrics are recorded either way.
+func (otc *OtelClient) roundTrip(req *http.Request, span trace.Span, start time.Time) (*http.Response, error) {
+	base := otc.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if otc.conns == nil {
+		return base.RoundTrip(req)
+	}
+	if otc.ConnTrace {
+		req = req.WithContext(otc.conns.withConnTrace(req.Context(), span, start))
+	} else {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: otc.conns.gotConn,
+		}))
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,192 @@
+package otel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"app1/internal/identity"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RPC_PROPAGATOR carries the W3C trace context and baggage in the gRPC
+// metadata, next to the custom trace headers the HTTP hops use.
+var RPC_PROPAGATOR = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Bucket boundaries, in milliseconds, of rpc.server.duration and
+// rpc.client.duration.
+var RPC_DURATION_BUCKETS = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// metadataCarrier adapts gRPC metadata to a propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// UnaryServerInterceptor continues the caller's trace under a SERVER span per
+// call and records rpc.server.duration. The custom trace headers take
+// precedence over traceparent, as they do for the HTTP hops.
+func (otc *OtelClient) UnaryServerInterceptor() (grpc.UnaryServerInterceptor, error) {
+	duration, err := otc.Metrics.Meter("asdsda").Float64Histogram("rpc.server.duration",
+		metric.WithDescription("Duration of inbound RPCs"),
+		metric.WithUnit("ms"),
+		metric.WithExplicitBucketBoundaries(RPC_DURATION_BUCKETS...))
+	if err != nil {
+		return nil, err
+	}
+	tracer := otc.Tracer.Tracer("opentelemetry.io/sdk")
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		md, _ := metadata.FromIncomingContext(ctx)
+		ctx = RPC_PROPAGATOR.Extract(ctx, metadataCarrier(md))
+		if traceID, err := trace.TraceIDFromHex(metadataCarrier(md).Get(OTEL_TRACE_HEADER)); err == nil {
+			spanID, _ := trace.SpanIDFromHex(metadataCarrier(md).Get(OTEL_SPAN_HEADER))
+			ctx = trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    traceID,
+				SpanID:     spanID,
+				TraceFlags: trace.FlagsSampled,
+				Remote:     true,
+			}))
+		}
+
+		id := identity.FromContext(ctx)
+		attrs := append(rpcAttributes(info.FullMethod), id.Attributes()...)
+		if p, ok := peer.FromContext(ctx); ok {
+			if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+				attrs = append(attrs, semconv.NetPeerIPKey.String(host))
+			}
+		}
+		ctx, span := tracer.Start(ctx, strings.TrimPrefix(info.FullMethod, "/"),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...),
+		)
+		defer span.End()
+		logAttrs := append([]any{
+			slog.String("TraceId", span.SpanContext().TraceID().String()),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		}, id.LogAttrs()...)
+
+		resp, err := handler(ctx, req)
+		elapsed := time.Since(start)
+		code := status.Code(err)
+		span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+		duration.Record(ctx, float64(elapsed.Microseconds())/1000, metric.WithAttributes(
+			append(rpcAttributes(info.FullMethod), semconv.RPCGRPCStatusCodeKey.Int(int(code)))...,
+		))
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			otc.Logger.Error(
+				fmt.Sprintf("Call to [%s] failed in %d miliseconds with [%s]", info.FullMethod, elapsed.Milliseconds(), code),
+				logAttrs...,
+			)
+		}
+		return resp, err
+	}, nil
+}
+
+// UnaryClientInterceptor starts a CLIENT span per call, child of the span in
+// ctx, sends it in both the custom trace headers and traceparent, and records
+// rpc.client.duration.
+func (otc *OtelClient) UnaryClientInterceptor() (grpc.UnaryClientInterceptor, error) {
+	duration, err := otc.Metrics.Meter("asdsda").Float64Histogram("rpc.client.duration",
+		metric.WithDescription("Duration of outbound RPCs"),
+		metric.WithUnit("ms"),
+		metric.WithExplicitBucketBoundaries(RPC_DURATION_BUCKETS...))
+	if err != nil {
+		return nil, err
+	}
+	tracer := otc.Tracer.Tracer("opentelemetry.io/sdk")
+
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		id := identity.FromContext(ctx)
+		attrs := append(rpcAttributes(method), id.Attributes()...)
+		if host, _, err := net.SplitHostPort(cc.Target()); err == nil {
+			attrs = append(attrs, semconv.NetPeerNameKey.String(host))
+		}
+		ctx, span := tracer.Start(ctx, strings.TrimPrefix(method, "/"),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attrs...),
+		)
+		defer span.End()
+		logAttrs := append([]any{
+			slog.String("TraceId", span.SpanContext().TraceID().String()),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		}, id.LogAttrs()...)
+
+		md, ok := metadata.FromOutgoingContext(ctx)
+		if ok {
+			md = md.Copy()
+		} else {
+			md = metadata.MD{}
+		}
+		md.Set(OTEL_TRACE_HEADER, span.SpanContext().TraceID().String())
+		md.Set(OTEL_SPAN_HEADER, span.SpanContext().SpanID().String())
+		RPC_PROPAGATOR.Inject(ctx, metadataCarrier(md))
+		ctx = metadata.NewOutgoingContext(ctx, md)
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		elapsed := time.Since(start)
+		code := status.Code(err)
+		span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+		duration.Record(ctx, float64(elapsed.Microseconds())/1000, metric.WithAttributes(
+			append(rpcAttributes(method), semconv.RPCGRPCStatusCodeKey.Int(int(code)))...,
+		))
+
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			otc.Logger.Error(
+				fmt.Sprintf("Call to [%s] failed in %d miliseconds with [%s]", method, elapsed.Milliseconds(), code),
+				logAttrs...,
+			)
+			return err
+		}
+		otc.Logger.Info(
+			fmt.Sprintf("Call to [%s] succeded in %d miliseconds", method, elapsed.Milliseconds()),
+			logAttrs...,
+		)
+		return nil
+	}, nil
+}
+
+// rpcAttributes splits a full method name, /package.Service/Method, into the
+// rpc.* attributes.
+func rpcAttributes(fullMethod string) []attribute.KeyValue {
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	return []attribute.KeyValue{
+		semconv.RPCSystemKey.String("grpc"),
+		semconv.RPCServiceKey.String(service),
+		semconv.RPCMethodKey.String(method),
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"time"
 
+	"app1/internal/identity"
+
 	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -22,6 +25,7 @@ import (
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
@@ -36,42 +40,55 @@ type OtelClient struct {
 	Metrics               *metricsdk.MeterProvider
 	HttpRequestTotalMeter metric.Int64Counter
 	Logger                *slog.Logger
+	// ConnTrace adds the connection events of every request to its span, it
+	// is on unless CONN_TRACE_ENV is false.
+	ConnTrace bool
+	// Base sends the requests of RoundTrip. NewOtelClient sets it to a
+	// transport configured by the HTTP_* variables, see
+	// TransportConfigFromEnv; nil means http.DefaultTransport.
+	Base http.RoundTripper
+
+	conns *connMetrics
+	// exporterConn is the connection of the trace exporter to the collector.
+	exporterConn *grpc.ClientConn
 }
 
 func (otc *OtelClient) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
 	tracer := otc.Tracer.Tracer("opentelemetry.io/sdk")
+	ctx := otc.Ctx
 	parentId := req.Header.Get(OTEL_TRACE_HEADER)
-	spanId := req.Header.Get(OTEL_SPAN_HEADER)
-
-	traceID, _ := trace.TraceIDFromHex(parentId)
-	spanID, _ := trace.SpanIDFromHex(spanId)
-	parentSpanContext := trace.NewSpanContext(trace.SpanContextConfig{
-		TraceID:    traceID,
-		SpanID:     spanID,
-		TraceFlags: trace.FlagsSampled,
-	})
-	ctx := trace.ContextWithSpanContext(context.Background(), parentSpanContext)
+	if parentId != "" {
+		ctx = withParentHeaders(ctx, req)
+	}
 
+	id := identity.Parse(req)
 	_, span := tracer.Start(
 		ctx,
 		fmt.Sprintf("%s %s", req.Method, req.URL.Path),
 		trace.WithAttributes(
 			attribute.String("hostname", req.Host),
 		),
+		trace.WithAttributes(id.Attributes()...),
 	)
-	defer span.End()
+	// The span ends with the response body, once it is read or closed.
+	var resp *http.Response
+	defer func() { endWithBody(span, resp) }()
+	logAttrs := append([]any{
+		slog.String("TraceId", parentId),
+		slog.String("SpanId", span.SpanContext().TraceID().String()),
+	}, id.LogAttrs()...)
 
-	req.Header.Set(OTEL_TRACE_HEADER, parentId)
+	req.Header.Set(OTEL_TRACE_HEADER, span.SpanContext().TraceID().String())
 	req.Header.Set(OTEL_SPAN_HEADER, span.SpanContext().SpanID().String())
 
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	resp, err := otc.roundTrip(req, span, start)
 	elapsed := time.Since(start)
 	status := "-1"
 	if resp != nil {
 		status = fmt.Sprintf("%d", resp.StatusCode)
 	}
-	otc.HttpRequestTotalMeter.Add(otc.Ctx, 1, metric.WithAttributes(
+	otc.HttpRequestTotalMeter.Add(req.Context(), 1, metric.WithAttributes(
 		attribute.String("method", req.Method),
 		attribute.String("path", req.URL.Path),
 		attribute.String("code", status),
@@ -81,8 +98,7 @@ func (otc *OtelClient) RoundTrip(req *http.Request) (*http.Response, error) {
 		span.SetStatus(codes.Error, err.Error())
 		otc.Logger.Error(
 			fmt.Sprintf("Request for [%s] failed in %d miliseconds", req.URL.Path, elapsed.Milliseconds()),
-			slog.String("TraceId", parentId),
-			slog.String("SpanId", span.SpanContext().TraceID().String()),
+			logAttrs...,
 		)
 		return nil, err
 
@@ -92,20 +108,32 @@ func (otc *OtelClient) RoundTrip(req *http.Request) (*http.Response, error) {
 		span.SetStatus(codes.Error, fmt.Sprintf("Server returned [%d]", resp.StatusCode))
 		otc.Logger.Error(
 			fmt.Sprintf("Request for [%s] failed in %d miliseconds", req.URL.Path, elapsed.Milliseconds()),
-			slog.String("TraceId", parentId),
-			slog.String("SpanId", span.SpanContext().TraceID().String()),
+			logAttrs...,
 		)
-		return nil, err
+		return resp, nil
 	}
 
 	otc.Logger.Info(
 		fmt.Sprintf("Request for [%s] succeded in %d miliseconds", req.URL.Path, elapsed.Milliseconds()),
-		slog.String("TraceId", parentId),
-		slog.String("SpanId", span.SpanContext().TraceID().String()),
+		logAttrs...,
 	)
 	return resp, err
 }
 
+// withParentHeaders returns ctx with the span named by the trace headers of
+// req as the remote parent, so the request span joins the caller's trace. It
+// is local to the request, otc.Ctx is shared by every request.
+func withParentHeaders(ctx context.Context, req *http.Request) context.Context {
+	traceID, _ := trace.TraceIDFromHex(req.Header.Get(OTEL_TRACE_HEADER))
+	spanID, _ := trace.SpanIDFromHex(req.Header.Get(OTEL_SPAN_HEADER))
+	return trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+}
+
 func NewOtelClient(ctx context.Context, collectorUrl string, attr ...attribute.KeyValue) (*OtelClient, error) {
 	res, err := resource.New(ctx,
 		resource.WithAttributes(attr...),
@@ -169,11 +197,45 @@ func NewOtelClient(ctx context.Context, collectorUrl string, attr ...attribute.K
 	if err != nil {
 		return nil, err
 	}
-	return &OtelClient{
+	conns, err := newConnMetrics(metricsProvider.Meter("asdsda"))
+	if err != nil {
+		return nil, err
+	}
+	otc := &OtelClient{
 		Ctx:                   ctx,
 		Tracer:                tracerProvider,
 		Metrics:               metricsProvider,
 		HttpRequestTotalMeter: c,
 		Logger:                logger,
-	}, nil
+		ConnTrace:             connTraceEnabled(),
+		conns:                 conns,
+		exporterConn:          conn,
+	}
+	transportConfig, err := TransportConfigFromEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	otc.Base = otc.NewTransport(transportConfig)
+	return otc, nil
+}
+
+// PingExporter waits until the connection of the trace exporter to the
+// collector is ready, or ctx is done. The exporters retry in the background
+// rather than fail, so this is how readiness checks see a collector outage.
+func (otc *OtelClient) PingExporter(ctx context.Context) error {
+	if otc.exporterConn == nil {
+		return nil
+	}
+	state := otc.exporterConn.GetState()
+	for state != connectivity.Ready {
+		if state == connectivity.Shutdown {
+			return fmt.Errorf("collector connection is %s", state)
+		}
+		otc.exporterConn.Connect()
+		if !otc.exporterConn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("collector connection is %s", state)
+		}
+		state = otc.exporterConn.GetState()
+	}
+	return nil
 }
@@ -2,25 +2,57 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"app1/internal/availability"
+	"app1/internal/chaos"
+	"app1/internal/health"
+	"app1/internal/identity"
+	"app1/internal/messaging"
 	myotel "app1/internal/otel"
 
+	_ "github.com/lib/pq"
 	"go.opentelemetry.io/otel/attribute"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 type App1 struct {
 	HttpClient *http.Client
 	OtcClient  *myotel.OtelClient
+	// Publisher submits reservations to app3 asynchronously, nil when BUS
+	// is unset.
+	Publisher messaging.Publisher
+	// Availability checks books with app2 over gRPC, nil when APP2_TRANSPORT
+	// is http.
+	Availability availability.AvailabilityClient
 }
 
 var (
 	APP2_URL = "http://app2:8082/available"
 	APP3_URL = "http://app3:8083/reserve"
+	// APP2_GRPC_ADDR is used instead of APP2_URL when APP2_TRANSPORT is grpc.
+	APP2_GRPC_ADDR = "app2:9082"
+	// IDEMPOTENCY_HEADER is passed through to app3 so retried reservations
+	// are only made once.
+	IDEMPOTENCY_HEADER = "Idempotency-Key"
+	// RESERVATIONS_TOPIC is where app3 takes asynchronous reservations from.
+	RESERVATIONS_TOPIC = "reservations"
+	// app1 is ready when app2 and app3 are, whichever transport reaches app2.
+	APP2_READY_URL = "http://app2:8082/readyz"
+	APP3_READY_URL = "http://app3:8083/readyz"
 )
 
 func (a *App1) GetBook(w http.ResponseWriter, r *http.Request) {
@@ -29,18 +61,38 @@ func (a *App1) GetBook(w http.ResponseWriter, r *http.Request) {
 	time.Sleep(100 * time.Millisecond)
 
 	// request to apps 2
-	req2, err := http.NewRequest("GET", APP2_URL, nil)
-	req2.Header.Set(myotel.OTEL_TRACE_HEADER, traceId)
-	req2.Header.Set(myotel.OTEL_SPAN_HEADER, spanId)
-	resp2, err2 := a.HttpClient.Do(req2)
+	err2 := a.checkAvailability(r, traceId, spanId)
 
-	// request to apps 3
-	req3, err := http.NewRequest("GET", APP3_URL, nil)
+	// request to apps 3, for the book and member the client asked for
+	app3URL, err := url.Parse(APP3_URL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	q := app3URL.Query()
+	for _, key := range []string{"book_id", "member_id"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			q.Set(key, v)
+		}
+	}
+	app3URL.RawQuery = q.Encode()
+	req3, err := http.NewRequest("GET", app3URL.String(), nil)
 	req3.Header.Set(myotel.OTEL_TRACE_HEADER, traceId)
 	req3.Header.Set(myotel.OTEL_SPAN_HEADER, spanId)
+	if key := r.Header.Get(IDEMPOTENCY_HEADER); key != "" {
+		req3.Header.Set(IDEMPOTENCY_HEADER, key)
+	}
+	chaos.Forward(r, req3)
+	identity.Forward(r, req3)
 	resp3, err3 := a.HttpClient.Do(req3)
+	if err3 == nil {
+		// Closing the body ends the request span and returns the
+		// connection to the pool.
+		defer resp3.Body.Close()
+	}
 
-	if err != nil || err2 != nil || err3 != nil || resp2.StatusCode != 200 || resp3.StatusCode != 200 {
+	if err != nil || err2 != nil || err3 != nil || resp3.StatusCode != 200 {
 		w.WriteHeader(http.StatusInternalServerError)
 		combinedErrors := fmt.Sprintf("%s\n%s\n%s\n", err, err2, err3)
 		io.WriteString(w, combinedErrors)
@@ -51,6 +103,161 @@ func (a *App1) GetBook(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// checkAvailability asks app2 whether the book can be reserved, over gRPC when
+// Availability is set and over HTTP otherwise.
+func (a *App1) checkAvailability(r *http.Request, traceId string, spanId string) error {
+	if a.Availability == nil {
+		req, err := http.NewRequest("GET", APP2_URL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(myotel.OTEL_TRACE_HEADER, traceId)
+		req.Header.Set(myotel.OTEL_SPAN_HEADER, spanId)
+		chaos.Forward(r, req)
+		identity.Forward(r, req)
+		resp, err := a.HttpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("app2 answered %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	bookID := int64(1)
+	if v := r.URL.Query().Get("book_id"); v != "" {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil && id > 0 {
+			bookID = id
+		}
+	}
+	traceID, _ := trace.TraceIDFromHex(traceId)
+	spanID, _ := trace.SpanIDFromHex(spanId)
+	parentSpanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithSpanContext(r.Context(), parentSpanContext)
+	ctx = chaos.ForwardMetadata(ctx, r)
+
+	resp, err := a.Availability.CheckAvailability(ctx, &availability.CheckAvailabilityRequest{BookId: bookID})
+	if err != nil {
+		return err
+	}
+	if !resp.GetAvailable() {
+		return fmt.Errorf("book %d is not available: %s", bookID, resp.GetMessage())
+	}
+	return nil
+}
+
+// newAvailabilityClient returns the gRPC client selected by APP2_TRANSPORT,
+// nil for the default HTTP transport. APP2_GRPC_ADDR overrides the address.
+func newAvailabilityClient(otelClient *myotel.OtelClient) (availability.AvailabilityClient, error) {
+	switch os.Getenv("APP2_TRANSPORT") {
+	case "", "http":
+		return nil, nil
+	case "grpc":
+		addr := APP2_GRPC_ADDR
+		if v := os.Getenv("APP2_GRPC_ADDR"); v != "" {
+			addr = v
+		}
+		interceptor, err := otelClient.UnaryClientInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := grpc.NewClient(addr,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithUnaryInterceptor(interceptor),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return availability.NewAvailabilityClient(conn), nil
+	}
+	return nil, fmt.Errorf("invalid APP2_TRANSPORT [%s], expected http or grpc", os.Getenv("APP2_TRANSPORT"))
+}
+
+// ReserveAsync publishes the reservation of book_id (default 1) for member_id
+// (default 1) on the message bus and answers 202 without waiting for app3.
+func (a *App1) ReserveAsync(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if a.Publisher == nil {
+		http.Error(w, "asynchronous reservations are disabled, set BUS", http.StatusServiceUnavailable)
+		return
+	}
+
+	body := map[string]int64{"book_id": 1, "member_id": 1}
+	for key := range body {
+		if v := r.URL.Query().Get(key); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || id <= 0 {
+				http.Error(w, fmt.Sprintf("invalid %s [%s]", key, v), http.StatusBadRequest)
+				return
+			}
+			body[key] = id
+		}
+	}
+	raw, _ := json.Marshal(body)
+
+	traceID, _ := trace.TraceIDFromHex(r.Header.Get(myotel.OTEL_TRACE_HEADER))
+	spanID, _ := trace.SpanIDFromHex(r.Header.Get(myotel.OTEL_SPAN_HEADER))
+	parentSpanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithSpanContext(r.Context(), parentSpanContext)
+
+	err := a.Publisher.Publish(ctx, RESERVATIONS_TOPIC, messaging.Message{Body: raw})
+	elapsed := time.Since(start)
+	logAttrs := append([]any{slog.String("TraceId", traceID.String())}, identity.FromContext(ctx).LogAttrs()...)
+	if err != nil {
+		a.OtcClient.Logger.Error(
+			fmt.Sprintf("Publishing reservation failed in %d miliseconds with [%s]", elapsed.Milliseconds(), err),
+			logAttrs...,
+		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.OtcClient.Logger.Info(
+		fmt.Sprintf("Publishing reservation succeded in %d miliseconds", elapsed.Milliseconds()),
+		logAttrs...,
+	)
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, "ACCEPTED")
+}
+
+// newPublisher returns the instrumented publisher selected by BUS: "postgres"
+// publishes with NOTIFY on the database named by BUS_DSN, with the password
+// read from BUS_PASSWORD_FILE, "memory" only reaches this process.
+func newPublisher(otelClient *myotel.OtelClient) (messaging.Publisher, error) {
+	switch os.Getenv("BUS") {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return messaging.NewPublisher(messaging.NewMemoryBus(otelClient.Logger), "memory", otelClient.Tracer), nil
+	case "postgres":
+		dsn := os.Getenv("BUS_DSN")
+		if file := os.Getenv("BUS_PASSWORD_FILE"); file != "" {
+			password, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("could not read bus password file: %w", err)
+			}
+			dsn += " password='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(strings.TrimRight(string(password), "\r\n")) + "'"
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+		return messaging.NewPublisher(messaging.NewPostgresPublisher(db), "postgresql", otelClient.Tracer), nil
+	}
+	return nil, fmt.Errorf("invalid BUS [%s], expected none, memory or postgres", os.Getenv("BUS"))
+}
+
 func main() {
 	fmt.Println("Starting app")
 	ctx := context.TODO()
@@ -64,14 +271,36 @@ func main() {
 		panic(err)
 	}
 
+	publisher, err := newPublisher(otelClient)
+	if err != nil {
+		panic(err)
+	}
+
+	availabilityClient, err := newAvailabilityClient(otelClient)
+	if err != nil {
+		panic(err)
+	}
+
+	checker, err := health.NewChecker(otelClient.Metrics.Meter("asdsda"))
+	if err != nil {
+		panic(err)
+	}
+	checker.Add("collector", otelClient.PingExporter)
+	checker.Add("app2", health.HTTPCheck(APP2_READY_URL))
+	checker.Add("app3", health.HTTPCheck(APP3_READY_URL))
+
 	app1 := App1{
 		HttpClient: &http.Client{
 			Transport: otelClient,
 		},
-		OtcClient: otelClient,
+		OtcClient:    otelClient,
+		Publisher:    publisher,
+		Availability: availabilityClient,
 	}
 	http.HandleFunc("/reserve", app1.GetBook)
-	err = http.ListenAndServe(":8081", nil)
+	http.HandleFunc("/reserve/async", app1.ReserveAsync)
+	checker.RegisterRoutes(http.DefaultServeMux)
+	err = http.ListenAndServe(":8081", chaos.Middleware("app1", otelClient, identity.Middleware(http.DefaultServeMux)))
 	if err != nil {
 		panic(err)
 	}
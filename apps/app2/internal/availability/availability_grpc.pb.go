@@ -0,0 +1,125 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: availability.proto
+
+package availability
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Availability_CheckAvailability_FullMethodName = "/availability.v1.Availability/CheckAvailability"
+)
+
+// AvailabilityClient is the client API for Availability service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Availability is the gRPC flavour of app2's GET /available.
+type AvailabilityClient interface {
+	CheckAvailability(ctx context.Context, in *CheckAvailabilityRequest, opts ...grpc.CallOption) (*CheckAvailabilityResponse, error)
+}
+
+type availabilityClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAvailabilityClient(cc grpc.ClientConnInterface) AvailabilityClient {
+	return &availabilityClient{cc}
+}
+
+func (c *availabilityClient) CheckAvailability(ctx context.Context, in *CheckAvailabilityRequest, opts ...grpc.CallOption) (*CheckAvailabilityResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CheckAvailabilityResponse)
+	err := c.cc.Invoke(ctx, Availability_CheckAvailability_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AvailabilityServer is the server API for Availability service.
+// All implementations must embed UnimplementedAvailabilityServer
+// for forward compatibility.
+//
+// Availability is the gRPC flavour of app2's GET /available.
+type AvailabilityServer interface {
+	CheckAvailability(context.Context, *CheckAvailabilityRequest) (*CheckAvailabilityResponse, error)
+	mustEmbedUnimplementedAvailabilityServer()
+}
+
+// UnimplementedAvailabilityServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAvailabilityServer struct{}
+
+func (UnimplementedAvailabilityServer) CheckAvailability(context.Context, *CheckAvailabilityRequest) (*CheckAvailabilityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckAvailability not implemented")
+}
+func (UnimplementedAvailabilityServer) mustEmbedUnimplementedAvailabilityServer() {}
+func (UnimplementedAvailabilityServer) testEmbeddedByValue()                      {}
+
+// UnsafeAvailabilityServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AvailabilityServer will
+// result in compilation errors.
+type UnsafeAvailabilityServer interface {
+	mustEmbedUnimplementedAvailabilityServer()
+}
+
+func RegisterAvailabilityServer(s grpc.ServiceRegistrar, srv AvailabilityServer) {
+	// If the following call pancis, it indicates UnimplementedAvailabilityServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Availability_ServiceDesc, srv)
+}
+
+func _Availability_CheckAvailability_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckAvailabilityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AvailabilityServer).CheckAvailability(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Availability_CheckAvailability_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AvailabilityServer).CheckAvailability(ctx, req.(*CheckAvailabilityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Availability_ServiceDesc is the grpc.ServiceDesc for Availability service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Availability_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "availability.v1.Availability",
+	HandlerType: (*AvailabilityServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CheckAvailability",
+			Handler:    _Availability_CheckAvailability_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "availability.proto",
+}
@@ -0,0 +1,128 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	myotel "app2/internal/otel"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ParseMetadata reads the chaos directives of a gRPC call from its incoming
+// metadata, where they use the same keys as the HTTP headers.
+func ParseMetadata(md metadata.MD) (Directive, error) {
+	return parse(lookup(func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}))
+}
+
+// ForwardMetadata returns ctx with the chaos directives of an incoming HTTP
+// request added to its outgoing gRPC metadata. Directives sent as baggage
+// members are forwarded as plain keys, the gRPC client only propagates the
+// baggage of ctx.
+func ForwardMetadata(ctx context.Context, from *http.Request) context.Context {
+	kv := []string{}
+	for key, v := range lookup(from.Header.Get) {
+		kv = append(kv, key, v)
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// UnaryServerInterceptor is the gRPC counterpart of Middleware. An injected
+// status fails the call with the matching gRPC code. It must run after the
+// otel interceptor, the fault is recorded on its SERVER span.
+func UnaryServerInterceptor(service string, otc *myotel.OtelClient) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		d, err := ParseMetadata(md)
+		if err != nil {
+			otc.Logger.Warn(
+				fmt.Sprintf("Ignoring chaos directives for [%s]: %s", info.FullMethod, err),
+				slog.String("TraceId", trace.SpanContextFromContext(ctx).TraceID().String()),
+			)
+			return handler(ctx, req)
+		}
+		if d.Empty() || !strings.EqualFold(d.Target, service) {
+			return handler(ctx, req)
+		}
+
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(
+			attribute.String("chaos.target", d.Target),
+			attribute.String("chaos.path", info.FullMethod),
+			attribute.Int64("chaos.delay_ms", d.Delay.Milliseconds()),
+			attribute.Int("chaos.status", d.Status),
+		)
+
+		if d.Delay > 0 {
+			select {
+			case <-time.After(d.Delay):
+			case <-ctx.Done():
+				span.SetStatus(otelcodes.Error, ctx.Err().Error())
+				return nil, status.FromContextError(ctx.Err()).Err()
+			}
+		}
+
+		otc.Logger.Warn(
+			fmt.Sprintf("Injected chaos on [%s]: delay %d miliseconds, status %d", info.FullMethod, d.Delay.Milliseconds(), d.Status),
+			slog.String("TraceId", span.SpanContext().TraceID().String()),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		)
+
+		if d.Status != 0 {
+			code := grpcCode(d.Status)
+			span.SetAttributes(attribute.String("chaos.grpc_code", code.String()))
+			if d.Status >= 500 {
+				span.SetStatus(otelcodes.Error, fmt.Sprintf("Injected status [%d]", d.Status))
+			}
+			return nil, status.Errorf(code, "chaos: injected status %d at %s", d.Status, service)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcCode maps an injected HTTP status to the gRPC code a server answering
+// it would most likely use.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if httpStatus >= 500 {
+		return codes.Internal
+	}
+	return codes.FailedPrecondition
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"time"
 
 	"go.opentelemetry.io/contrib/bridges/otelslog"
@@ -22,6 +23,7 @@ import (
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
@@ -36,35 +38,43 @@ type OtelClient struct {
 	Metrics               *metricsdk.MeterProvider
 	HttpRequestTotalMeter metric.Int64Counter
 	Logger                *slog.Logger
+	// ConnTrace adds the connection events of every request to its span, it
+	// is on unless CONN_TRACE_ENV is false.
+	ConnTrace bool
+	// Base sends the requests of RoundTrip. NewOtelClient sets it to a
+	// transport configured by the HTTP_* variables, see
+	// TransportConfigFromEnv; nil means http.DefaultTransport.
+	Base http.RoundTripper
+
+	conns *connMetrics
+	// exporterConn is the connection of the trace exporter to the collector.
+	exporterConn *grpc.ClientConn
 }
 
 func (otc *OtelClient) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
 	tracer := otc.Tracer.Tracer("opentelemetry.io/sdk")
+	ctx := otc.Ctx
+	parentId := req.Header.Get(OTEL_TRACE_HEADER)
+	if parentId != "" {
+		ctx = withParentHeaders(ctx, req)
+	}
 	_, span := tracer.Start(
-		otc.Ctx,
+		ctx,
 		fmt.Sprintf("%s %s", req.Method, req.URL.Path),
 		trace.WithAttributes(
 			attribute.String("hostname", req.Host),
 		),
 	)
-	defer span.End()
+	// The span ends with the response body, once it is read or closed.
+	var resp *http.Response
+	defer func() { endWithBody(span, resp) }()
 
-	parentId := req.Header.Get(OTEL_TRACE_HEADER)
 	if parentId == "" {
 		req.Header.Set(OTEL_TRACE_HEADER, span.SpanContext().TraceID().String())
-	} else {
-		traceID, _ := trace.TraceIDFromHex(parentId)
-		parentSpanContext := trace.NewSpanContext(trace.SpanContextConfig{
-			TraceID:    traceID,
-			SpanID:     span.SpanContext().SpanID(),
-			TraceFlags: trace.FlagsSampled,
-			Remote:     true,
-		})
-		otc.Ctx = trace.ContextWithSpanContext(otc.Ctx, parentSpanContext)
 	}
 
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	resp, err := otc.roundTrip(req, span, start)
 	elapsed := time.Since(start)
 	if err != nil {
 		otc.Logger.Error(
@@ -84,7 +94,7 @@ func (otc *OtelClient) RoundTrip(req *http.Request) (*http.Response, error) {
 	if resp != nil {
 		status = fmt.Sprintf("%d", resp.StatusCode)
 	}
-	otc.HttpRequestTotalMeter.Add(otc.Ctx, 1, metric.WithAttributes(
+	otc.HttpRequestTotalMeter.Add(req.Context(), 1, metric.WithAttributes(
 		attribute.String("method", req.Method),
 		attribute.String("path", req.URL.Path),
 		attribute.String("code", status),
@@ -96,6 +106,20 @@ func (otc *OtelClient) RoundTrip(req *http.Request) (*http.Response, error) {
 	return resp, err
 }
 
+// withParentHeaders returns ctx with the span named by the trace headers of
+// req as the remote parent, so the request span joins the caller's trace. It
+// is local to the request, otc.Ctx is shared by every request.
+func withParentHeaders(ctx context.Context, req *http.Request) context.Context {
+	traceID, _ := trace.TraceIDFromHex(req.Header.Get(OTEL_TRACE_HEADER))
+	spanID, _ := trace.SpanIDFromHex(req.Header.Get(OTEL_SPAN_HEADER))
+	return trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+}
+
 func NewOtelClient(ctx context.Context, collectorUrl string, attr ...attribute.KeyValue) (*OtelClient, error) {
 	res, err := resource.New(ctx,
 		resource.WithAttributes(attr...),
@@ -159,11 +183,45 @@ func NewOtelClient(ctx context.Context, collectorUrl string, attr ...attribute.K
 	if err != nil {
 		return nil, err
 	}
-	return &OtelClient{
+	conns, err := newConnMetrics(metricsProvider.Meter("asdsda"))
+	if err != nil {
+		return nil, err
+	}
+	otc := &OtelClient{
 		Ctx:                   ctx,
 		Tracer:                tracerProvider,
 		Metrics:               metricsProvider,
 		HttpRequestTotalMeter: c,
 		Logger:                logger,
-	}, nil
+		ConnTrace:             connTraceEnabled(),
+		conns:                 conns,
+		exporterConn:          conn,
+	}
+	transportConfig, err := TransportConfigFromEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	otc.Base = otc.NewTransport(transportConfig)
+	return otc, nil
+}
+
+// PingExporter waits until the connection of the trace exporter to the
+// collector is ready, or ctx is done. The exporters retry in the background
+// rather than fail, so this is how readiness checks see a collector outage.
+func (otc *OtelClient) PingExporter(ctx context.Context) error {
+	if otc.exporterConn == nil {
+		return nil
+	}
+	state := otc.exporterConn.GetState()
+	for state != connectivity.Ready {
+		if state == connectivity.Shutdown {
+			return fmt.Errorf("collector connection is %s", state)
+		}
+		otc.exporterConn.Connect()
+		if !otc.exporterConn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("collector connection is %s", state)
+		}
+		state = otc.exporterConn.GetState()
+	}
+	return nil
 }
@@ -5,19 +5,28 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
+	"app2/internal/availability"
+	"app2/internal/chaos"
+	"app2/internal/health"
+	"app2/internal/identity"
 	myotel "app2/internal/otel"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
 var (
 	OTEL_SPAN_HEADER = "x-otel-span-id"
+	// GRPC_ADDR is where the gRPC flavour of /available is served.
+	GRPC_ADDR = ":9082"
 )
 
 type app2 struct {
@@ -39,6 +48,7 @@ func (a *app2) GetBook(w http.ResponseWriter, r *http.Request) {
 	})
 	ctx := trace.ContextWithSpanContext(context.Background(), parentSpanContext)
 
+	id := identity.Parse(r)
 	tracer := a.otc.Tracer.Tracer("opentelemetry.io/sdk")
 	_, span := tracer.Start(
 		ctx,
@@ -46,6 +56,7 @@ func (a *app2) GetBook(w http.ResponseWriter, r *http.Request) {
 		trace.WithAttributes(
 			attribute.String("hostname", "locahost"),
 		),
+		trace.WithAttributes(id.Attributes()...),
 	)
 	defer span.End()
 	time.Sleep(200 * time.Millisecond)
@@ -53,8 +64,10 @@ func (a *app2) GetBook(w http.ResponseWriter, r *http.Request) {
 	elapsed := time.Since(start)
 	a.otc.Logger.Info(
 		fmt.Sprintf("Validation for book succeded in %d miliseconds", elapsed.Milliseconds()),
-		slog.String("TraceId", traceID.String()),
-		slog.String("SpanId", span.SpanContext().TraceID().String()),
+		append([]any{
+			slog.String("TraceId", traceID.String()),
+			slog.String("SpanId", span.SpanContext().TraceID().String()),
+		}, id.LogAttrs()...)...,
 	)
 
 	a.otc.HttpRequestTotalMeter.Add(a.otc.Ctx, 1, metric.WithAttributes(
@@ -66,6 +79,30 @@ func (a *app2) GetBook(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "GOOD!")
 }
 
+// availabilityServer serves GetBook over gRPC. The SERVER span and the
+// rpc.server.duration metric come from the interceptor.
+type availabilityServer struct {
+	availability.UnimplementedAvailabilityServer
+	otc *myotel.OtelClient
+}
+
+func (s *availabilityServer) CheckAvailability(ctx context.Context, req *availability.CheckAvailabilityRequest) (*availability.CheckAvailabilityResponse, error) {
+	start := time.Now()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int64("book.id", req.GetBookId()))
+	time.Sleep(200 * time.Millisecond)
+
+	elapsed := time.Since(start)
+	s.otc.Logger.Info(
+		fmt.Sprintf("Validation for book %d succeded in %d miliseconds", req.GetBookId(), elapsed.Milliseconds()),
+		append([]any{
+			slog.String("TraceId", span.SpanContext().TraceID().String()),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		}, identity.FromContext(ctx).LogAttrs()...)...,
+	)
+	return &availability.CheckAvailabilityResponse{Available: true, Message: "GOOD!"}, nil
+}
+
 func toggleFailure(w http.ResponseWriter, r *http.Request) {
 	for range 100 {
 		go func() {
@@ -78,6 +115,39 @@ func toggleFailure(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "BOOM?")
 }
 
+// burnCPU is a bounded version of toggleFailure: it keeps `cpus` goroutines
+// spinning for `duration` and then lets them go.
+func (a *app2) burnCPU(w http.ResponseWriter, r *http.Request) {
+	cpus, err := strconv.Atoi(r.URL.Query().Get("cpus"))
+	if err != nil || cpus <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "cpus must be a positive integer")
+		return
+	}
+	duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || duration <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "duration must be a positive duration")
+		return
+	}
+
+	deadline := time.Now().Add(duration)
+	for range cpus {
+		go func() {
+			i := 0
+			for time.Now().Before(deadline) {
+				i++
+			}
+		}()
+	}
+	a.otc.Logger.Warn(
+		fmt.Sprintf("Burning %d CPUs for %s", cpus, duration),
+		slog.Int("cpus", cpus),
+		slog.String("duration", duration.String()),
+	)
+	io.WriteString(w, fmt.Sprintf("burning %d CPUs until %s", cpus, deadline.Format(time.RFC3339)))
+}
+
 func main() {
 	fmt.Println("Starting app")
 	ctx := context.TODO()
@@ -94,9 +164,32 @@ func main() {
 	app2 := app2{
 		otc: otelClient,
 	}
+	checker, err := health.NewChecker(otelClient.Metrics.Meter("asdsda"))
+	if err != nil {
+		panic(err)
+	}
+	checker.Add("collector", otelClient.PingExporter)
+	interceptor, err := otelClient.UnaryServerInterceptor()
+	if err != nil {
+		panic(err)
+	}
+	listener, err := net.Listen("tcp", GRPC_ADDR)
+	if err != nil {
+		panic(err)
+	}
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptor, chaos.UnaryServerInterceptor("app2", otelClient)))
+	availability.RegisterAvailabilityServer(server, &availabilityServer{otc: otelClient})
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			panic(err)
+		}
+	}()
+
 	http.HandleFunc("/available", app2.GetBook)
 	http.HandleFunc("/toggle", toggleFailure)
-	err = http.ListenAndServe(":8082", nil)
+	http.HandleFunc("/burn", app2.burnCPU)
+	checker.RegisterRoutes(http.DefaultServeMux)
+	err = http.ListenAndServe(":8082", chaos.Middleware("app2", otelClient, http.DefaultServeMux))
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,501 @@
+// Package config loads the app3 configuration. Values are resolved, from
+// lowest to highest precedence, from the defaults, an optional JSON config
+// file (-config or APP3_CONFIG), environment variables and command line flags.
+//
+// The database password is never read from the config file: it comes from the
+// file named by -db-password-file / DB_PASSWORD_FILE, or from DB_PASSWORD.
+package config
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var SSL_MODES = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// REPOSITORIES are the library storage backends. "memory" keeps everything in
+// process and needs no database.
+var REPOSITORIES = []string{"postgres", "memory"}
+
+var OUTBOX_SINKS = []string{"log", "webhook", "memory"}
+
+// BUSES are the message bus backends app3 can take reservations from. "none"
+// disables asynchronous reservations.
+var BUSES = []string{"none", "memory", "postgres"}
+
+type Config struct {
+	ListenAddr   string `json:"listen_addr"`
+	CollectorURL string `json:"collector_url"`
+	Repository   string `json:"repository"`
+	Memory       Memory `json:"memory"`
+	// IdempotencyTTL is how long the response to a request carrying an
+	// Idempotency-Key is kept for replay.
+	IdempotencyTTL Duration     `json:"idempotency_ttl"`
+	Outbox         OutboxConfig `json:"outbox"`
+	Bus            string       `json:"bus"`
+	DB             DBConfig     `json:"db"`
+}
+
+// Memory configures the in-memory repository.
+type Memory struct {
+	Latency Duration `json:"latency"`
+}
+
+// OutboxConfig configures the relay publishing the outbox events.
+type OutboxConfig struct {
+	// Sink is one of OUTBOX_SINKS.
+	Sink       string   `json:"sink"`
+	WebhookURL string   `json:"webhook_url,omitempty"`
+	Interval   Duration `json:"interval"`
+	BatchSize  int      `json:"batch_size"`
+}
+
+type DBConfig struct {
+	Host           string     `json:"host"`
+	Port           int        `json:"port"`
+	User           string     `json:"user"`
+	Name           string     `json:"name"`
+	Password       string     `json:"-"`
+	PasswordFile   string     `json:"password_file,omitempty"`
+	SSLMode        string     `json:"sslmode"`
+	SSLRootCert    string     `json:"sslrootcert,omitempty"`
+	SSLCert        string     `json:"sslcert,omitempty"`
+	SSLKey         string     `json:"sslkey,omitempty"`
+	ConnectTimeout Duration   `json:"connect_timeout"`
+	Pool           PoolConfig `json:"pool"`
+	// SlowQueryThreshold is the statement duration above which a slow
+	// query log record is written, 0 disables the log.
+	SlowQueryThreshold Duration `json:"slow_query_threshold"`
+	// ApplicationName is reported by Postgres in pg_stat_activity and the
+	// server logs for every app3 connection.
+	ApplicationName string `json:"application_name"`
+	// SQLComment tags every statement with a sqlcommenter comment holding
+	// the traceparent, service and route that issued it.
+	SQLComment bool `json:"sql_comment"`
+}
+
+type PoolConfig struct {
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+	ConnMaxIdleTime Duration `json:"conn_max_idle_time"`
+}
+
+func (p PoolConfig) Apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(p.ConnMaxLifetime))
+	db.SetConnMaxIdleTime(time.Duration(p.ConnMaxIdleTime))
+}
+
+// Duration is a time.Duration written as a Go duration string, e.g. "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
+
+func Default() Config {
+	return Config{
+		ListenAddr:     ":8083",
+		CollectorURL:   "collector:14317",
+		Repository:     "postgres",
+		IdempotencyTTL: Duration(24 * time.Hour),
+		Bus:            "none",
+		Outbox: OutboxConfig{
+			Sink:      "log",
+			Interval:  Duration(time.Second),
+			BatchSize: 100,
+		},
+		DB: DBConfig{
+			Host:            "postgres",
+			Port:            5432,
+			User:            "app3",
+			Name:            "library",
+			SSLMode:         "disable",
+			ApplicationName: "app3",
+			ConnectTimeout:  Duration(5 * time.Second),
+			Pool: PoolConfig{
+				MaxOpenConns:    10,
+				MaxIdleConns:    5,
+				ConnMaxLifetime: Duration(30 * time.Minute),
+				ConnMaxIdleTime: Duration(5 * time.Minute),
+			},
+			SlowQueryThreshold: Duration(500 * time.Millisecond),
+		},
+	}
+}
+
+// binding ties a setting to its environment variable and flag.
+type binding struct {
+	env  string
+	flag string
+	help string
+	// value points into the Config being loaded and implements flag.Value
+	value flag.Value
+}
+
+type intValue struct{ p *int }
+
+func (v intValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v.p = n
+	return nil
+}
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) String() string {
+	if v.p == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*v.p)
+}
+
+func (v boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v.p = b
+	return nil
+}
+
+// IsBoolFlag lets the flag be given as -db-sql-comment without a value.
+func (v boolValue) IsBoolFlag() bool {
+	return true
+}
+
+type stringValue struct{ p *string }
+
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+func bindings(c *Config) []binding {
+	return []binding{
+		{"APP3_LISTEN_ADDR", "listen", "HTTP listen address", stringValue{&c.ListenAddr}},
+		{"APP3_COLLECTOR_URL", "collector", "OTLP gRPC collector address", stringValue{&c.CollectorURL}},
+		{"APP3_REPOSITORY", "repository", "library storage: " + strings.Join(REPOSITORIES, ", "), stringValue{&c.Repository}},
+		{"APP3_MEMORY_LATENCY", "memory-latency", "latency added to every in-memory repository call", &c.Memory.Latency},
+		{"APP3_IDEMPOTENCY_TTL", "idempotency-ttl", "how long responses to Idempotency-Key requests are replayed", &c.IdempotencyTTL},
+		{"APP3_OUTBOX_SINK", "outbox-sink", "where outbox events are published: " + strings.Join(OUTBOX_SINKS, ", "), stringValue{&c.Outbox.Sink}},
+		{"APP3_OUTBOX_WEBHOOK_URL", "outbox-webhook-url", "URL the webhook sink POSTs events to", stringValue{&c.Outbox.WebhookURL}},
+		{"APP3_OUTBOX_INTERVAL", "outbox-interval", "how often the outbox is polled", &c.Outbox.Interval},
+		{"APP3_OUTBOX_BATCH_SIZE", "outbox-batch-size", "maximum events published per poll", intValue{&c.Outbox.BatchSize}},
+		{"APP3_BUS", "bus", "message bus for asynchronous reservations: " + strings.Join(BUSES, ", "), stringValue{&c.Bus}},
+		{"DB_HOST", "db-host", "Postgres host", stringValue{&c.DB.Host}},
+		{"DB_PORT", "db-port", "Postgres port", intValue{&c.DB.Port}},
+		{"DB_USER", "db-user", "Postgres user", stringValue{&c.DB.User}},
+		{"DB_NAME", "db-name", "Postgres database", stringValue{&c.DB.Name}},
+		{"DB_PASSWORD_FILE", "db-password-file", "file holding the Postgres password", stringValue{&c.DB.PasswordFile}},
+		{"DB_SSLMODE", "db-sslmode", "Postgres sslmode: " + strings.Join(SSL_MODES, ", "), stringValue{&c.DB.SSLMode}},
+		{"DB_SSLROOTCERT", "db-sslrootcert", "CA certificate used to verify the server", stringValue{&c.DB.SSLRootCert}},
+		{"DB_SSLCERT", "db-sslcert", "client certificate", stringValue{&c.DB.SSLCert}},
+		{"DB_SSLKEY", "db-sslkey", "client certificate key", stringValue{&c.DB.SSLKey}},
+		{"DB_APPLICATION_NAME", "db-application-name", "application_name reported to Postgres", stringValue{&c.DB.ApplicationName}},
+		{"DB_SQL_COMMENT", "db-sql-comment", "tag statements with a sqlcommenter traceparent comment", boolValue{&c.DB.SQLComment}},
+		{"DB_CONNECT_TIMEOUT", "db-connect-timeout", "Postgres connect timeout", &c.DB.ConnectTimeout},
+		{"DB_MAX_OPEN_CONNS", "db-max-open-conns", "maximum open connections, 0 is unlimited", intValue{&c.DB.Pool.MaxOpenConns}},
+		{"DB_MAX_IDLE_CONNS", "db-max-idle-conns", "maximum idle connections", intValue{&c.DB.Pool.MaxIdleConns}},
+		{"DB_CONN_MAX_LIFETIME", "db-conn-max-lifetime", "maximum connection lifetime, 0 is unlimited", &c.DB.Pool.ConnMaxLifetime},
+		{"DB_CONN_MAX_IDLE_TIME", "db-conn-max-idle-time", "maximum connection idle time, 0 is unlimited", &c.DB.Pool.ConnMaxIdleTime},
+		{"DB_SLOW_QUERY_THRESHOLD", "db-slow-query-threshold", "log statements slower than this, 0 disables the log", &c.DB.SlowQueryThreshold},
+	}
+}
+
+// Load resolves the configuration from args (without the program name) and
+// the environment. It returns the arguments left after the flags, e.g. a
+// `migrate up` subcommand.
+func Load(args []string, getenv func(string) string) (*Config, []string, error) {
+	// Flags are parsed into a scratch config first so that only the flags
+	// actually set on the command line override the file and environment.
+	fromFlags := Default()
+	fs := flag.NewFlagSet("app3", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("APP3_CONFIG"), "optional JSON config file (env APP3_CONFIG)")
+	for _, b := range bindings(&fromFlags) {
+		fs.Var(b.value, b.flag, fmt.Sprintf("%s (env %s)", b.help, b.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	c := Default()
+	if *configFile != "" {
+		if err := loadFile(*configFile, &c); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, b := range bindings(&c) {
+		if set[b.flag] {
+			if err := b.value.Set(fs.Lookup(b.flag).Value.String()); err != nil {
+				return nil, nil, fmt.Errorf("invalid -%s: %w", b.flag, err)
+			}
+			continue
+		}
+		if v := getenv(b.env); v != "" {
+			if err := b.value.Set(v); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s [%s]: %w", b.env, v, err)
+			}
+		}
+	}
+
+	if c.DB.PasswordFile != "" {
+		raw, err := os.ReadFile(c.DB.PasswordFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read db password file: %w", err)
+		}
+		c.DB.Password = strings.TrimRight(string(raw), "\r\n")
+	} else {
+		c.DB.Password = getenv("DB_PASSWORD")
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return &c, fs.Args(), nil
+}
+
+func loadFile(path string, c *Config) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	errs := []error{}
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen address is required"))
+	}
+	if c.CollectorURL == "" {
+		errs = append(errs, errors.New("collector url is required"))
+	}
+	if c.IdempotencyTTL <= 0 {
+		errs = append(errs, errors.New("idempotency ttl must be positive"))
+	}
+	validSink := false
+	for _, sink := range OUTBOX_SINKS {
+		validSink = validSink || c.Outbox.Sink == sink
+	}
+	if !validSink {
+		errs = append(errs, fmt.Errorf("invalid outbox sink [%s], expected one of %s", c.Outbox.Sink, strings.Join(OUTBOX_SINKS, ", ")))
+	}
+	if c.Outbox.Sink == "webhook" && c.Outbox.WebhookURL == "" {
+		errs = append(errs, errors.New("outbox webhook url is required with the webhook sink"))
+	}
+	if c.Outbox.Interval <= 0 || c.Outbox.BatchSize <= 0 {
+		errs = append(errs, errors.New("outbox interval and batch size must be positive"))
+	}
+	validBus := false
+	for _, bus := range BUSES {
+		validBus = validBus || c.Bus == bus
+	}
+	if !validBus {
+		errs = append(errs, fmt.Errorf("invalid bus [%s], expected one of %s", c.Bus, strings.Join(BUSES, ", ")))
+	}
+	if c.Bus == "postgres" && c.Repository != "postgres" {
+		errs = append(errs, errors.New("the postgres bus needs the postgres repository"))
+	}
+	switch c.Repository {
+	case "memory":
+		if c.Memory.Latency < 0 {
+			errs = append(errs, errors.New("memory latency must not be negative"))
+		}
+		// The database settings are unused without Postgres.
+		return errors.Join(errs...)
+	case "postgres":
+	default:
+		errs = append(errs, fmt.Errorf("invalid repository [%s], expected one of %s", c.Repository, strings.Join(REPOSITORIES, ", ")))
+	}
+	if c.DB.Host == "" || strings.ContainsAny(c.DB.Host, " /'\\") {
+		errs = append(errs, fmt.Errorf("invalid db host [%s]", c.DB.Host))
+	}
+	if c.DB.Port < 1 || c.DB.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid db port [%d]", c.DB.Port))
+	}
+	if c.DB.User == "" {
+		errs = append(errs, errors.New("db user is required"))
+	}
+	if c.DB.Name == "" {
+		errs = append(errs, errors.New("db name is required"))
+	}
+	if c.DB.Password == "" {
+		errs = append(errs, errors.New("db password is required, set DB_PASSWORD_FILE or DB_PASSWORD"))
+	}
+
+	validMode := false
+	for _, m := range SSL_MODES {
+		validMode = validMode || c.DB.SSLMode == m
+	}
+	if !validMode {
+		errs = append(errs, fmt.Errorf("invalid db sslmode [%s], expected one of %s", c.DB.SSLMode, strings.Join(SSL_MODES, ", ")))
+	}
+	if (c.DB.SSLCert == "") != (c.DB.SSLKey == "") {
+		errs = append(errs, errors.New("db sslcert and sslkey must be set together"))
+	}
+	for _, f := range []string{c.DB.SSLRootCert, c.DB.SSLCert, c.DB.SSLKey} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			errs = append(errs, fmt.Errorf("db tls file: %w", err))
+		}
+	}
+
+	if c.DB.ConnectTimeout < 0 {
+		errs = append(errs, errors.New("db connect timeout must not be negative"))
+	}
+	if c.DB.Pool.MaxOpenConns < 0 || c.DB.Pool.MaxIdleConns < 0 || c.DB.Pool.ConnMaxLifetime < 0 || c.DB.Pool.ConnMaxIdleTime < 0 {
+		errs = append(errs, errors.New("db pool settings must not be negative"))
+	}
+	if c.DB.SlowQueryThreshold < 0 {
+		errs = append(errs, errors.New("db slow query threshold must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// quote escapes a libpq key/value connection string value.
+func quote(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// DSN returns the lib/pq connection string for the database.
+func (d DBConfig) DSN() string {
+	parts := []string{
+		"host=" + quote(d.Host),
+		"port=" + strconv.Itoa(d.Port),
+		"user=" + quote(d.User),
+		"password=" + quote(d.Password),
+		"dbname=" + quote(d.Name),
+		"sslmode=" + quote(d.SSLMode),
+	}
+	if d.SSLRootCert != "" {
+		parts = append(parts, "sslrootcert="+quote(d.SSLRootCert))
+	}
+	if d.SSLCert != "" {
+		parts = append(parts, "sslcert="+quote(d.SSLCert), "sslkey="+quote(d.SSLKey))
+	}
+	if d.ApplicationName != "" {
+		parts = append(parts, "application_name="+quote(d.ApplicationName))
+	}
+	if d.ConnectTimeout > 0 {
+		seconds := int(time.Duration(d.ConnectTimeout).Round(time.Second).Seconds())
+		parts = append(parts, "connect_timeout="+strconv.Itoa(max(seconds, 1)))
+	}
+	return strings.Join(parts, " ")
+}
+
+const REDACTED = "<redacted>"
+
+type redactedDB struct {
+	DBConfig
+	Password string `json:"password"`
+}
+
+type redacted struct {
+	ListenAddr     string       `json:"listen_addr"`
+	CollectorURL   string       `json:"collector_url"`
+	Repository     string       `json:"repository"`
+	Memory         Memory       `json:"memory"`
+	IdempotencyTTL Duration     `json:"idempotency_ttl"`
+	Outbox         OutboxConfig `json:"outbox"`
+	Bus            string       `json:"bus"`
+	DB             redactedDB   `json:"db"`
+}
+
+// redactURL masks the userinfo and the query of raw, where webhook URLs
+// usually carry their token, e.g. https://<redacted>@hooks.local/x?<redacted>.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		if raw == "" {
+			return ""
+		}
+		return REDACTED
+	}
+	s := u.Scheme + "://"
+	if u.User != nil {
+		s += REDACTED + "@"
+	}
+	s += u.Host + u.EscapedPath()
+	if u.RawQuery != "" {
+		s += "?" + REDACTED
+	}
+	return s
+}
+
+// Redacted returns a JSON friendly view of the configuration with the
+// password and the credentials of the webhook URL masked.
+func (c Config) Redacted() any {
+	password := ""
+	if c.DB.Password != "" {
+		password = REDACTED
+	}
+	outbox := c.Outbox
+	outbox.WebhookURL = redactURL(outbox.WebhookURL)
+	return redacted{
+		ListenAddr:     c.ListenAddr,
+		CollectorURL:   c.CollectorURL,
+		Repository:     c.Repository,
+		Memory:         c.Memory,
+		IdempotencyTTL: c.IdempotencyTTL,
+		Outbox:         outbox,
+		Bus:            c.Bus,
+		DB:             redactedDB{DBConfig: c.DB, Password: password},
+	}
+}
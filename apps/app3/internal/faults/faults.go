@@ -0,0 +1,395 @@
+package faults
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	myotel "app3/internal/otel"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type Mode string
+
+const (
+	SyntheticError Mode = "error"
+	SlowQuery      Mode = "slow"
+	PoolExhaustion Mode = "pool"
+	WrongRowCount  Mode = "rowcount"
+	Intermittent   Mode = "intermittent"
+)
+
+var MODES = []Mode{SyntheticError, SlowQuery, PoolExhaustion, WrongRowCount, Intermittent}
+
+// Params tune how an enabled mode behaves. Only the fields relevant to a mode
+// are used, the rest are ignored.
+type Params struct {
+	Message string        `json:"message,omitempty"`
+	Delay   time.Duration `json:"-"`
+	Offset  int           `json:"offset,omitempty"`
+	Percent float64       `json:"percent,omitempty"`
+}
+
+func (p Params) MarshalJSON() ([]byte, error) {
+	type alias Params
+	delay := ""
+	if p.Delay > 0 {
+		delay = p.Delay.String()
+	}
+	return json.Marshal(struct {
+		alias
+		Delay string `json:"delay,omitempty"`
+	}{alias(p), delay})
+}
+
+func defaultParams(m Mode) Params {
+	switch m {
+	case SyntheticError:
+		return Params{Message: "synthetic database error"}
+	case SlowQuery:
+		return Params{Delay: 2 * time.Second}
+	case PoolExhaustion:
+		return Params{Message: "too many open connections", Delay: 500 * time.Millisecond}
+	case WrongRowCount:
+		return Params{Offset: -1}
+	case Intermittent:
+		return Params{Message: "intermittent database error", Percent: 10}
+	}
+	return Params{}
+}
+
+type State struct {
+	Mode    Mode       `json:"mode"`
+	Enabled bool       `json:"enabled"`
+	Params  Params     `json:"params"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+type entry struct {
+	enabled atomic.Bool
+	params  atomic.Pointer[Params]
+	since   atomic.Int64
+}
+
+type Registry struct {
+	otc   *myotel.OtelClient
+	modes map[Mode]*entry
+	// mu serializes changes so the enabled flag, params and log events of a
+	// mode are always consistent with each other. Reads are lock free.
+	mu sync.Mutex
+}
+
+func NewRegistry(otc *myotel.OtelClient) (*Registry, error) {
+	r := &Registry{
+		otc:   otc,
+		modes: map[Mode]*entry{},
+	}
+	for _, m := range MODES {
+		e := &entry{}
+		p := defaultParams(m)
+		e.params.Store(&p)
+		r.modes[m] = e
+	}
+
+	_, err := otc.Metrics.Meter("asdsda").Int64ObservableGauge(
+		"faults.mode.enabled",
+		metric.WithDescription("1 when the fault mode is enabled, 0 otherwise"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for _, m := range MODES {
+				v := int64(0)
+				if r.modes[m].enabled.Load() {
+					v = 1
+				}
+				o.Observe(v, metric.WithAttributes(attribute.String("mode", string(m))))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Registry) lookup(m Mode) (*entry, error) {
+	e, ok := r.modes[m]
+	if !ok {
+		return nil, fmt.Errorf("unknown fault mode [%s]", m)
+	}
+	return e, nil
+}
+
+func (r *Registry) Enabled(m Mode) bool {
+	e, ok := r.modes[m]
+	return ok && e.enabled.Load()
+}
+
+func (r *Registry) Params(m Mode) Params {
+	e, ok := r.modes[m]
+	if !ok {
+		return Params{}
+	}
+	return *e.params.Load()
+}
+
+func (r *Registry) Enable(m Mode, p Params) error {
+	e, err := r.lookup(m)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enable(m, e, p)
+	return nil
+}
+
+func (r *Registry) Disable(m Mode) error {
+	e, err := r.lookup(m)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disable(m, e)
+	return nil
+}
+
+// Toggle flips a mode keeping its current params and returns the new state.
+// The state is read and flipped under the lock, so concurrent toggles each
+// flip it once.
+func (r *Registry) Toggle(m Mode) (bool, error) {
+	e, err := r.lookup(m)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.enabled.Load() {
+		r.disable(m, e)
+		return false, nil
+	}
+	r.enable(m, e, *e.params.Load())
+	return true, nil
+}
+
+// enable and disable must be called with mu held.
+func (r *Registry) enable(m Mode, e *entry, p Params) {
+	e.params.Store(&p)
+	e.since.Store(time.Now().UnixNano())
+	e.enabled.Store(true)
+	r.otc.Logger.Warn(
+		fmt.Sprintf("Fault mode [%s] enabled", m),
+		slog.String("mode", string(m)),
+		slog.Any("params", p),
+	)
+}
+
+func (r *Registry) disable(m Mode, e *entry) {
+	if !e.enabled.Swap(false) {
+		return
+	}
+	e.since.Store(time.Now().UnixNano())
+	r.otc.Logger.Info(
+		fmt.Sprintf("Fault mode [%s] disabled", m),
+		slog.String("mode", string(m)),
+	)
+}
+
+func (r *Registry) Get(m Mode) (State, error) {
+	e, err := r.lookup(m)
+	if err != nil {
+		return State{}, err
+	}
+	s := State{
+		Mode:    m,
+		Enabled: e.enabled.Load(),
+		Params:  *e.params.Load(),
+	}
+	if s.Enabled {
+		since := time.Unix(0, e.since.Load())
+		s.Since = &since
+	}
+	return s, nil
+}
+
+func (r *Registry) List() []State {
+	states := make([]State, 0, len(MODES))
+	for _, m := range MODES {
+		s, _ := r.Get(m)
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Mode < states[j].Mode })
+	return states
+}
+
+// Fault is returned by Before when an enabled mode makes the query fail.
+type Fault struct {
+	Mode    Mode
+	Message string
+}
+
+func (f *Fault) Error() string {
+	return f.Message
+}
+
+// Before applies the modes that act ahead of a request: it sleeps for the pool
+// exhaustion mode and returns a *Fault when the request must fail. The slow
+// query mode is applied per statement by Slow.
+func (r *Registry) Before(ctx context.Context) error {
+	if r.Enabled(SyntheticError) {
+		return &Fault{Mode: SyntheticError, Message: r.Params(SyntheticError).Message}
+	}
+	if r.Enabled(PoolExhaustion) {
+		p := r.Params(PoolExhaustion)
+		if err := sleep(ctx, p.Delay); err != nil {
+			return err
+		}
+		return &Fault{Mode: PoolExhaustion, Message: p.Message}
+	}
+	if r.Enabled(Intermittent) {
+		p := r.Params(Intermittent)
+		if rand.Float64()*100 < p.Percent {
+			return &Fault{Mode: Intermittent, Message: p.Message}
+		}
+	}
+	return nil
+}
+
+// Ping is the readiness check of the registry: it fails while a mode that
+// fails every request is enabled, so an injected outage shows up in /readyz
+// like a real one.
+func (r *Registry) Ping(ctx context.Context) error {
+	for _, m := range []Mode{SyntheticError, PoolExhaustion} {
+		if r.Enabled(m) {
+			return fmt.Errorf("fault mode [%s] is enabled", m)
+		}
+	}
+	return nil
+}
+
+// Slow sleeps for the slow query mode. It is meant to run inside the span of
+// the statement being slowed down, so the delay shows up on the statement
+// itself in traces and in db.client.operation.duration.
+func (r *Registry) Slow(ctx context.Context) error {
+	if !r.Enabled(SlowQuery) {
+		return nil
+	}
+	return sleep(ctx, r.Params(SlowQuery).Delay)
+}
+
+// AdjustRows applies the wrong row count mode to a query result of n rows and
+// returns how many rows it should have, fewer or more than n.
+func (r *Registry) AdjustRows(n int) int {
+	if !r.Enabled(WrongRowCount) {
+		return n
+	}
+	n += r.Params(WrongRowCount).Offset
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func parseParams(m Mode, r *http.Request) (Params, error) {
+	p := defaultParams(m)
+	q := r.URL.Query()
+	if v := q.Get("message"); v != "" {
+		p.Message = v
+	}
+	if v := q.Get("delay"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return p, fmt.Errorf("invalid delay [%s]", v)
+		}
+		p.Delay = d
+	}
+	if v := q.Get("offset"); v != "" {
+		o, err := strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid offset [%s]", v)
+		}
+		p.Offset = o
+	}
+	if v := q.Get("percent"); v != "" {
+		pct, err := strconv.ParseFloat(v, 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return p, fmt.Errorf("invalid percent [%s]", v)
+		}
+		p.Percent = pct
+	}
+	return p, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// RegisterRoutes exposes the registry over HTTP:
+//
+//	GET  /faults                list every mode
+//	GET  /faults/{mode}         inspect a mode
+//	POST /faults/{mode}/enable  enable a mode, params come from the query string
+//	POST /faults/{mode}/disable disable a mode
+func (r *Registry) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /faults", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.List())
+	})
+	mux.HandleFunc("GET /faults/{mode}", func(w http.ResponseWriter, req *http.Request) {
+		s, err := r.Get(Mode(req.PathValue("mode")))
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	})
+	mux.HandleFunc("POST /faults/{mode}/enable", func(w http.ResponseWriter, req *http.Request) {
+		m := Mode(req.PathValue("mode"))
+		if _, err := r.lookup(m); err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		p, err := parseParams(m, req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		r.Enable(m, p)
+		s, _ := r.Get(m)
+		writeJSON(w, http.StatusOK, s)
+	})
+	mux.HandleFunc("POST /faults/{mode}/disable", func(w http.ResponseWriter, req *http.Request) {
+		m := Mode(req.PathValue("mode"))
+		if err := r.Disable(m); err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		s, _ := r.Get(m)
+		writeJSON(w, http.StatusOK, s)
+	})
+}
@@ -0,0 +1,274 @@
+package faults
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	myotel "app3/internal/otel"
+
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func newRegistry(t *testing.T) *Registry {
+	t.Helper()
+	r, err := NewRegistry(&myotel.OtelClient{
+		Ctx:     context.Background(),
+		Tracer:  sdktrace.NewTracerProvider(),
+		Metrics: metricsdk.NewMeterProvider(),
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestEnableDisable(t *testing.T) {
+	r := newRegistry(t)
+	for _, s := range r.List() {
+		if s.Enabled {
+			t.Fatalf("expected every mode disabled at start, got %+v", s)
+		}
+	}
+
+	if err := r.Enable(SyntheticError, Params{Message: "boom"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.Get(SyntheticError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Enabled || s.Params.Message != "boom" || s.Since == nil {
+		t.Errorf("expected error mode enabled with message boom, got %+v", s)
+	}
+
+	if err := r.Disable(SyntheticError); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := r.Get(SyntheticError); s.Enabled || s.Since != nil {
+		t.Errorf("expected error mode disabled, got %+v", s)
+	}
+	// Disabling keeps the params for the next Toggle.
+	if p := r.Params(SyntheticError); p.Message != "boom" {
+		t.Errorf("expected params to be kept, got %+v", p)
+	}
+}
+
+func TestUnknownMode(t *testing.T) {
+	r := newRegistry(t)
+	if err := r.Enable("nope", Params{}); err == nil {
+		t.Error("expected Enable of an unknown mode to fail")
+	}
+	if err := r.Disable("nope"); err == nil {
+		t.Error("expected Disable of an unknown mode to fail")
+	}
+	if _, err := r.Toggle("nope"); err == nil {
+		t.Error("expected Toggle of an unknown mode to fail")
+	}
+	if _, err := r.Get("nope"); err == nil {
+		t.Error("expected Get of an unknown mode to fail")
+	}
+	if r.Enabled("nope") {
+		t.Error("expected an unknown mode to be disabled")
+	}
+}
+
+func TestToggleConcurrently(t *testing.T) {
+	r := newRegistry(t)
+	// An even number of toggles leaves the mode as it was only if each one
+	// flips it exactly once.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Toggle(SlowQuery); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if r.Enabled(SlowQuery) {
+		t.Error("expected slow mode disabled after 100 toggles")
+	}
+	if p := r.Params(SlowQuery); p.Delay != 2*time.Second {
+		t.Errorf("expected Toggle to keep the default delay, got %s", p.Delay)
+	}
+}
+
+func TestRoutesValidateParams(t *testing.T) {
+	r := newRegistry(t)
+	mux := http.NewServeMux()
+	r.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/faults/slow/enable?delay=250ms", http.StatusOK},
+		{"/faults/slow/enable?delay=soon", http.StatusBadRequest},
+		{"/faults/slow/enable?delay=-1s", http.StatusBadRequest},
+		{"/faults/rowcount/enable?offset=-3", http.StatusOK},
+		{"/faults/rowcount/enable?offset=one", http.StatusBadRequest},
+		{"/faults/intermittent/enable?percent=50", http.StatusOK},
+		{"/faults/intermittent/enable?percent=101", http.StatusBadRequest},
+		{"/faults/intermittent/enable?percent=-1", http.StatusBadRequest},
+		{"/faults/nope/enable", http.StatusNotFound},
+		{"/faults/nope/disable", http.StatusNotFound},
+	} {
+		resp, err := http.Post(server.URL+tc.path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("POST %s: expected %d, got %d", tc.path, tc.status, resp.StatusCode)
+		}
+	}
+
+	// A rejected request leaves the params of the last accepted one.
+	if p := r.Params(SlowQuery); p.Delay != 250*time.Millisecond {
+		t.Errorf("expected delay 250ms, got %s", p.Delay)
+	}
+	if p := r.Params(WrongRowCount); p.Offset != -3 {
+		t.Errorf("expected offset -3, got %d", p.Offset)
+	}
+	if p := r.Params(Intermittent); p.Percent != 50 {
+		t.Errorf("expected percent 50, got %v", p.Percent)
+	}
+
+	resp, err := http.Get(server.URL + "/faults/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	s := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if params, _ := s["params"].(map[string]any); s["enabled"] != true || params["delay"] != "250ms" {
+		t.Errorf("expected slow enabled with delay 250ms, got %v", s)
+	}
+}
+
+func TestBeforeSyntheticError(t *testing.T) {
+	r := newRegistry(t)
+	if err := r.Before(context.Background()); err != nil {
+		t.Fatalf("expected no error with every mode disabled, got %v", err)
+	}
+	r.Enable(SyntheticError, defaultParams(SyntheticError))
+	err := r.Before(context.Background())
+	var fault *Fault
+	if !errors.As(err, &fault) || fault.Mode != SyntheticError || fault.Message != "synthetic database error" {
+		t.Errorf("expected a synthetic error fault, got %v", err)
+	}
+	if err := r.Ping(context.Background()); err == nil {
+		t.Error("expected Ping to fail while the error mode is enabled")
+	}
+}
+
+func TestBeforePoolExhaustion(t *testing.T) {
+	r := newRegistry(t)
+	r.Enable(PoolExhaustion, Params{Message: "pool", Delay: 50 * time.Millisecond})
+
+	start := time.Now()
+	err := r.Before(context.Background())
+	var fault *Fault
+	if !errors.As(err, &fault) || fault.Mode != PoolExhaustion {
+		t.Errorf("expected a pool exhaustion fault, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait for the delay, returned after %s", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r.Enable(PoolExhaustion, Params{Message: "pool", Delay: time.Hour})
+	if err := r.Before(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait to end with the context, got %v", err)
+	}
+}
+
+func TestBeforeIntermittent(t *testing.T) {
+	r := newRegistry(t)
+	failures := func(percent float64) int {
+		r.Enable(Intermittent, Params{Message: "flaky", Percent: percent})
+		n := 0
+		for i := 0; i < 10000; i++ {
+			if r.Before(context.Background()) != nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := failures(0); n != 0 {
+		t.Errorf("percent 0: expected no failures, got %d", n)
+	}
+	if n := failures(100); n != 10000 {
+		t.Errorf("percent 100: expected every call to fail, got %d", n)
+	}
+	// 10000 draws at 25% are within 20%-30% all but never.
+	if n := failures(25); n < 2000 || n > 3000 {
+		t.Errorf("percent 25: expected about 2500 failures, got %d", n)
+	}
+	if err := r.Ping(context.Background()); err != nil {
+		t.Errorf("expected Ping to pass with only intermittent failures, got %v", err)
+	}
+}
+
+func TestSlow(t *testing.T) {
+	r := newRegistry(t)
+	start := time.Now()
+	if err := r.Slow(context.Background()); err != nil || time.Since(start) > 20*time.Millisecond {
+		t.Errorf("expected no delay with slow disabled, got %v after %s", err, time.Since(start))
+	}
+
+	r.Enable(SlowQuery, Params{Delay: 50 * time.Millisecond})
+	start = time.Now()
+	if err := r.Slow(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected a 50ms delay, returned after %s", elapsed)
+	}
+	// Slow only delays statements, it never fails a request on its own.
+	if err := r.Before(context.Background()); err != nil {
+		t.Errorf("expected Before to ignore the slow mode, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.Enable(SlowQuery, Params{Delay: time.Hour})
+	if err := r.Slow(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the delay to end with the context, got %v", err)
+	}
+}
+
+func TestAdjustRows(t *testing.T) {
+	r := newRegistry(t)
+	if n := r.AdjustRows(3); n != 3 {
+		t.Errorf("expected 3 rows with rowcount disabled, got %d", n)
+	}
+	for _, tc := range []struct{ offset, rows, want int }{
+		{-1, 3, 2},
+		{2, 3, 5},
+		{-5, 3, 0},
+	} {
+		r.Enable(WrongRowCount, Params{Offset: tc.offset})
+		if n := r.AdjustRows(tc.rows); n != tc.want {
+			t.Errorf("offset %d on %d rows: expected %d, got %d", tc.offset, tc.rows, tc.want, n)
+		}
+	}
+}
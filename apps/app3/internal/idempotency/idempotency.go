@@ -0,0 +1,226 @@
+// Package idempotency makes requests sent with an Idempotency-Key header safe
+// to retry: the first request holding a key is processed and its response
+// stored, later requests with the same key and payload get that response
+// replayed, and requests reusing a key for a different payload are rejected.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	myotel "app3/internal/otel"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	IDEMPOTENCY_HEADER = "Idempotency-Key"
+	// REPLAYED_HEADER is set on replayed responses.
+	REPLAYED_HEADER = "Idempotent-Replayed"
+)
+
+const MAX_KEY_LENGTH = 255
+
+type Middleware struct {
+	Store Store
+	TTL   time.Duration
+	Otc   *myotel.OtelClient
+
+	requests metric.Int64Counter
+}
+
+func NewMiddleware(store Store, ttl time.Duration, otc *myotel.OtelClient) (*Middleware, error) {
+	requests, err := otc.Metrics.Meter("asdsda").Int64Counter(
+		"idempotency.requests.total",
+		metric.WithDescription("Requests carrying an Idempotency-Key, by outcome"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Middleware{Store: store, TTL: ttl, Otc: otc, requests: requests}, nil
+}
+
+// Hash identifies the payload of a request: its method, path, query and body.
+func Hash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.Method, r.URL.Path, r.URL.Query().Encode())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Handler wraps next so that requests with an Idempotency-Key are processed
+// once. Requests without the header are passed through untouched.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IDEMPOTENCY_HEADER)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		traceID, _ := trace.TraceIDFromHex(r.Header.Get(myotel.OTEL_TRACE_HEADER))
+		spanID, _ := trace.SpanIDFromHex(r.Header.Get(myotel.OTEL_SPAN_HEADER))
+		parentSpanContext := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			TraceFlags: trace.FlagsSampled,
+			Remote:     true,
+		})
+		ctx := trace.ContextWithSpanContext(r.Context(), parentSpanContext)
+
+		tracer := m.Otc.Tracer.Tracer("opentelemetry.io/sdk")
+		ctx, span := tracer.Start(
+			ctx,
+			fmt.Sprintf("idempotency %s", r.URL.Path),
+			trace.WithAttributes(attribute.String("idempotency.key", key)),
+		)
+		defer span.End()
+
+		outcome := m.serve(ctx, span, w, r, key, next)
+		span.SetAttributes(
+			attribute.String("idempotency.outcome", outcome),
+			attribute.Bool("idempotency.replayed", outcome == "replayed"),
+		)
+		m.requests.Add(m.Otc.Ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	})
+}
+
+// serve handles a request carrying key and returns its outcome: processed,
+// replayed, in_progress, mismatch, invalid or failed.
+func (m *Middleware) serve(ctx context.Context, span trace.Span, w http.ResponseWriter, r *http.Request, key string, next http.Handler) string {
+	if len(key) > MAX_KEY_LENGTH {
+		http.Error(w, fmt.Sprintf("%s must be at most %d characters", IDEMPOTENCY_HEADER, MAX_KEY_LENGTH), http.StatusBadRequest)
+		return "invalid"
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return "invalid"
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	hash := Hash(r, body)
+
+	rec, claimed, err := m.Store.Begin(ctx, key, hash, m.TTL)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		m.log(span, slog.LevelError, fmt.Sprintf("Could not claim idempotency key [%s]: %s", key, err))
+		http.Error(w, "idempotency store unavailable", http.StatusServiceUnavailable)
+		return "failed"
+	}
+
+	if !claimed {
+		switch {
+		case rec.RequestHash != hash:
+			m.log(span, slog.LevelWarn, fmt.Sprintf("Idempotency key [%s] reused with a different payload", key))
+			http.Error(w, fmt.Sprintf("%s was already used for a different request", IDEMPOTENCY_HEADER), http.StatusUnprocessableEntity)
+			return "mismatch"
+		case rec.Response == nil:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, fmt.Sprintf("a request with this %s is still in progress", IDEMPOTENCY_HEADER), http.StatusConflict)
+			return "in_progress"
+		}
+		m.log(span, slog.LevelInfo, fmt.Sprintf("Replaying response %d for idempotency key [%s]", rec.Response.Status, key))
+		if rec.Response.ContentType != "" {
+			w.Header().Set("Content-Type", rec.Response.ContentType)
+		}
+		w.Header().Set(REPLAYED_HEADER, "true")
+		w.WriteHeader(rec.Response.Status)
+		w.Write(rec.Response.Body)
+		return "replayed"
+	}
+
+	// The request context may be gone by now, the bookkeeping must happen.
+	storeCtx := context.WithoutCancel(ctx)
+	defer func() {
+		// A panicking handler answers nothing worth replaying, so the key is
+		// released before the panic goes on to the server, otherwise it would
+		// stay in progress until it expires.
+		if p := recover(); p != nil {
+			if err := m.Store.Release(storeCtx, key); err != nil {
+				m.log(span, slog.LevelError, fmt.Sprintf("Could not release idempotency key [%s]: %s", key, err))
+			}
+			panic(p)
+		}
+	}()
+
+	rw := &recorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rw, r)
+
+	// A server error may be transient, so the key is released and the
+	// client's retry gets processed again instead of replaying the error.
+	if rw.status >= 500 {
+		err = m.Store.Release(storeCtx, key)
+	} else {
+		err = m.Store.Complete(storeCtx, key, Response{
+			Status:      rw.status,
+			ContentType: rw.Header().Get("Content-Type"),
+			Body:        rw.body.Bytes(),
+		})
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		m.log(span, slog.LevelError, fmt.Sprintf("Could not store response for idempotency key [%s]: %s", key, err))
+	}
+	return "processed"
+}
+
+func (m *Middleware) log(span trace.Span, level slog.Level, msg string) {
+	m.Otc.Logger.Log(m.Otc.Ctx, level, msg,
+		slog.String("TraceId", span.SpanContext().TraceID().String()),
+		slog.String("SpanId", span.SpanContext().SpanID().String()),
+	)
+}
+
+// PurgeEvery deletes expired records every interval until ctx is done.
+func (m *Middleware) PurgeEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := m.Store.Purge(ctx)
+		if err != nil {
+			m.Otc.Logger.Error(fmt.Sprintf("Could not purge idempotency keys: %s", err))
+			continue
+		}
+		if n > 0 {
+			m.Otc.Logger.Info(fmt.Sprintf("Purged %d expired idempotency keys", n))
+		}
+	}
+}
+
+// recorder captures the status and body written by the wrapped handler while
+// passing them through.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *recorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recorder) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
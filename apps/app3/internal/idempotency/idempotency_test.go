@@ -0,0 +1,195 @@
+package idempotency
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	myotel "app3/internal/otel"
+
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var TTL = time.Hour
+
+func newMiddleware(t *testing.T, store Store) *Middleware {
+	t.Helper()
+	m, err := NewMiddleware(store, TTL, &myotel.OtelClient{
+		Ctx:     context.Background(),
+		Tracer:  sdktrace.NewTracerProvider(),
+		Metrics: metricsdk.NewMeterProvider(),
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// counting answers status with the number of requests it processed so far.
+func counting(status int) (http.Handler, *atomic.Int64) {
+	calls := &atomic.Int64{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		io.WriteString(w, strings.Repeat("x", int(n)))
+	}), calls
+}
+
+func send(h http.Handler, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/reservations", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IDEMPOTENCY_HEADER, key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestReplay(t *testing.T) {
+	next, calls := counting(http.StatusCreated)
+	h := newMiddleware(t, NewMemoryStore()).Handler(next)
+
+	first := send(h, "k1", `{"book_id":1}`)
+	second := send(h, "k1", `{"book_id":1}`)
+	if calls.Load() != 1 {
+		t.Fatalf("expected the handler to run once, ran %d times", calls.Load())
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Errorf("expected the first response replayed, got %d %q", second.Code, second.Body)
+	}
+	if second.Header().Get(REPLAYED_HEADER) != "true" || second.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("expected replay headers, got %v", second.Header())
+	}
+	if first.Header().Get(REPLAYED_HEADER) != "" {
+		t.Error("expected the first response not to be marked as replayed")
+	}
+
+	// Requests without a key or with another key are always processed.
+	send(h, "", `{"book_id":1}`)
+	send(h, "k2", `{"book_id":1}`)
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestPayloadMismatch(t *testing.T) {
+	next, calls := counting(http.StatusCreated)
+	h := newMiddleware(t, NewMemoryStore()).Handler(next)
+
+	send(h, "k1", `{"book_id":1}`)
+	w := send(h, "k1", `{"book_id":2}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422, got %d", w.Code)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the mismatching request not to be processed, got %d calls", calls.Load())
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+	h := newMiddleware(t, NewMemoryStore()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-unblock
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send(h, "k1", `{}`) }()
+	<-started
+
+	w := send(h, "k1", `{}`)
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 409 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+	close(unblock)
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Errorf("expected the first request to complete with 201, got %d", w.Code)
+	}
+	if w := send(h, "k1", `{}`); w.Code != http.StatusCreated || w.Header().Get(REPLAYED_HEADER) != "true" {
+		t.Errorf("expected the completed response replayed, got %d", w.Code)
+	}
+}
+
+func TestReleaseOnServerError(t *testing.T) {
+	next, calls := counting(http.StatusInternalServerError)
+	h := newMiddleware(t, NewMemoryStore()).Handler(next)
+
+	send(h, "k1", `{}`)
+	w := send(h, "k1", `{}`)
+	if calls.Load() != 2 {
+		t.Errorf("expected the retry of a 5xx to be processed again, got %d calls", calls.Load())
+	}
+	if w.Header().Get(REPLAYED_HEADER) != "" {
+		t.Error("expected a 5xx never to be replayed")
+	}
+
+	// Client errors are final and replayed like successes.
+	next, calls = counting(http.StatusConflict)
+	h = newMiddleware(t, NewMemoryStore()).Handler(next)
+	send(h, "k1", `{}`)
+	send(h, "k1", `{}`)
+	if calls.Load() != 1 {
+		t.Errorf("expected a 409 to be replayed, got %d calls", calls.Load())
+	}
+}
+
+func TestReleaseOnPanic(t *testing.T) {
+	store := NewMemoryStore()
+	h := newMiddleware(t, store).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("expected the panic to be passed on, got %v", p)
+			}
+		}()
+		send(h, "k1", `{}`)
+	}()
+
+	_, claimed, err := store.Begin(context.Background(), "k1", "other", TTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Error("expected the key of the panicking request to be released")
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	next, calls := counting(http.StatusCreated)
+	h := newMiddleware(t, store).Handler(next)
+
+	send(h, "k1", `{}`)
+	now = now.Add(TTL / 2)
+	send(h, "k2", `{}`)
+
+	if n, _ := store.Purge(context.Background()); n != 0 {
+		t.Errorf("expected nothing to purge before the TTL, purged %d", n)
+	}
+	now = now.Add(TTL / 2)
+	if n, _ := store.Purge(context.Background()); n != 1 {
+		t.Errorf("expected k1 to be purged after the TTL, purged %d", n)
+	}
+
+	// An expired key is processed again, an unexpired one still replayed.
+	send(h, "k1", `{}`)
+	send(h, "k2", `{}`)
+	if calls.Load() != 3 {
+		t.Errorf("expected only k1 to be processed again, got %d calls", calls.Load())
+	}
+}
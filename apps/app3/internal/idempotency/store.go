@@ -0,0 +1,179 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Response is what is replayed for a duplicate request.
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+type Record struct {
+	Key         string
+	RequestHash string
+	// Response is nil while the request that claimed the key is in flight.
+	Response  *Response
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type Store interface {
+	// Begin claims key for a request whose payload hashes to hash. When the
+	// key is already held by an unexpired record it returns that record and
+	// false instead.
+	Begin(ctx context.Context, key string, hash string, ttl time.Duration) (*Record, bool, error)
+	// Complete stores the response of the request holding key.
+	Complete(ctx context.Context, key string, resp Response) error
+	// Release drops key so the request can be retried, e.g. after a 5xx.
+	Release(ctx context.Context, key string) error
+	// Purge deletes the expired records and returns how many there were.
+	Purge(ctx context.Context) (int64, error)
+}
+
+// PostgresStore keeps the records in the idempotency_keys table created by the
+// 0004_idempotency migration.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) Begin(ctx context.Context, key string, hash string, ttl time.Duration) (*Record, bool, error) {
+	// The existing record can expire or be released between the insert and
+	// the select, in which case claiming the key is attempted again.
+	for attempt := 0; attempt < 3; attempt++ {
+		rec := &Record{Key: key, RequestHash: hash}
+		err := s.DB.QueryRowContext(ctx, `
+			INSERT INTO idempotency_keys (key, request_hash, expires_at)
+			VALUES ($1, $2, now() + make_interval(secs => $3))
+			ON CONFLICT (key) DO UPDATE SET
+				request_hash = EXCLUDED.request_hash,
+				status = NULL,
+				content_type = NULL,
+				body = NULL,
+				created_at = now(),
+				expires_at = EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at <= now()
+			RETURNING created_at, expires_at`,
+			key, hash, ttl.Seconds(),
+		).Scan(&rec.CreatedAt, &rec.ExpiresAt)
+		if err == nil {
+			return rec, true, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, false, err
+		}
+
+		var status sql.NullInt64
+		var contentType sql.NullString
+		var body []byte
+		err = s.DB.QueryRowContext(ctx, `
+			SELECT request_hash, status, content_type, body, created_at, expires_at
+			FROM idempotency_keys WHERE key = $1 AND expires_at > now()`,
+			key,
+		).Scan(&rec.RequestHash, &status, &contentType, &body, &rec.CreatedAt, &rec.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if status.Valid {
+			rec.Response = &Response{Status: int(status.Int64), ContentType: contentType.String, Body: body}
+		}
+		return rec, false, nil
+	}
+	return nil, false, errors.New("could not claim idempotency key")
+}
+
+func (s *PostgresStore) Complete(ctx context.Context, key string, resp Response) error {
+	_, err := s.DB.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status = $2, content_type = $3, body = $4 WHERE key = $1",
+		key, resp.Status, resp.ContentType, resp.Body,
+	)
+	return err
+}
+
+func (s *PostgresStore) Release(ctx context.Context, key string) error {
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = $1 AND status IS NULL", key)
+	return err
+}
+
+func (s *PostgresStore) Purge(ctx context.Context) (int64, error) {
+	res, err := s.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= now()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// MemoryStore is an in-process Store, used with the in-memory repository.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+	now     func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]Record{}, now: time.Now}
+}
+
+func (m *MemoryStore) Begin(ctx context.Context, key string, hash string, ttl time.Duration) (*Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if rec, ok := m.records[key]; ok && rec.ExpiresAt.After(now) {
+		return &rec, false, nil
+	}
+	rec := Record{Key: key, RequestHash: hash, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	m.records[key] = rec
+	return &rec, true, nil
+}
+
+func (m *MemoryStore) Complete(ctx context.Context, key string, resp Response) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.records[key]
+	if !ok {
+		return nil
+	}
+	rec.Response = &resp
+	m.records[key] = rec
+	return nil
+}
+
+func (m *MemoryStore) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.records[key]; ok && rec.Response == nil {
+		delete(m.records, key)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Purge(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	var purged int64
+	for key, rec := range m.records {
+		if !rec.ExpiresAt.After(now) {
+			delete(m.records, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,441 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"app3/internal/faults"
+	"app3/internal/idempotency"
+	"app3/internal/identity"
+	myotel "app3/internal/otel"
+	"app3/internal/otelsql"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Handlers struct {
+	Books        BookRepository
+	Reservations ReservationRepository
+	Otc          *myotel.OtelClient
+	Faults       *faults.Registry
+	// Idempotency, when set, wraps the routes that change state so they can
+	// be retried safely with an Idempotency-Key header.
+	Idempotency *idempotency.Middleware
+
+	reservationsTotal metric.Int64Counter
+	cancellations     metric.Int64Counter
+	booksCreated      metric.Int64Counter
+}
+
+func NewHandlers(books BookRepository, reservations ReservationRepository, otc *myotel.OtelClient, faultRegistry *faults.Registry) (*Handlers, error) {
+	meter := otc.Metrics.Meter("asdsda")
+	reservationsTotal, err := meter.Int64Counter("library.reservations.total",
+		metric.WithDescription("Reservation attempts by outcome"))
+	if err != nil {
+		return nil, err
+	}
+	cancellations, err := meter.Int64Counter("library.reservations.cancelled.total",
+		metric.WithDescription("Cancelled reservations"))
+	if err != nil {
+		return nil, err
+	}
+	booksCreated, err := meter.Int64Counter("library.books.created.total",
+		metric.WithDescription("Books added to the catalogue"))
+	if err != nil {
+		return nil, err
+	}
+	return &Handlers{
+		Books:             books,
+		Reservations:      reservations,
+		Otc:               otc,
+		Faults:            faultRegistry,
+		reservationsTotal: reservationsTotal,
+		cancellations:     cancellations,
+		booksCreated:      booksCreated,
+	}, nil
+}
+
+func (h *Handlers) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /books", h.ListBooks)
+	mux.HandleFunc("GET /books/{id}", h.GetBook)
+	mux.Handle("POST /books", h.idempotent(h.CreateBook))
+	mux.Handle("POST /reservations", h.idempotent(h.CreateReservation))
+	mux.HandleFunc("GET /reservations/{id}", h.GetReservation)
+	mux.Handle("DELETE /reservations/{id}", h.idempotent(h.CancelReservation))
+	mux.Handle("POST /reservations/{id}/cancel", h.idempotent(h.CancelReservation))
+	mux.Handle("/reserve", h.idempotent(h.Reserve))
+}
+
+func (h *Handlers) idempotent(handler http.HandlerFunc) http.Handler {
+	if h.Idempotency == nil {
+		return handler
+	}
+	return h.Idempotency.Handler(handler)
+}
+
+// start opens the server span of a request, parented on the trace headers set
+// by the caller's OtelClient.
+func (h *Handlers) start(r *http.Request, name string) (context.Context, trace.Span) {
+	traceID, _ := trace.TraceIDFromHex(r.Header.Get(myotel.OTEL_TRACE_HEADER))
+	spanID, _ := trace.SpanIDFromHex(r.Header.Get(myotel.OTEL_SPAN_HEADER))
+	parentSpanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithSpanContext(r.Context(), parentSpanContext)
+	ctx = otelsql.ContextWithRoute(ctx, route(r))
+
+	tracer := h.Otc.Tracer.Tracer("opentelemetry.io/sdk")
+	return tracer.Start(
+		ctx,
+		name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+			attribute.String("http.route", route(r)),
+		),
+		trace.WithAttributes(identity.Parse(r).Attributes()...),
+	)
+}
+
+// route returns the path of the mux pattern that matched r, e.g.
+// /reservations/{id}, falling back to the request path.
+func route(r *http.Request) string {
+	if r.Pattern == "" {
+		return r.URL.Path
+	}
+	if _, path, ok := strings.Cut(r.Pattern, " "); ok {
+		return path
+	}
+	return r.Pattern
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrOutOfStock), errors.Is(err, ErrAlreadyCancelled), errors.Is(err, ErrDuplicate):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// finish writes the response and records its outcome on the span and in the
+// logs. Client errors are logged as warnings, everything else as errors.
+func (h *Handlers) finish(w http.ResponseWriter, r *http.Request, span trace.Span, start time.Time, status int, body any, err error) {
+	elapsed := time.Since(start)
+	span.SetAttributes(attribute.Int("http.status_code", status))
+
+	traceAttrs := append([]any{
+		slog.String("TraceId", span.SpanContext().TraceID().String()),
+		slog.String("SpanId", span.SpanContext().SpanID().String()),
+	}, identity.Parse(r).LogAttrs()...)
+	if err != nil {
+		var fault *faults.Fault
+		if errors.As(err, &fault) {
+			span.SetAttributes(attribute.String("fault.mode", string(fault.Mode)))
+		}
+		msg := fmt.Sprintf("Request [%s %s] failed in %d miliseconds with [%s]", r.Method, r.URL.Path, elapsed.Milliseconds(), err)
+		if status >= 500 {
+			span.SetStatus(codes.Error, err.Error())
+			h.Otc.Logger.Error(msg, traceAttrs...)
+		} else {
+			h.Otc.Logger.Warn(msg, traceAttrs...)
+		}
+		body = map[string]string{"error": err.Error()}
+	} else {
+		h.Otc.Logger.Info(
+			fmt.Sprintf("Request [%s %s] succeded in %d miliseconds", r.Method, r.URL.Path, elapsed.Milliseconds()),
+			traceAttrs...,
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func pathID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%w: id must be a positive integer", ErrInvalid)
+	}
+	return id, nil
+}
+
+func queryID(r *http.Request, name string, fallback int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%w: %s must be a positive integer", ErrInvalid, name)
+	}
+	return id, nil
+}
+
+func (h *Handlers) ListBooks(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := h.start(r, "GET /books")
+	defer span.End()
+
+	if err := h.Faults.Before(ctx); err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	books, err := h.Books.ListBooks(ctx)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	// A negative offset drops the last books, a positive one repeats the
+	// first ones, as a query returning duplicated rows would.
+	if n := h.Faults.AdjustRows(len(books)); n < len(books) {
+		books = books[:n]
+	} else if len(books) > 0 {
+		for i := 0; len(books) < n; i++ {
+			books = append(books, books[i])
+		}
+	}
+	span.SetAttributes(attribute.Int("library.books", len(books)))
+	h.finish(w, r, span, start, http.StatusOK, books, nil)
+}
+
+func (h *Handlers) GetBook(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := h.start(r, "GET /books/{id}")
+	defer span.End()
+
+	id, err := pathID(r)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	span.SetAttributes(attribute.Int64("library.book_id", id))
+	if err := h.Faults.Before(ctx); err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	book, err := h.Books.GetBook(ctx, id)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	h.finish(w, r, span, start, http.StatusOK, book, nil)
+}
+
+func (h *Handlers) CreateBook(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := h.start(r, "POST /books")
+	defer span.End()
+
+	book := Book{}
+	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
+		h.finish(w, r, span, start, http.StatusBadRequest, nil, fmt.Errorf("%w: %s", ErrInvalid, err))
+		return
+	}
+	if err := book.Validate(); err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	if err := h.Faults.Before(ctx); err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	created, err := h.Books.CreateBook(ctx, book)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	h.booksCreated.Add(h.Otc.Ctx, 1)
+	span.SetAttributes(attribute.Int64("library.book_id", created.ID))
+	h.finish(w, r, span, start, http.StatusCreated, created, nil)
+}
+
+type reservationRequest struct {
+	BookID   int64 `json:"book_id"`
+	MemberID int64 `json:"member_id"`
+}
+
+// reserve runs the reservation workflow shared by /reserve and
+// POST /reservations and records its business outcome.
+func (h *Handlers) reserve(ctx context.Context, span trace.Span, req reservationRequest) (*Reservation, error) {
+	span.SetAttributes(
+		attribute.Int64("library.book_id", req.BookID),
+		attribute.Int64("library.member_id", req.MemberID),
+	)
+	outcome := "created"
+	defer func() {
+		span.SetAttributes(attribute.String("library.reservation.outcome", outcome))
+		h.reservationsTotal.Add(h.Otc.Ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	}()
+
+	if err := h.Faults.Before(ctx); err != nil {
+		outcome = "failed"
+		return nil, err
+	}
+	res, err := h.Reservations.Reserve(ctx, req.BookID, req.MemberID)
+	switch {
+	case errors.Is(err, ErrOutOfStock):
+		outcome = "out_of_stock"
+		return nil, err
+	case errors.Is(err, ErrNotFound):
+		outcome = "not_found"
+		return nil, err
+	case err != nil:
+		outcome = "failed"
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int64("library.reservation_id", res.ID))
+	return res, nil
+}
+
+// Reserve is the endpoint app1 calls. It reserves a copy of book_id (default
+// 1) for member_id (default 1) and answers 200 so app1 keeps treating any
+// other status as a failure.
+func (h *Handlers) Reserve(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := h.start(r, "/reserve")
+	defer span.End()
+
+	bookID, err := queryID(r, "book_id", 1)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	memberID, err := queryID(r, "member_id", 1)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	res, err := h.reserve(ctx, span, reservationRequest{BookID: bookID, MemberID: memberID})
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	h.finish(w, r, span, start, http.StatusOK, res, nil)
+}
+
+func (h *Handlers) CreateReservation(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := h.start(r, "POST /reservations")
+	defer span.End()
+
+	req := reservationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.finish(w, r, span, start, http.StatusBadRequest, nil, fmt.Errorf("%w: %s", ErrInvalid, err))
+		return
+	}
+	if req.BookID <= 0 || req.MemberID <= 0 {
+		h.finish(w, r, span, start, http.StatusBadRequest, nil, fmt.Errorf("%w: book_id and member_id are required", ErrInvalid))
+		return
+	}
+
+	res, err := h.reserve(ctx, span, req)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	h.finish(w, r, span, start, http.StatusCreated, res, nil)
+}
+
+// ReserveMessage handles a reservation submitted asynchronously, e.g. by app1
+// through the message bus. body holds the same JSON as POST /reservations and
+// the span of ctx, the consumer span of the message, gets the reservation
+// attributes.
+func (h *Handlers) ReserveMessage(ctx context.Context, body []byte) (*Reservation, error) {
+	start := time.Now()
+	span := trace.SpanFromContext(ctx)
+
+	req := reservationRequest{}
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalid, err)
+	} else if req.BookID <= 0 || req.MemberID <= 0 {
+		err = fmt.Errorf("%w: book_id and member_id are required", ErrInvalid)
+	}
+	var res *Reservation
+	if err == nil {
+		res, err = h.reserve(ctx, span, req)
+	}
+
+	elapsed := time.Since(start)
+	id := identity.FromContext(ctx)
+	span.SetAttributes(id.Attributes()...)
+	traceAttrs := append([]any{
+		slog.String("TraceId", span.SpanContext().TraceID().String()),
+		slog.String("SpanId", span.SpanContext().SpanID().String()),
+	}, id.LogAttrs()...)
+	if err != nil {
+		h.Otc.Logger.Warn(fmt.Sprintf("Async reservation failed in %d miliseconds with [%s]", elapsed.Milliseconds(), err), traceAttrs...)
+		return nil, err
+	}
+	h.Otc.Logger.Info(fmt.Sprintf("Async reservation %d succeded in %d miliseconds", res.ID, elapsed.Milliseconds()), traceAttrs...)
+	return res, nil
+}
+
+func (h *Handlers) GetReservation(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := h.start(r, "GET /reservations/{id}")
+	defer span.End()
+
+	id, err := pathID(r)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	span.SetAttributes(attribute.Int64("library.reservation_id", id))
+	if err := h.Faults.Before(ctx); err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	res, err := h.Reservations.GetReservation(ctx, id)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	h.finish(w, r, span, start, http.StatusOK, res, nil)
+}
+
+func (h *Handlers) CancelReservation(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := h.start(r, "cancel /reservations/{id}")
+	defer span.End()
+
+	id, err := pathID(r)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	span.SetAttributes(attribute.Int64("library.reservation_id", id))
+	if err := h.Faults.Before(ctx); err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	res, err := h.Reservations.CancelReservation(ctx, id)
+	if err != nil {
+		h.finish(w, r, span, start, statusFor(err), nil, err)
+		return
+	}
+	h.cancellations.Add(h.Otc.Ctx, 1)
+	h.finish(w, r, span, start, http.StatusOK, res, nil)
+}
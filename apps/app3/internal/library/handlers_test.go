@@ -0,0 +1,244 @@
+package library
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"app3/internal/faults"
+	myotel "app3/internal/otel"
+
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// newServer serves the library routes over a MemoryRepository created with
+// opts.
+func newServer(t *testing.T, opts MemoryOptions) (*httptest.Server, *faults.Registry) {
+	t.Helper()
+	otc := &myotel.OtelClient{
+		Ctx:     context.Background(),
+		Tracer:  sdktrace.NewTracerProvider(),
+		Metrics: metricsdk.NewMeterProvider(),
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	faultRegistry, err := faults.NewRegistry(otc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewMemoryRepository(opts)
+	handlers, err := NewHandlers(repo, repo, otc, faultRegistry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	handlers.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, faultRegistry
+}
+
+// do sends the request and decodes the JSON answer into out, when not nil.
+func do(t *testing.T, method string, url string, body any, out any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		raw, _ := json.Marshal(body)
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %s", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestListAndGetBooks(t *testing.T) {
+	server, _ := newServer(t, MemoryOptions{})
+
+	books := []Book{}
+	if status := do(t, "GET", server.URL+"/books", nil, &books); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if len(books) != 100 {
+		t.Fatalf("expected the 100 seeded books, got %d", len(books))
+	}
+	if books[0].Name != "Harry Potter" || books[0].Stock != 1000000 {
+		t.Errorf("expected Harry Potter with 1000000 copies first, got %+v", books[0])
+	}
+
+	book := Book{}
+	if status := do(t, "GET", server.URL+"/books/2", nil, &book); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if book.ID != 2 || book.Name != "Dune" {
+		t.Errorf("expected Dune, got %+v", book)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/books/999", http.StatusNotFound},
+		{"/books/abc", http.StatusBadRequest},
+		{"/reservations/1", http.StatusNotFound},
+	} {
+		if status := do(t, "GET", server.URL+tc.path, nil, nil); status != tc.status {
+			t.Errorf("GET %s: expected %d, got %d", tc.path, tc.status, status)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	server, _ := newServer(t, MemoryOptions{})
+
+	res := Reservation{}
+	if status := do(t, "GET", server.URL+"/reserve?book_id=2&member_id=1", nil, &res); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if res.BookID != 2 || res.MemberID != 1 || res.Status != ReservationActive {
+		t.Errorf("expected an active reservation of book 2, got %+v", res)
+	}
+	book := Book{}
+	do(t, "GET", server.URL+"/books/2", nil, &book)
+	if book.Stock != 4 {
+		t.Errorf("expected the stock of Dune to drop to 4, got %d", book.Stock)
+	}
+
+	got := Reservation{}
+	if status := do(t, "GET", server.URL+"/reservations/1", nil, &got); status != http.StatusOK || got.ID != res.ID {
+		t.Errorf("expected to read reservation %d back, got %d %+v", res.ID, status, got)
+	}
+
+	// Every synthetic user of the client has a member.
+	if status := do(t, "GET", server.URL+"/reserve?book_id=1&member_id=1000", nil, nil); status != http.StatusOK {
+		t.Errorf("expected member 1000 to be seeded, got %d", status)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/reserve?book_id=999", http.StatusNotFound},
+		{"/reserve?member_id=1001", http.StatusNotFound},
+		{"/reserve?book_id=zero", http.StatusBadRequest},
+	} {
+		if status := do(t, "GET", server.URL+tc.path, nil, nil); status != tc.status {
+			t.Errorf("GET %s: expected %d, got %d", tc.path, tc.status, status)
+		}
+	}
+}
+
+func TestReserveOutOfStock(t *testing.T) {
+	server, _ := newServer(t, MemoryOptions{})
+
+	// The Hobbit has a single copy.
+	req := reservationRequest{BookID: 3, MemberID: 1}
+	res := Reservation{}
+	if status := do(t, "POST", server.URL+"/reservations", req, &res); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	failure := map[string]string{}
+	if status := do(t, "POST", server.URL+"/reservations", req, &failure); status != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", status)
+	}
+	if failure["error"] != ErrOutOfStock.Error() {
+		t.Errorf("expected %q, got %q", ErrOutOfStock, failure["error"])
+	}
+
+	// Cancelling gives the copy back.
+	if status := do(t, "DELETE", server.URL+"/reservations/1", nil, nil); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if status := do(t, "DELETE", server.URL+"/reservations/1", nil, nil); status != http.StatusConflict {
+		t.Errorf("expected 409 cancelling twice, got %d", status)
+	}
+	if status := do(t, "POST", server.URL+"/reservations", req, nil); status != http.StatusCreated {
+		t.Errorf("expected 201 once the copy is back, got %d", status)
+	}
+}
+
+func TestInjectedErrors(t *testing.T) {
+	failed := errors.New("connection reset")
+	server, faultRegistry := newServer(t, MemoryOptions{
+		Err: func(ctx context.Context, op string) error {
+			if op == "Reserve" {
+				return failed
+			}
+			return nil
+		},
+	})
+
+	failure := map[string]string{}
+	if status := do(t, "GET", server.URL+"/reserve", nil, &failure); status != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", status)
+	}
+	if failure["error"] != failed.Error() {
+		t.Errorf("expected %q, got %q", failed, failure["error"])
+	}
+	if status := do(t, "GET", server.URL+"/books/1", nil, nil); status != http.StatusOK {
+		t.Errorf("expected reads to keep working, got %d", status)
+	}
+	book := Book{}
+	do(t, "GET", server.URL+"/books/1", nil, &book)
+	if book.Stock != 1000000 {
+		t.Errorf("expected a failed reservation to keep the stock, got %d", book.Stock)
+	}
+
+	faultRegistry.Enable(faults.SyntheticError, faults.Params{Message: "synthetic"})
+	if status := do(t, "GET", server.URL+"/books", nil, &failure); status != http.StatusInternalServerError || failure["error"] != "synthetic" {
+		t.Errorf("expected the synthetic error with 500, got %d %v", status, failure)
+	}
+	faultRegistry.Disable(faults.SyntheticError)
+
+	faultRegistry.Enable(faults.WrongRowCount, faults.Params{Offset: -10})
+	books := []Book{}
+	do(t, "GET", server.URL+"/books", nil, &books)
+	if len(books) != 90 {
+		t.Errorf("expected the row count fault to drop 10 books, got %d", len(books))
+	}
+	faultRegistry.Enable(faults.WrongRowCount, faults.Params{Offset: 150})
+	books = []Book{}
+	do(t, "GET", server.URL+"/books", nil, &books)
+	if len(books) != 250 || books[100].ID != books[0].ID || books[249].ID != books[49].ID {
+		t.Errorf("expected the row count fault to repeat 150 books, got %d", len(books))
+	}
+}
+
+func TestLatency(t *testing.T) {
+	latency := 100 * time.Millisecond
+	server, _ := newServer(t, MemoryOptions{Latency: latency})
+
+	start := time.Now()
+	if status := do(t, "GET", server.URL+"/books/1", nil, nil); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("expected the request to take at least %s, took %s", latency, elapsed)
+	}
+
+	// The latency honours the request context.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/books", nil)
+	if _, err := http.DefaultClient.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the client to give up first, got %v", err)
+	}
+}
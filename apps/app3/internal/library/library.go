@@ -0,0 +1,73 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrOutOfStock       = errors.New("book out of stock")
+	ErrAlreadyCancelled = errors.New("reservation already cancelled")
+	ErrInvalid          = errors.New("invalid request")
+	ErrDuplicate        = errors.New("book already exists")
+)
+
+// BookRepository and ReservationRepository are implemented with the same
+// semantics by PostgresRepository and MemoryRepository: unknown ids return
+// ErrNotFound, reserving a book without stock returns ErrOutOfStock and
+// cancelling twice returns ErrAlreadyCancelled.
+type BookRepository interface {
+	ListBooks(ctx context.Context) ([]Book, error)
+	GetBook(ctx context.Context, id int64) (*Book, error)
+	CreateBook(ctx context.Context, b Book) (*Book, error)
+}
+
+type ReservationRepository interface {
+	// Reserve atomically takes one copy of the book out of stock and
+	// records an active reservation for the member.
+	Reserve(ctx context.Context, bookID int64, memberID int64) (*Reservation, error)
+	GetReservation(ctx context.Context, id int64) (*Reservation, error)
+	// CancelReservation atomically cancels the reservation and puts the
+	// copy back in stock.
+	CancelReservation(ctx context.Context, id int64) (*Reservation, error)
+}
+
+type Book struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Author string `json:"author"`
+	Year   int    `json:"year"`
+	Stock  int    `json:"stock"`
+}
+
+type Member struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type ReservationStatus string
+
+const (
+	ReservationActive    ReservationStatus = "active"
+	ReservationCancelled ReservationStatus = "cancelled"
+)
+
+type Reservation struct {
+	ID          int64             `json:"id"`
+	BookID      int64             `json:"book_id"`
+	MemberID    int64             `json:"member_id"`
+	Status      ReservationStatus `json:"status"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	CancelledAt *time.Time        `json:"cancelled_at,omitempty"`
+}
+
+func (b Book) Validate() error {
+	if b.Name == "" || b.Author == "" || b.Stock < 0 {
+		return ErrInvalid
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"app3/internal/outbox"
+)
+
+type MemoryOptions struct {
+	// Latency is added to every call, honouring context cancellation.
+	Latency time.Duration
+	// Err, when set, is called with the operation name (e.g. "Reserve")
+	// before every call and its error, if any, is returned instead.
+	Err func(ctx context.Context, op string) error
+	// Outbox, when set, receives a reservation.created event for every
+	// reservation, as the Postgres outbox table does.
+	Outbox *outbox.MemoryStore
+}
+
+// MemoryRepository is an in-process BookRepository and ReservationRepository
+// with the same semantics as PostgresRepository, for running app3 and its
+// handlers without a database.
+type MemoryRepository struct {
+	opts MemoryOptions
+
+	mu           sync.Mutex
+	books        map[int64]Book
+	members      map[int64]Member
+	reservations map[int64]Reservation
+	nextBook     int64
+	nextRes      int64
+	now          func() time.Time
+}
+
+// NewMemoryRepository returns a repository seeded with the same data as the
+// 0003_seed and 0006_catalogue migrations.
+func NewMemoryRepository(opts MemoryOptions) *MemoryRepository {
+	m := &MemoryRepository{
+		opts:         opts,
+		books:        map[int64]Book{},
+		members:      map[int64]Member{},
+		reservations: map[int64]Reservation{},
+		now:          time.Now,
+	}
+	seed := []Book{
+		{Name: "Harry Potter", Author: "J.K. Rowling", Year: 1997, Stock: 1000000},
+		{Name: "Dune", Author: "Frank Herbert", Year: 1965, Stock: 5},
+		{Name: "The Hobbit", Author: "J.R.R. Tolkien", Year: 1937, Stock: 1},
+	}
+	for n := 4; n <= 100; n++ {
+		seed = append(seed, Book{
+			Name:   fmt.Sprintf("Book %d", n),
+			Author: fmt.Sprintf("Author %d", n%40+1),
+			Year:   1900 + n,
+			Stock:  20 + (n*37)%180,
+		})
+	}
+	for _, b := range seed {
+		m.nextBook++
+		b.ID = m.nextBook
+		m.books[b.ID] = b
+	}
+	m.members[1] = Member{ID: 1, Name: "Demo Member", Email: "demo@library.local"}
+	for n := int64(2); n <= 1000; n++ {
+		m.members[n] = Member{ID: n, Name: fmt.Sprintf("Member %d", n), Email: fmt.Sprintf("member-%d@library.local", n)}
+	}
+	return m
+}
+
+// ReadOperation reports whether op, as passed to MemoryOptions.Err, only
+// reads, like the SELECT statements of PostgresRepository.
+func ReadOperation(op string) bool {
+	switch op {
+	case "ListBooks", "GetBook", "GetReservation":
+		return true
+	}
+	return false
+}
+
+func (m *MemoryRepository) before(ctx context.Context, op string) error {
+	if m.opts.Latency > 0 {
+		t := time.NewTimer(m.opts.Latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if m.opts.Err != nil {
+		return m.opts.Err(ctx, op)
+	}
+	return ctx.Err()
+}
+
+func (m *MemoryRepository) ListBooks(ctx context.Context) ([]Book, error) {
+	if err := m.before(ctx, "ListBooks"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	books := make([]Book, 0, len(m.books))
+	for _, b := range m.books {
+		books = append(books, b)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+	return books, nil
+}
+
+func (m *MemoryRepository) GetBook(ctx context.Context, id int64) (*Book, error) {
+	if err := m.before(ctx, "GetBook"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.books[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &b, nil
+}
+
+func (m *MemoryRepository) CreateBook(ctx context.Context, b Book) (*Book, error) {
+	if err := m.before(ctx, "CreateBook"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.books {
+		if existing.Name == b.Name && existing.Author == b.Author {
+			return nil, ErrDuplicate
+		}
+	}
+	m.nextBook++
+	b.ID = m.nextBook
+	m.books[b.ID] = b
+	return &b, nil
+}
+
+func (m *MemoryRepository) Reserve(ctx context.Context, bookID int64, memberID int64) (*Reservation, error) {
+	if err := m.before(ctx, "Reserve"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.books[bookID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if b.Stock <= 0 {
+		return nil, ErrOutOfStock
+	}
+	if _, ok := m.members[memberID]; !ok {
+		return nil, ErrNotFound
+	}
+
+	now := m.now()
+	r := Reservation{
+		ID:        m.nextRes + 1,
+		BookID:    bookID,
+		MemberID:  memberID,
+		Status:    ReservationActive,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if m.opts.Outbox != nil {
+		if err := outbox.Write(ctx, outbox.RESERVATION_CREATED, r.ID, r, m.opts.Outbox.Add); err != nil {
+			return nil, err
+		}
+	}
+
+	b.Stock--
+	m.books[bookID] = b
+	m.nextRes++
+	m.reservations[r.ID] = r
+	return &r, nil
+}
+
+func (m *MemoryRepository) GetReservation(ctx context.Context, id int64) (*Reservation, error) {
+	if err := m.before(ctx, "GetReservation"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.reservations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &r, nil
+}
+
+func (m *MemoryRepository) CancelReservation(ctx context.Context, id int64) (*Reservation, error) {
+	if err := m.before(ctx, "CancelReservation"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.reservations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if r.Status == ReservationCancelled {
+		return nil, ErrAlreadyCancelled
+	}
+
+	now := m.now()
+	r.Status = ReservationCancelled
+	r.UpdatedAt = now
+	r.CancelledAt = &now
+	m.reservations[id] = r
+
+	b := m.books[r.BookID]
+	b.Stock++
+	m.books[r.BookID] = b
+	return &r, nil
+}
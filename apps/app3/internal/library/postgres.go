@@ -0,0 +1,223 @@
+package library
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	myotel "app3/internal/otel"
+	"app3/internal/outbox"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// PostgresRepository implements BookRepository and ReservationRepository on
+// top of the schema managed by the migrate package.
+type PostgresRepository struct {
+	DB  *sql.DB
+	Otc *myotel.OtelClient
+}
+
+func NewPostgresRepository(db *sql.DB, otc *myotel.OtelClient) *PostgresRepository {
+	return &PostgresRepository{DB: db, Otc: otc}
+}
+
+const reservationColumns = "id, book_id, member_id, status, created_at, updated_at, cancelled_at"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanReservation(row scanner) (*Reservation, error) {
+	r := &Reservation{}
+	var cancelledAt sql.NullTime
+	err := row.Scan(&r.ID, &r.BookID, &r.MemberID, &r.Status, &r.CreatedAt, &r.UpdatedAt, &cancelledAt)
+	if err != nil {
+		return nil, err
+	}
+	if cancelledAt.Valid {
+		r.CancelledAt = &cancelledAt.Time
+	}
+	return r, nil
+}
+
+func (s *PostgresRepository) count(queryType string, err error) {
+	status := "success"
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		status = "failed"
+	}
+	s.Otc.PostgreSqlQueriesTotal.Add(s.Otc.Ctx, 1, metric.WithAttributes(
+		attribute.String("type", queryType),
+		attribute.String("status", status),
+	))
+}
+
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func sqlState(err error) string {
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		return state.SQLState()
+	}
+	return ""
+}
+
+// isForeignKeyViolation reports whether err is a Postgres 23503 error, which
+// the reservation insert returns for an unknown member.
+func isForeignKeyViolation(err error) bool {
+	return sqlState(err) == "23503"
+}
+
+// isUniqueViolation reports whether err is a Postgres 23505 error, returned
+// when a book with the same name and author already exists.
+func isUniqueViolation(err error) bool {
+	return sqlState(err) == "23505"
+}
+
+func (s *PostgresRepository) ListBooks(ctx context.Context) ([]Book, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT id, name, author, year, stock FROM books ORDER BY id")
+	s.count("select", err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []Book{}
+	for rows.Next() {
+		b := Book{}
+		if err := rows.Scan(&b.ID, &b.Name, &b.Author, &b.Year, &b.Stock); err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+func (s *PostgresRepository) GetBook(ctx context.Context, id int64) (*Book, error) {
+	b := &Book{}
+	err := s.DB.QueryRowContext(ctx, "SELECT id, name, author, year, stock FROM books WHERE id = $1", id).
+		Scan(&b.ID, &b.Name, &b.Author, &b.Year, &b.Stock)
+	s.count("select", err)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return b, nil
+}
+
+func (s *PostgresRepository) CreateBook(ctx context.Context, b Book) (*Book, error) {
+	err := s.DB.QueryRowContext(ctx,
+		"INSERT INTO books (name, author, year, stock) VALUES ($1, $2, $3, $4) RETURNING id",
+		b.Name, b.Author, b.Year, b.Stock,
+	).Scan(&b.ID)
+	s.count("insert", err)
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicate
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Reserve takes one copy of the book out of stock and records the reservation,
+// along with its reservation.created outbox event, in a single transaction.
+// The book row is locked so concurrent reservations cannot oversell the last
+// copy.
+func (s *PostgresRepository) Reserve(ctx context.Context, bookID int64, memberID int64) (*Reservation, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var stock int
+	err = tx.QueryRowContext(ctx, "SELECT stock FROM books WHERE id = $1 FOR UPDATE", bookID).Scan(&stock)
+	s.count("select", err)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if stock <= 0 {
+		return nil, ErrOutOfStock
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE books SET stock = stock - 1 WHERE id = $1", bookID)
+	s.count("update", err)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := scanReservation(tx.QueryRowContext(ctx,
+		"INSERT INTO reservations (book_id, member_id, status) VALUES ($1, $2, $3) RETURNING "+reservationColumns,
+		bookID, memberID, ReservationActive,
+	))
+	s.count("insert", err)
+	if isForeignKeyViolation(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = outbox.Write(ctx, outbox.RESERVATION_CREATED, r.ID, r, func(ctx context.Context, e outbox.Event) error {
+		return outbox.Insert(ctx, tx, e)
+	})
+	s.count("insert", err)
+	if err != nil {
+		return nil, err
+	}
+	return r, tx.Commit()
+}
+
+func (s *PostgresRepository) GetReservation(ctx context.Context, id int64) (*Reservation, error) {
+	r, err := scanReservation(s.DB.QueryRowContext(ctx,
+		"SELECT "+reservationColumns+" FROM reservations WHERE id = $1", id,
+	))
+	s.count("select", err)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return r, nil
+}
+
+// CancelReservation marks the reservation cancelled and puts the copy back in
+// stock, in a single transaction.
+func (s *PostgresRepository) CancelReservation(ctx context.Context, id int64) (*Reservation, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	r, err := scanReservation(tx.QueryRowContext(ctx,
+		"SELECT "+reservationColumns+" FROM reservations WHERE id = $1 FOR UPDATE", id,
+	))
+	s.count("select", err)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if r.Status == ReservationCancelled {
+		return nil, ErrAlreadyCancelled
+	}
+
+	r, err = scanReservation(tx.QueryRowContext(ctx,
+		"UPDATE reservations SET status = $2, updated_at = now(), cancelled_at = now() WHERE id = $1 RETURNING "+reservationColumns,
+		id, ReservationCancelled,
+	))
+	s.count("update", err)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE books SET stock = stock + 1 WHERE id = $1", r.BookID)
+	s.count("update", err)
+	if err != nil {
+		return nil, err
+	}
+	return r, tx.Commit()
+}
@@ -0,0 +1,174 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newBus() *MemoryBus {
+	return NewMemoryBus(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// received is what a handler saw of a message.
+type received struct {
+	ctx context.Context
+	msg Message
+}
+
+func TestRoundTrip(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	bus := newBus()
+	publisher := NewPublisher(bus, "memory", tp)
+	subscriber := NewSubscriber(bus, "memory", tp)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan received, 1)
+	failed := errors.New("out of stock")
+	err := subscriber.Subscribe(ctx, "reservations", func(ctx context.Context, topic string, msg Message) error {
+		got <- received{ctx, msg}
+		return failed
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqCtx, request := tp.Tracer("test").Start(context.Background(), "GET /reserve")
+	member, _ := baggage.NewMemberRaw("enduser.id", "user-1")
+	b, _ := baggage.New(member)
+	reqCtx = baggage.ContextWithBaggage(reqCtx, b)
+	err = publisher.Publish(reqCtx, "reservations", Message{Headers: map[string]string{"content-type": "application/json"}, Body: []byte(`{"book_id":1}`)})
+	request.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r received
+	select {
+	case r = <-got:
+	case <-time.After(time.Second):
+		t.Fatal("expected the message to be delivered")
+	}
+	if string(r.msg.Body) != `{"book_id":1}` || r.msg.ID == "" || r.msg.Headers["content-type"] != "application/json" {
+		t.Errorf("expected the message with its id and headers, got %+v", r.msg)
+	}
+	if v := baggage.FromContext(r.ctx).Member("enduser.id").Value(); v != "user-1" {
+		t.Errorf("expected the baggage to reach the handler, got %q", v)
+	}
+
+	// The CONSUMER span ends once the handler returned.
+	deadline := time.Now().Add(time.Second)
+	for len(recorder.Ended()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	producer, consumer := spans["reservations send"], spans["reservations process"]
+	if producer == nil || consumer == nil {
+		t.Fatalf("expected a send and a process span, got %v", spans)
+	}
+	if producer.SpanKind() != trace.SpanKindProducer || consumer.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("expected PRODUCER and CONSUMER spans, got %s and %s", producer.SpanKind(), consumer.SpanKind())
+	}
+	if producer.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Error("expected the PRODUCER span to be a child of the request")
+	}
+	if consumer.Parent().SpanID() != producer.SpanContext().SpanID() || !consumer.Parent().IsRemote() {
+		t.Error("expected the CONSUMER span to continue the trace from the PRODUCER span")
+	}
+	if consumer.SpanContext().TraceID() != request.SpanContext().TraceID() {
+		t.Error("expected a single trace from the request to the handler")
+	}
+	if trace.SpanFromContext(r.ctx).SpanContext().SpanID() != consumer.SpanContext().SpanID() {
+		t.Error("expected the handler to run under the CONSUMER span")
+	}
+	if consumer.Status().Code != codes.Error || consumer.Status().Description != failed.Error() {
+		t.Errorf("expected the handler error on the CONSUMER span, got %+v", consumer.Status())
+	}
+	for _, kv := range consumer.Attributes() {
+		if kv.Key == "messaging.message_id" && kv.Value.AsString() != r.msg.ID {
+			t.Errorf("expected the message id %s, got %s", r.msg.ID, kv.Value.AsString())
+		}
+	}
+}
+
+func TestMemoryBusQueueFull(t *testing.T) {
+	bus := newBus()
+	bus.QueueSize = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unblock := make(chan struct{})
+	bus.Subscribe(ctx, "reservations", func(ctx context.Context, topic string, msg Message) error {
+		<-unblock
+		return nil
+	})
+	defer close(unblock)
+
+	// The first message is being handled, the second fills the queue.
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = bus.Publish(context.Background(), "reservations", Message{})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+
+	// Messages of other topics are not affected.
+	if err := bus.Publish(context.Background(), "other", Message{}); err != nil {
+		t.Errorf("expected a topic without subscribers to accept messages, got %v", err)
+	}
+}
+
+func TestMemoryBusUnsubscribe(t *testing.T) {
+	bus := newBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	bus.Subscribe(ctx, "reservations", func(context.Context, string, Message) error { return nil })
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		bus.mu.RLock()
+		n := len(bus.subs["reservations"])
+		bus.mu.RUnlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("expected the subscription to end with its context")
+}
+
+// failingPublisher fails every publish.
+type failingPublisher struct{}
+
+func (failingPublisher) Publish(context.Context, string, Message) error {
+	return errors.New("connection refused")
+}
+
+func TestPublishError(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	err := NewPublisher(failingPublisher{}, "postgres", tp).Publish(context.Background(), "reservations", Message{})
+	if err == nil {
+		t.Fatal("expected the error of the backend")
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+		t.Errorf("expected a failed PRODUCER span, got %v", spans)
+	}
+}
@@ -0,0 +1,93 @@
+package messaging
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MAX_NOTIFY_PAYLOAD is the largest payload Postgres accepts in a NOTIFY.
+const MAX_NOTIFY_PAYLOAD = 7999
+
+// PostgresPublisher publishes messages with pg_notify, on a channel named
+// after the topic. NOTIFY is fire and forget: a message published while no
+// subscriber is listening is lost.
+type PostgresPublisher struct {
+	DB *sql.DB
+}
+
+func NewPostgresPublisher(db *sql.DB) *PostgresPublisher {
+	return &PostgresPublisher{DB: db}
+}
+
+func (p *PostgresPublisher) Publish(ctx context.Context, topic string, msg Message) error {
+	if msg.ID == "" {
+		msg.ID = newID()
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MAX_NOTIFY_PAYLOAD {
+		return fmt.Errorf("messaging: message %s is %d bytes, NOTIFY payloads are limited to %d", msg.ID, len(payload), MAX_NOTIFY_PAYLOAD)
+	}
+	_, err = p.DB.ExecContext(ctx, "SELECT pg_notify($1, $2)", topic, string(payload))
+	return err
+}
+
+// PostgresSubscriber LISTENs on a dedicated connection per subscription and
+// reconnects on its own when the connection drops.
+type PostgresSubscriber struct {
+	DSN    string
+	Logger *slog.Logger
+}
+
+func NewPostgresSubscriber(dsn string, logger *slog.Logger) *PostgresSubscriber {
+	return &PostgresSubscriber{DSN: dsn, Logger: logger}
+}
+
+func (s *PostgresSubscriber) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	listener := pq.NewListener(s.DSN, time.Second, 30*time.Second, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			s.Logger.Warn(fmt.Sprintf("Listener on [%s] got event %d: %s", topic, event, err))
+		}
+	})
+	if err := listener.Listen(topic); err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		defer listener.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-listener.Notify:
+				if n == nil {
+					// Sent after a reconnect: notifications published while
+					// the connection was down are lost.
+					s.Logger.Warn(fmt.Sprintf("Listener on [%s] reconnected, messages may have been lost", topic))
+					continue
+				}
+				msg := Message{}
+				if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+					s.Logger.Error(fmt.Sprintf("Dropping malformed message on [%s]: %s", topic, err))
+					continue
+				}
+				if err := handler(ctx, topic, msg); err != nil {
+					s.Logger.Error(fmt.Sprintf("Handling message %s from [%s] failed with [%s]", msg.ID, topic, err))
+				}
+			case <-time.After(90 * time.Second):
+				// Detects a dead connection when nothing is being published.
+				go listener.Ping()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,318 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//go:embed migrations/*.sql
+var MIGRATIONS embed.FS
+
+// LOCK_ID is the Postgres advisory lock held while migrating, so two app3
+// replicas starting at the same time do not run the same migration twice.
+const LOCK_ID = 7273_0032
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Load reads NNNN_name.up.sql / NNNN_name.down.sql pairs from the root of
+// fsys, ordered by version. Versions must start at 1 and have no gaps, so a
+// migration lost in a merge is noticed before anything is applied.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		match := fileName.FindStringSubmatch(e.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file [%s]", e.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		raw, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %04d has two names [%s] and [%s]", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(raw)
+			sum := sha256.Sum256(raw)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(raw)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %04d is missing before %s", i+1, m)
+		}
+	}
+	return migrations, nil
+}
+
+type Migrator struct {
+	DB         *sql.DB
+	Tracer     trace.Tracer
+	Logger     *slog.Logger
+	Migrations []Migration
+}
+
+// New returns a Migrator for the migrations embedded in the binary.
+func New(db *sql.DB, tracer trace.Tracer, logger *slog.Logger) (*Migrator, error) {
+	sub, err := fs.Sub(MIGRATIONS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := Load(sub)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Tracer: tracer, Logger: logger, Migrations: migrations}, nil
+}
+
+type applied struct {
+	Checksum  string
+	AppliedAt time.Time
+}
+
+type Status struct {
+	Migration Migration
+	Applied   bool
+	AppliedAt time.Time
+	// Modified is set when the embedded up file no longer matches the
+	// checksum recorded when the migration was applied.
+	Modified bool
+}
+
+func (s Status) String() string {
+	state := "pending"
+	if s.Applied {
+		state = "applied " + s.AppliedAt.Format(time.RFC3339)
+	}
+	if s.Modified {
+		state += " (checksum mismatch)"
+	}
+	return fmt.Sprintf("%s\t%s", s.Migration, state)
+}
+
+// withLock runs fn on a dedicated connection holding the migrations advisory
+// lock, after making sure the schema_migrations table exists.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", LOCK_ID); err != nil {
+		return fmt.Errorf("could not acquire migrations lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", LOCK_ID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			checksum CHAR(64) NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]applied, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := map[int]applied{}
+	for rows.Next() {
+		var version int
+		a := applied{}
+		if err := rows.Scan(&version, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		done[version] = a
+	}
+	return done, rows.Err()
+}
+
+// Up applies every pending migration in order. It refuses to run when an
+// applied migration was modified after the fact.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		todo, err := m.pending(done)
+		if err != nil {
+			return err
+		}
+		for _, mig := range todo {
+			err := m.run(ctx, conn, mig, "up", mig.Up,
+				"INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+				mig.Version, mig.Name, mig.Checksum)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pending returns the migrations missing from done, in order, or an error
+// when one in done no longer matches its checksum.
+func (m *Migrator) pending(done map[int]applied) ([]Migration, error) {
+	todo := []Migration{}
+	for _, mig := range m.Migrations {
+		a, ok := done[mig.Version]
+		if !ok {
+			todo = append(todo, mig)
+			continue
+		}
+		if a.Checksum != mig.Checksum {
+			return nil, fmt.Errorf("migration %s was modified after being applied", mig)
+		}
+	}
+	return todo, nil
+}
+
+// Down reverts the last `steps` applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.Migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.Migrations[i]
+			if _, ok := done[mig.Version]; !ok {
+				continue
+			}
+			err := m.run(ctx, conn, mig, "down", mig.Down,
+				"DELETE FROM schema_migrations WHERE version = $1", mig.Version)
+			if err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	statuses := []Status{}
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.Migrations {
+			s := Status{Migration: mig}
+			if a, ok := done[mig.Version]; ok {
+				s.Applied = true
+				s.AppliedAt = a.AppliedAt
+				s.Modified = a.Checksum != mig.Checksum
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// run executes one migration script and its bookkeeping statement in a single
+// transaction, under its own span.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, mig Migration, direction string, script string, bookkeeping string, args ...any) error {
+	start := time.Now()
+	ctx, span := m.Tracer.Start(ctx,
+		fmt.Sprintf("migrate %s %s", direction, mig),
+		trace.WithAttributes(
+			attribute.Int("migration.version", mig.Version),
+			attribute.String("migration.name", mig.Name),
+			attribute.String("migration.direction", direction),
+			attribute.String("migration.checksum", mig.Checksum),
+		),
+	)
+	defer span.End()
+
+	err := func() error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, script); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+
+	elapsed := time.Since(start)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		m.Logger.Error(
+			fmt.Sprintf("Migration %s %s failed in %d miliseconds with [%s]", direction, mig, elapsed.Milliseconds(), err),
+			slog.String("TraceId", span.SpanContext().TraceID().String()),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		)
+		return fmt.Errorf("migration %s %s: %w", direction, mig, err)
+	}
+	m.Logger.Info(
+		fmt.Sprintf("Migration %s %s succeded in %d miliseconds", direction, mig, elapsed.Milliseconds()),
+		slog.String("TraceId", span.SpanContext().TraceID().String()),
+		slog.String("SpanId", span.SpanContext().SpanID().String()),
+	)
+	return nil
+}
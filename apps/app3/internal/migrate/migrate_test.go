@@ -0,0 +1,104 @@
+package migrate
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// files returns a file system holding a file with the given name for every
+// name, holding a comment with its name.
+func files(names ...string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for _, name := range names {
+		fsys[name] = &fstest.MapFile{Data: []byte("-- " + name)}
+	}
+	return fsys
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(files(
+		"0002_library.down.sql", "0002_library.up.sql",
+		"0001_books.up.sql", "0001_books.down.sql",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+	first := migrations[0]
+	if first.Version != 1 || first.Name != "books" || first.String() != "0001_books" {
+		t.Errorf("expected 0001_books first, got %+v", first)
+	}
+	if first.Up != "-- 0001_books.up.sql" || first.Down != "-- 0001_books.down.sql" {
+		t.Errorf("expected the up and down files paired, got %q and %q", first.Up, first.Down)
+	}
+	if len(first.Checksum) != 64 || first.Checksum == migrations[1].Checksum {
+		t.Errorf("expected a sha256 checksum per up file, got %q", first.Checksum)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"missing down", []string{"0001_books.up.sql"}, "needs both an up and a down file"},
+		{"missing up", []string{"0001_books.down.sql"}, "needs both an up and a down file"},
+		{"two names", []string{"0001_books.up.sql", "0001_books.down.sql", "0001_library.up.sql"}, "has two names [books] and [library]"},
+		{"gap", []string{"0001_books.up.sql", "0001_books.down.sql", "0003_seed.up.sql", "0003_seed.down.sql"}, "migration 0002 is missing before 0003_seed"},
+		{"not from 1", []string{"0002_library.up.sql", "0002_library.down.sql"}, "migration 0001 is missing"},
+		{"unexpected file", []string{"0001_books.up.sql", "0001_books.down.sql", "README.md"}, "unexpected migration file [README.md]"},
+		{"bad direction", []string{"0001_books.sideways.sql"}, "unexpected migration file"},
+	} {
+		if _, err := Load(files(tc.files...)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	sub, err := fs.Sub(MIGRATIONS, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(sub); err != nil {
+		t.Errorf("expected the embedded migrations to load, got %v", err)
+	}
+}
+
+func TestPending(t *testing.T) {
+	migrations, err := Load(files(
+		"0001_books.up.sql", "0001_books.down.sql",
+		"0002_library.up.sql", "0002_library.down.sql",
+		"0003_seed.up.sql", "0003_seed.down.sql",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Migrator{Migrations: migrations}
+
+	todo, err := m.pending(map[int]applied{1: {Checksum: migrations[0].Checksum}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todo) != 2 || todo[0].Version != 2 || todo[1].Version != 3 {
+		t.Errorf("expected 0002 and 0003 pending, got %v", todo)
+	}
+
+	// An applied migration whose up file changed stops everything.
+	_, err = m.pending(map[int]applied{
+		1: {Checksum: migrations[0].Checksum},
+		2: {Checksum: migrations[0].Checksum},
+	})
+	if err == nil || !strings.Contains(err.Error(), "migration 0002_library was modified after being applied") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+
+	if todo, _ := m.pending(map[int]applied{}); len(todo) != 3 {
+		t.Errorf("expected every migration pending on an empty database, got %v", todo)
+	}
+}
@@ -0,0 +1,7 @@
+-- Original table created by setupDB. IF NOT EXISTS keeps databases that were
+-- bootstrapped before migrations existed working.
+CREATE TABLE IF NOT EXISTS books (
+    name VARCHAR(255),
+    author VARCHAR(255),
+    year INT
+);
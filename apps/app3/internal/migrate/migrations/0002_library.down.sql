@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS reservations;
+DROP TABLE IF EXISTS members;
+DROP INDEX IF EXISTS books_name_author_key;
+ALTER TABLE books DROP COLUMN IF EXISTS stock;
+ALTER TABLE books DROP COLUMN IF EXISTS id;
@@ -0,0 +1,33 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY;
+ALTER TABLE books ADD COLUMN IF NOT EXISTS stock INT NOT NULL DEFAULT 0 CHECK (stock >= 0);
+
+CREATE TABLE IF NOT EXISTS members (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS reservations (
+    id BIGSERIAL PRIMARY KEY,
+    book_id BIGINT NOT NULL REFERENCES books (id),
+    member_id BIGINT NOT NULL REFERENCES members (id),
+    status VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    cancelled_at TIMESTAMPTZ
+);
+
+-- setupDB inserted a new 'Harry Potter' row on every boot. Keep the oldest
+-- copy of each book, move reservations over to it and drop the duplicates.
+WITH ranked AS (
+    SELECT id, min(id) OVER (PARTITION BY name, author) AS keep FROM books
+)
+UPDATE reservations r SET book_id = ranked.keep
+FROM ranked
+WHERE r.book_id = ranked.id AND ranked.id <> ranked.keep;
+
+DELETE FROM books a USING books b
+WHERE a.name = b.name AND a.author = b.author AND a.id > b.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS books_name_author_key ON books (name, author);
+CREATE INDEX IF NOT EXISTS reservations_book_id_idx ON reservations (book_id);
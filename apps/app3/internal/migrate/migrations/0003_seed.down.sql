@@ -0,0 +1,7 @@
+DELETE FROM members m
+WHERE m.email = 'demo@library.local'
+  AND NOT EXISTS (SELECT 1 FROM reservations r WHERE r.member_id = m.id);
+
+DELETE FROM books b
+WHERE (b.name, b.author) IN (('Harry Potter', 'J.K. Rowling'), ('Dune', 'Frank Herbert'), ('The Hobbit', 'J.R.R. Tolkien'))
+  AND NOT EXISTS (SELECT 1 FROM reservations r WHERE r.book_id = b.id);
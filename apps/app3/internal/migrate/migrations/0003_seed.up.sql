@@ -0,0 +1,9 @@
+INSERT INTO books (name, author, year, stock) VALUES
+    ('Harry Potter', 'J.K. Rowling', 1997, 1000000),
+    ('Dune', 'Frank Herbert', 1965, 5),
+    ('The Hobbit', 'J.R.R. Tolkien', 1937, 1)
+ON CONFLICT (name, author) DO UPDATE SET stock = GREATEST(books.stock, EXCLUDED.stock);
+
+INSERT INTO members (name, email) VALUES
+    ('Demo Member', 'demo@library.local')
+ON CONFLICT (email) DO NOTHING;
@@ -0,0 +1,7 @@
+DELETE FROM members m
+WHERE m.email ~ '^member-[0-9]+@library\.local$'
+  AND NOT EXISTS (SELECT 1 FROM reservations r WHERE r.member_id = m.id);
+
+DELETE FROM books b
+WHERE b.name ~ '^Book [0-9]+$' AND b.author ~ '^Author [0-9]+$'
+  AND NOT EXISTS (SELECT 1 FROM reservations r WHERE r.book_id = b.id);
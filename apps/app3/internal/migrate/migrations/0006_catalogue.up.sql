@@ -0,0 +1,14 @@
+-- The client picks books 1 to 100 and users 1 to 1000 by default, so the
+-- catalogue and the members cover them. Harry Potter keeps the stock 0003
+-- gave it: the default client reserves book 1 on every request.
+INSERT INTO books (name, author, year, stock)
+SELECT 'Book ' || n, 'Author ' || (n % 40 + 1), 1900 + n, 20 + (n * 37) % 180
+FROM generate_series(4, 100) AS n
+ON CONFLICT (name, author) DO NOTHING;
+
+-- Member n is synthetic user-n, member 1 is the demo member of 0003.
+INSERT INTO members (id, name, email)
+SELECT n, 'Member ' || n, 'member-' || n || '@library.local'
+FROM generate_series(2, 1000) AS n
+ON CONFLICT DO NOTHING;
+SELECT setval('members_id_seq', (SELECT max(id) FROM members));
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS outbox_pending;
+ALTER TABLE outbox DROP COLUMN IF EXISTS failed_at;
+ALTER TABLE outbox DROP COLUMN IF EXISTS next_attempt_at;
+CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (id) WHERE sent_at IS NULL;
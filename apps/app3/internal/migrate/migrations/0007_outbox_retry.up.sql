@@ -0,0 +1,10 @@
+-- Failed outbox events are retried with an exponential backoff instead of on
+-- every poll, and given up on after outbox.MAX_ATTEMPTS attempts. A relay
+-- claims the events it publishes by pushing next_attempt_at past the claim
+-- timeout, so other relays skip them without a transaction held open while
+-- the sink is called.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS failed_at TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS outbox_pending;
+CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (next_attempt_at, id) WHERE sent_at IS NULL AND failed_at IS NULL;
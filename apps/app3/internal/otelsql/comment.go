@@ -0,0 +1,66 @@
+package otelsql
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type routeKey struct{}
+
+// ContextWithRoute records the HTTP route serving a request, e.g. /reserve,
+// for the sqlcommenter comment of the statements it runs.
+func ContextWithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+func routeFromContext(ctx context.Context) string {
+	route, _ := ctx.Value(routeKey{}).(string)
+	return route
+}
+
+// comment appends a sqlcommenter (https://google.github.io/sqlcommenter/spec/)
+// comment to query, carrying the traceparent of the span in ctx, the service
+// and the route, so a statement seen in pg_stat_activity or the Postgres logs
+// can be tied back to its trace:
+//
+//	SELECT 1 /*route='%2Freserve',service='app3',traceparent='00-...-01'*/
+//
+// Statements that already hold a comment are left alone, as the spec asks.
+func (t *tracer) comment(ctx context.Context, query string) string {
+	if !t.sqlComment || strings.Contains(query, "/*") || strings.Contains(query, "--") {
+		return query
+	}
+
+	tags := map[string]string{}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	if tp := carrier.Get("traceparent"); tp != "" {
+		tags["traceparent"] = tp
+	}
+	if t.service != "" {
+		tags["service"] = t.service
+	}
+	if route := routeFromContext(ctx); route != "" {
+		tags["route"] = route
+	}
+	if len(tags) == 0 {
+		return query
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = url.QueryEscape(k) + "='" + url.PathEscape(tags[k]) + "'"
+	}
+
+	trimmed := strings.TrimRight(query, "; \t\r\n")
+	return trimmed + " /*" + strings.Join(pairs, ",") + "*/" + query[len(trimmed):]
+}
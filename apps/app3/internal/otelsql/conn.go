@@ -0,0 +1,352 @@
+package otelsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	_ driver.Conn               = (*conn)(nil)
+	_ driver.ConnPrepareContext = (*conn)(nil)
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.Pinger             = (*conn)(nil)
+	_ driver.SessionResetter    = (*conn)(nil)
+	_ driver.Validator          = (*conn)(nil)
+	_ driver.NamedValueChecker  = (*conn)(nil)
+	_ driver.StmtExecContext    = (*stmt)(nil)
+	_ driver.StmtQueryContext   = (*stmt)(nil)
+	_ driver.RowsNextResultSet  = (*rows)(nil)
+)
+
+type conn struct {
+	conn driver.Conn
+	t    *tracer
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	ctx, span := c.t.start(ctx, "sql.prepare "+Operation(query), query)
+
+	var s driver.Stmt
+	var err error
+	if pc, ok := c.conn.(driver.ConnPrepareContext); ok {
+		s, err = pc.PrepareContext(ctx, c.t.comment(ctx, query))
+	} else {
+		s, err = c.conn.Prepare(c.t.comment(ctx, query))
+	}
+	c.t.end(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{stmt: s, query: query, t: c.t}, nil
+}
+
+func (c *conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	beginCtx, span := c.t.start(ctx, "sql.begin", "",
+		attribute.Bool("db.transaction.read_only", opts.ReadOnly),
+	)
+
+	var tx driver.Tx
+	var err error
+	if bc, ok := c.conn.(driver.ConnBeginTx); ok {
+		tx, err = bc.BeginTx(beginCtx, opts)
+	} else {
+		tx, err = c.conn.Begin()
+	}
+	c.t.end(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &txn{tx: tx, ctx: ctx, t: c.t}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	ctx, span := c.t.start(ctx, "", query)
+	err := c.t.beforeStatement(ctx, query)
+	var res driver.Result
+	if err == nil {
+		res, err = ec.ExecContext(ctx, c.t.comment(ctx, query), args)
+	}
+	if errors.Is(err, driver.ErrSkip) {
+		// database/sql retries through Prepare, which gets its own span.
+		span.End()
+		return nil, err
+	}
+	c.t.endExec(ctx, span, query, start, res, err)
+	return res, err
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	queryCtx, span := c.t.start(ctx, "", query)
+	err := c.t.beforeStatement(queryCtx, query)
+	var r driver.Rows
+	if err == nil {
+		r, err = qc.QueryContext(queryCtx, c.t.comment(queryCtx, query), args)
+	}
+	if errors.Is(err, driver.ErrSkip) {
+		span.End()
+		return nil, err
+	}
+	return c.t.endQuery(queryCtx, span, query, start, r, err)
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	p, ok := c.conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+	ctx, span := c.t.start(ctx, "sql.ping", "")
+	err := p.Ping(ctx)
+	c.t.end(span, err)
+	return err
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if r, ok := c.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	if v, ok := c.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type stmt struct {
+	stmt  driver.Stmt
+	query string
+	t     *tracer
+}
+
+func (s *stmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *stmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.stmt.Exec(args)
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.stmt.Query(args)
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	ctx, span := s.t.start(ctx, "", s.query)
+	var res driver.Result
+	err := s.t.beforeStatement(ctx, s.query)
+	if err == nil {
+		res, err = s.exec(ctx, args)
+	}
+	s.t.endExec(ctx, span, s.query, start, res, err)
+	return res, err
+}
+
+func (s *stmt) exec(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if ec, ok := s.stmt.(driver.StmtExecContext); ok {
+		return ec.ExecContext(ctx, args)
+	}
+	values, err := namedToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.stmt.Exec(values)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	queryCtx, span := s.t.start(ctx, "", s.query)
+	var r driver.Rows
+	err := s.t.beforeStatement(queryCtx, s.query)
+	if err == nil {
+		r, err = s.queryRows(queryCtx, args)
+	}
+	return s.t.endQuery(queryCtx, span, s.query, start, r, err)
+}
+
+func (s *stmt) queryRows(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if qc, ok := s.stmt.(driver.StmtQueryContext); ok {
+		return qc.QueryContext(ctx, args)
+	}
+	values, err := namedToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.stmt.Query(values)
+}
+
+func (s *stmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func namedToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("otelsql: driver does not support named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// endExec ends the span of an exec and observes it with the number of rows it
+// affected.
+func (t *tracer) endExec(ctx context.Context, span trace.Span, query string, start time.Time, res driver.Result, err error) {
+	var affected int64
+	if err == nil && res != nil {
+		if n, err := res.RowsAffected(); err == nil {
+			affected = n
+			span.SetAttributes(attribute.Int64("db.rows_affected", n))
+		}
+	}
+	if t.observe(ctx, query, start, affected, err) {
+		span.SetAttributes(attribute.Bool("db.slow_query", true))
+	}
+	t.end(span, err)
+}
+
+// endQuery ends the span of a query. A failed query is observed right away,
+// otherwise the observation happens once its rows are closed.
+func (t *tracer) endQuery(ctx context.Context, span trace.Span, query string, start time.Time, r driver.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		if t.observe(ctx, query, start, 0, err) {
+			span.SetAttributes(attribute.Bool("db.slow_query", true))
+		}
+		t.end(span, err)
+		return nil, err
+	}
+	t.end(span, nil)
+	return t.wrapRows(ctx, r, query, start), nil
+}
+
+// txn parents its commit and rollback spans on the context the transaction
+// was started with, so they are siblings of the statements it ran.
+type txn struct {
+	tx  driver.Tx
+	ctx context.Context
+	t   *tracer
+}
+
+func (tx *txn) Commit() error {
+	_, span := tx.t.start(tx.ctx, "sql.commit", "")
+	err := tx.tx.Commit()
+	tx.t.end(span, err)
+	return err
+}
+
+func (tx *txn) Rollback() error {
+	_, span := tx.t.start(tx.ctx, "sql.rollback", "")
+	err := tx.tx.Rollback()
+	tx.t.end(span, err)
+	return err
+}
+
+// rows covers the iteration of a result set with a span that ends when the
+// rows are closed and records how many rows were read. Closing the rows also
+// observes the query that produced them.
+type rows struct {
+	rows  driver.Rows
+	span  trace.Span
+	count int64
+	err   error
+
+	t     *tracer
+	ctx   context.Context
+	query string
+	start time.Time
+}
+
+func (t *tracer) wrapRows(ctx context.Context, r driver.Rows, query string, start time.Time) driver.Rows {
+	_, span := t.start(ctx, "sql.rows", "")
+	return &rows{rows: r, span: span, t: t, ctx: ctx, query: query, start: start}
+}
+
+func (r *rows) Columns() []string {
+	return r.rows.Columns()
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	err := r.rows.Next(dest)
+	if err == nil {
+		r.count++
+	} else if err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *rows) HasNextResultSet() bool {
+	if n, ok := r.rows.(driver.RowsNextResultSet); ok {
+		return n.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *rows) NextResultSet() error {
+	if n, ok := r.rows.(driver.RowsNextResultSet); ok {
+		return n.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (r *rows) Close() error {
+	err := r.rows.Close()
+	r.span.SetAttributes(attribute.Int64("db.rows_returned", r.count))
+	failed := r.err
+	if failed == nil {
+		failed = err
+	}
+	if r.t.observe(r.ctx, r.query, r.start, r.count, failed) {
+		r.span.SetAttributes(attribute.Bool("db.slow_query", true))
+	}
+	recordError(r.span, failed)
+	r.span.End()
+	return err
+}
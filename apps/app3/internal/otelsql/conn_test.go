@@ -0,0 +1,426 @@
+package otelsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// sqlStateError is a driver error carrying a Postgres SQLSTATE, like pq.Error.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sql state " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+// fakeDriver answers every query with rows rows and every exec with one
+// affected row, failing statements that contain "fail". It records the
+// statements it receives.
+type fakeDriver struct {
+	rows int
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+func (d *fakeDriver) received(query string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries = append(d.queries, query)
+	if strings.Contains(query, "fail") {
+		return sqlStateError("23505")
+	}
+	return nil
+}
+
+func (d *fakeDriver) sent() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.queries...)
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.d.received(query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.d.received(query); err != nil {
+		return nil, err
+	}
+	return &fakeRows{left: c.d.rows}, nil
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.c.ExecContext(context.Background(), s.query, nil)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.c.QueryContext(context.Background(), s.query, nil)
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	left int
+}
+
+func (r *fakeRows) Columns() []string { return []string{"id"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.left == 0 {
+		return io.EOF
+	}
+	r.left--
+	dest[0] = int64(r.left)
+	return nil
+}
+
+// open returns a database over a fakeDriver answering rows rows, with its
+// spans and metrics going to the returned recorder and reader.
+func open(t *testing.T, rows int) (*sql.DB, *fakeDriver, *tracetest.SpanRecorder, *metricsdk.ManualReader) {
+	t.Helper()
+	fake := &fakeDriver{rows: rows}
+	recorder := tracetest.NewSpanRecorder()
+	reader := metricsdk.NewManualReader()
+	d := Wrap(fake, Config{
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+		MeterProvider:  metricsdk.NewMeterProvider(metricsdk.WithReader(reader)),
+		SQLComment:     true,
+		Service:        "app3",
+	})
+	db := sql.OpenDB(mustConnector(t, d))
+	t.Cleanup(func() { db.Close() })
+	return db, fake, recorder, reader
+}
+
+// spans returns the ended spans by name, failing on duplicates.
+func spans(t *testing.T, recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	t.Helper()
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		if _, ok := byName[s.Name()]; ok {
+			t.Fatalf("expected a single %s span", s.Name())
+		}
+		byName[s.Name()] = s
+	}
+	return byName
+}
+
+func attr(s sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// durations returns the number of statements recorded in the duration
+// histogram by fingerprint and outcome.
+func durations(t *testing.T, reader *metricsdk.ManualReader) map[string]uint64 {
+	t.Helper()
+	rm := metricdata.ResourceMetrics{}
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]uint64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "db.client.operation.duration" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+				fingerprint, _ := dp.Attributes.Value("db.query.fingerprint")
+				outcome, _ := dp.Attributes.Value("outcome")
+				counts[fingerprint.AsString()+" "+outcome.AsString()] += dp.Count
+			}
+		}
+	}
+	return counts
+}
+
+func TestQuery(t *testing.T) {
+	db, fake, recorder, reader := open(t, 3)
+	ctx := ContextWithRoute(context.Background(), "/books")
+
+	query := "SELECT id FROM books WHERE stock > $1"
+	rows, err := db.QueryContext(ctx, query, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+
+	got := spans(t, recorder)
+	span, ok := got["SELECT"]
+	if !ok {
+		t.Fatalf("expected a SELECT span, got %v", got)
+	}
+	if v := attr(span, "db.statement").AsString(); v != query {
+		t.Errorf("expected db.statement %q without the comment, got %q", query, v)
+	}
+	if v := attr(span, "db.query.fingerprint").AsString(); v != "SELECT id FROM books WHERE stock > ?" {
+		t.Errorf("expected the fingerprint, got %q", v)
+	}
+	if v := attr(span, "db.operation").AsString(); v != "SELECT" {
+		t.Errorf("expected db.operation SELECT, got %q", v)
+	}
+	if n := attr(got["sql.rows"], "db.rows_returned").AsInt64(); n != 3 {
+		t.Errorf("expected db.rows_returned 3, got %d", n)
+	}
+	if got["sql.rows"].Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Error("expected the sql.rows span to be a child of the query")
+	}
+
+	sent := fake.sent()[0]
+	want := "traceparent='00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String()
+	if !strings.HasPrefix(sent, query+" /*route='%2Fbooks',service='app3',") || !strings.Contains(sent, want) {
+		t.Errorf("expected the statement sent with the sqlcommenter comment of its span, got %q", sent)
+	}
+
+	if n := durations(t, reader)["SELECT id FROM books WHERE stock > ? success"]; n != 1 {
+		t.Errorf("expected 1 successful SELECT in the duration histogram, got %d", n)
+	}
+}
+
+func TestExec(t *testing.T) {
+	db, _, recorder, reader := open(t, 0)
+
+	if _, err := db.ExecContext(context.Background(), "UPDATE books SET stock = stock - 1 WHERE id = $1", 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.ExecContext(context.Background(), "INSERT INTO fail VALUES ($1)", 1)
+	if err == nil {
+		t.Fatal("expected the insert to fail")
+	}
+
+	got := spans(t, recorder)
+	if n := attr(got["UPDATE"], "db.rows_affected").AsInt64(); n != 1 {
+		t.Errorf("expected db.rows_affected 1, got %d", n)
+	}
+	if got["UPDATE"].Status().Code == codes.Error {
+		t.Error("expected the UPDATE span not to be an error")
+	}
+	failed := got["INSERT"]
+	if failed.Status().Code != codes.Error || failed.Status().Description != err.Error() {
+		t.Errorf("expected the INSERT span to be an error, got %+v", failed.Status())
+	}
+	if v := attr(failed, "db.sql_state").AsString(); v != "23505" {
+		t.Errorf("expected db.sql_state 23505, got %q", v)
+	}
+
+	counts := durations(t, reader)
+	if counts["UPDATE books SET stock = stock - ? WHERE id = ? success"] != 1 || counts["INSERT INTO fail VALUES (?) error"] != 1 {
+		t.Errorf("expected a success and an error in the duration histogram, got %v", counts)
+	}
+}
+
+func TestTx(t *testing.T) {
+	db, _, recorder, _ := open(t, 0)
+	ctx := context.Background()
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM outbox"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]int{}
+	for _, s := range recorder.Ended() {
+		names[s.Name()]++
+	}
+	for name, n := range map[string]int{"sql.begin": 2, "DELETE": 1, "sql.commit": 1, "sql.rollback": 1} {
+		if names[name] != n {
+			t.Errorf("expected %d %s spans, got %d", n, name, names[name])
+		}
+	}
+	for _, s := range recorder.Ended() {
+		if s.Name() == "sql.begin" && attr(s, "db.transaction.read_only").AsBool() {
+			return
+		}
+	}
+	t.Error("expected a read only sql.begin span")
+}
+
+func TestPrepare(t *testing.T) {
+	db, fake, recorder, reader := open(t, 2)
+	ctx := context.Background()
+
+	query := "SELECT name FROM books WHERE id = $1"
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+
+	got := spans(t, recorder)
+	for _, name := range []string{"sql.prepare SELECT", "SELECT", "sql.rows"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("expected a %s span, got %v", name, got)
+		}
+	}
+	if !strings.Contains(fake.sent()[0], "/*service='app3'") {
+		t.Errorf("expected the prepared statement to carry the comment, got %q", fake.sent()[0])
+	}
+	if n := durations(t, reader)["SELECT name FROM books WHERE id = ? success"]; n != 1 {
+		t.Errorf("expected the prepared query in the duration histogram once, got %d", n)
+	}
+}
+
+func TestWithoutSpans(t *testing.T) {
+	db, _, recorder, reader := open(t, 0)
+
+	if _, err := db.ExecContext(WithoutSpans(context.Background()), "DELETE FROM outbox"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range recorder.Ended() {
+		if s.Name() != "sql.connect" {
+			t.Errorf("expected no statement spans, got %s", s.Name())
+		}
+	}
+	if n := durations(t, reader)["DELETE FROM outbox success"]; n != 1 {
+		t.Errorf("expected the statement to be measured anyway, got %d", n)
+	}
+}
+
+func TestBeforeStatement(t *testing.T) {
+	fake := &fakeDriver{}
+	recorder := tracetest.NewSpanRecorder()
+	refused := errors.New("refused")
+	db := sql.OpenDB(mustConnector(t, Wrap(fake, Config{
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+		BeforeStatement: func(ctx context.Context, query string) error {
+			return refused
+		},
+	})))
+	defer db.Close()
+
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM outbox"); !errors.Is(err, refused) {
+		t.Errorf("expected the hook error, got %v", err)
+	}
+	if len(fake.sent()) != 0 {
+		t.Errorf("expected nothing to reach the driver, got %v", fake.sent())
+	}
+	if s := spans(t, recorder)["DELETE"]; s == nil || s.Status().Code != codes.Error {
+		t.Error("expected the DELETE span to be an error")
+	}
+}
+
+func mustConnector(t *testing.T, d driver.Driver) driver.Connector {
+	t.Helper()
+	c, err := d.(driver.DriverContext).OpenConnector("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRecordStats(t *testing.T) {
+	db, _, _, _ := open(t, 0)
+	db.SetMaxOpenConns(4)
+	if err := db.PingContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := metricsdk.NewManualReader()
+	meter := metricsdk.NewMeterProvider(metricsdk.WithReader(reader)).Meter("test")
+	if err := RecordStats(db, meter, attribute.String("pool.name", "library")); err != nil {
+		t.Fatal(err)
+	}
+	rm := metricdata.ResourceMetrics{}
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+
+	gauges := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			gauge, ok := m.Data.(metricdata.Gauge[int64])
+			if !ok {
+				continue
+			}
+			for _, dp := range gauge.DataPoints {
+				if pool, _ := dp.Attributes.Value("pool.name"); pool.AsString() != "library" {
+					t.Errorf("expected %s to carry the pool name", m.Name)
+				}
+				key := m.Name
+				if state, ok := dp.Attributes.Value("state"); ok {
+					key += " " + state.AsString()
+				}
+				gauges[key] = dp.Value
+			}
+		}
+	}
+	for key, want := range map[string]int64{
+		"db.client.connections.open":       1,
+		"db.client.connections.usage idle": 1,
+		"db.client.connections.usage used": 0,
+		"db.client.connections.max":        4,
+	} {
+		if got, ok := gauges[key]; !ok || got != want {
+			t.Errorf("expected %s to be %d, got %d", key, want, got)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package otelsql
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Fingerprint normalizes a statement so that executions differing only in
+// their literals share one value: comments are dropped, string, numeric and
+// positional parameters become ?, lists of them collapse to a single ?, and
+// whitespace is collapsed. Keywords and identifiers are kept as written.
+//
+//	SELECT * FROM books WHERE id IN (1, 2, $3) AND name = 'x'
+//	SELECT * FROM books WHERE id IN (?) AND name = ?
+func Fingerprint(query string) string {
+	out := make([]rune, 0, len(query))
+	src := []rune(query)
+	space := false
+
+	emit := func(r rune) {
+		if space && len(out) > 0 {
+			out = append(out, ' ')
+		}
+		space = false
+		out = append(out, r)
+	}
+	// placeholder writes a ?, folding "?, ?" into the previous one.
+	placeholder := func() {
+		n := len(out)
+		if n >= 2 && out[n-1] == ',' && out[n-2] == '?' {
+			out = out[:n-1]
+			space = false
+			return
+		}
+		emit('?')
+	}
+	prevIdent := func() bool {
+		if space || len(out) == 0 {
+			return false
+		}
+		r := out[len(out)-1]
+		return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+
+	for i := 0; i < len(src); i++ {
+		r := src[i]
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+		case r == '-' && i+1 < len(src) && src[i+1] == '-':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			space = true
+		case r == '/' && i+1 < len(src) && src[i+1] == '*':
+			i += 2
+			for i+1 < len(src) && !(src[i] == '*' && src[i+1] == '/') {
+				i++
+			}
+			i++
+			space = true
+		case r == '\'':
+			// '' inside a literal is an escaped quote.
+			for i++; i < len(src); i++ {
+				if src[i] == '\'' {
+					if i+1 < len(src) && src[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			placeholder()
+		case r == '$' && i+1 < len(src) && unicode.IsDigit(src[i+1]):
+			for i+1 < len(src) && unicode.IsDigit(src[i+1]) {
+				i++
+			}
+			placeholder()
+		case unicode.IsDigit(r) && !prevIdent():
+			for i+1 < len(src) && (unicode.IsDigit(src[i+1]) || src[i+1] == '.') {
+				i++
+			}
+			placeholder()
+		case r == '?':
+			placeholder()
+		default:
+			emit(r)
+		}
+	}
+	return strings.TrimRight(string(out), "; ")
+}
@@ -0,0 +1,374 @@
+// Package otelsql wraps a database/sql driver so every connect, query, exec,
+// prepare, transaction and row iteration produces a CLIENT span.
+//
+// Register the wrapped driver once and open the database with its name:
+//
+//	otelsql.Register("postgres-otel", &pq.Driver{}, otelsql.Config{...})
+//	db, err := sql.Open("postgres-otel", dsn)
+//
+// Spans are parented on the context passed to the *Context methods of
+// database/sql, so callers must use QueryContext, ExecContext, BeginTx, etc.
+//
+// With a MeterProvider every statement is also recorded in the
+// db.client.operation.duration histogram, labeled with its Fingerprint, and
+// with a Logger statements slower than SlowQueryThreshold are logged.
+package otelsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "app3/internal/otelsql"
+
+type Config struct {
+	TracerProvider trace.TracerProvider
+	// System is the db.system attribute, e.g. semconv.DBSystemPostgreSQL.
+	System attribute.KeyValue
+	DBName string
+	User   string
+	Host   string
+	Port   int
+	// Attributes are added to every span.
+	Attributes []attribute.KeyValue
+
+	// MeterProvider, when set, records db.client.operation.duration.
+	MeterProvider metric.MeterProvider
+	// Logger, when set, receives a warning for every statement that takes
+	// longer than SlowQueryThreshold. A zero threshold disables the log.
+	Logger             *slog.Logger
+	SlowQueryThreshold time.Duration
+	// BeforeStatement, when set, runs inside the span of every query and
+	// exec before it reaches the driver. An error aborts the statement.
+	BeforeStatement func(ctx context.Context, query string) error
+
+	// SQLComment appends a sqlcommenter comment with the traceparent of the
+	// statement span, Service and the route set by ContextWithRoute to the
+	// statements sent to the database. Spans and metrics keep the original.
+	SQLComment bool
+	Service    string
+}
+
+type otelDriver struct {
+	driver driver.Driver
+	t      *tracer
+}
+
+// Wrap returns a driver instrumenting d.
+func Wrap(d driver.Driver, cfg Config) driver.Driver {
+	return &otelDriver{driver: d, t: newTracer(cfg)}
+}
+
+// Register wraps d and registers it with database/sql under name.
+func Register(name string, d driver.Driver, cfg Config) {
+	sql.Register(name, Wrap(d, cfg))
+}
+
+func (d *otelDriver) Open(name string) (driver.Conn, error) {
+	return d.connect(context.Background(), func(context.Context) (driver.Conn, error) {
+		return d.driver.Open(name)
+	})
+}
+
+func (d *otelDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.driver.(driver.DriverContext); ok {
+		c, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &connector{connector: c, driver: d}, nil
+	}
+	return &connector{connector: dsnConnector{dsn: name, driver: d.driver}, driver: d}, nil
+}
+
+func (d *otelDriver) connect(ctx context.Context, open func(context.Context) (driver.Conn, error)) (driver.Conn, error) {
+	ctx, span := d.t.start(ctx, "sql.connect", "")
+	c, err := open(ctx)
+	d.t.end(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{conn: c, t: d.t}, nil
+}
+
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type connector struct {
+	connector driver.Connector
+	driver    *otelDriver
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.connect(ctx, c.connector.Connect)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+type tracer struct {
+	tracer trace.Tracer
+	attrs  []attribute.KeyValue
+
+	duration  metric.Float64Histogram
+	logger    *slog.Logger
+	slowQuery time.Duration
+	before    func(ctx context.Context, query string) error
+
+	sqlComment bool
+	service    string
+}
+
+func newTracer(cfg Config) *tracer {
+	attrs := []attribute.KeyValue{}
+	if cfg.System.Valid() {
+		attrs = append(attrs, cfg.System)
+	}
+	if cfg.DBName != "" {
+		attrs = append(attrs, semconv.DBNameKey.String(cfg.DBName))
+	}
+	if cfg.User != "" {
+		attrs = append(attrs, semconv.DBUserKey.String(cfg.User))
+	}
+	if cfg.Host != "" {
+		attrs = append(attrs, semconv.NetPeerNameKey.String(cfg.Host))
+	}
+	if cfg.Port != 0 {
+		attrs = append(attrs, semconv.NetPeerPortKey.Int(cfg.Port))
+	}
+	attrs = append(attrs, cfg.Attributes...)
+
+	var duration metric.Float64Histogram = noop.Float64Histogram{}
+	if cfg.MeterProvider != nil {
+		h, err := cfg.MeterProvider.Meter(instrumentationName).Float64Histogram(
+			"db.client.operation.duration",
+			metric.WithDescription("Duration of database statements, from execution until their rows are closed"),
+			metric.WithUnit("s"),
+			metric.WithExplicitBucketBoundaries(0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+		)
+		if err != nil {
+			otel.Handle(err)
+		} else {
+			duration = h
+		}
+	}
+	return &tracer{
+		tracer:    cfg.TracerProvider.Tracer(instrumentationName),
+		attrs:     attrs,
+		duration:  duration,
+		logger:    cfg.Logger,
+		slowQuery: cfg.SlowQueryThreshold,
+		before:    cfg.BeforeStatement,
+
+		sqlComment: cfg.SQLComment,
+		service:    cfg.Service,
+	}
+}
+
+type withoutSpansKey struct{}
+
+// WithoutSpans returns a context whose statements produce no spans, for
+// background pollers that would otherwise start a new trace on every tick.
+// Their statements are still measured and logged when slow.
+func WithoutSpans(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutSpansKey{}, true)
+}
+
+// start opens a CLIENT span. When query is set and name is empty the span is
+// named after the SQL operation, e.g. SELECT.
+func (t *tracer) start(ctx context.Context, name string, query string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx.Value(withoutSpansKey{}) != nil {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	all := append([]attribute.KeyValue{}, t.attrs...)
+	if query != "" {
+		op := Operation(query)
+		all = append(all,
+			semconv.DBStatementKey.String(query),
+			semconv.DBOperationKey.String(op),
+			attribute.String("db.query.fingerprint", Fingerprint(query)),
+		)
+		if name == "" {
+			name = op
+		}
+	}
+	all = append(all, attrs...)
+	return t.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(all...),
+	)
+}
+
+func (t *tracer) end(span trace.Span, err error) {
+	recordError(span, err)
+	span.End()
+}
+
+// beforeStatement runs the BeforeStatement hook, if any.
+func (t *tracer) beforeStatement(ctx context.Context, query string) error {
+	if t.before == nil {
+		return nil
+	}
+	return t.before(ctx, query)
+}
+
+// observe records a finished statement in the duration histogram and logs it
+// when it was slow, reporting whether it was. ctx carries the statement span.
+func (t *tracer) observe(ctx context.Context, query string, start time.Time, rows int64, err error) bool {
+	elapsed := time.Since(start)
+	fingerprint := Fingerprint(query)
+	op := Operation(query)
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	t.duration.Record(ctx, elapsed.Seconds(), metric.WithAttributes(
+		attribute.String("db.query.fingerprint", fingerprint),
+		semconv.DBOperationKey.String(op),
+		attribute.String("outcome", outcome),
+	))
+
+	if t.slowQuery <= 0 || elapsed < t.slowQuery {
+		return false
+	}
+	if t.logger == nil {
+		return true
+	}
+	span := trace.SpanFromContext(ctx)
+	t.logger.WarnContext(ctx,
+		fmt.Sprintf("Slow query %s took %d miliseconds", op, elapsed.Milliseconds()),
+		slog.String("TraceId", span.SpanContext().TraceID().String()),
+		slog.String("SpanId", span.SpanContext().SpanID().String()),
+		slog.String("db.query.fingerprint", fingerprint),
+		slog.String("db.statement", query),
+		slog.String("db.operation", op),
+		slog.Int64("db.rows", rows),
+		slog.String("outcome", outcome),
+		slog.Int64("threshold_ms", t.slowQuery.Milliseconds()),
+	)
+	return true
+}
+
+// recordError maps a driver error onto the span. driver.ErrSkip only asks
+// database/sql to fall back to another code path, so it is not an error.
+func recordError(span trace.Span, err error) {
+	if err == nil || errors.Is(err, driver.ErrSkip) {
+		return
+	}
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		span.SetAttributes(attribute.String("db.sql_state", state.SQLState()))
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		span.SetAttributes(attribute.Bool("db.bad_connection", true))
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		span.SetAttributes(attribute.Bool("db.cancelled", true))
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Operation returns the upper cased first keyword of a statement, e.g. SELECT,
+// after any leading comments. A WITH query returns the statement that follows
+// its common table expressions, e.g. SELECT for WITH x AS (...) SELECT.
+func Operation(query string) string {
+	words := topLevelWords(query)
+	if len(words) == 0 {
+		return "UNKNOWN"
+	}
+	if words[0] != "WITH" {
+		return words[0]
+	}
+	for _, w := range words[1:] {
+		switch w {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "VALUES", "TABLE":
+			return w
+		}
+	}
+	return "WITH"
+}
+
+// topLevelWords returns the upper cased words of query outside of comments,
+// string literals and parentheses, e.g. the subqueries of a WITH.
+func topLevelWords(query string) []string {
+	words := []string{}
+	depth := 0
+	start := -1
+	flush := func(end int) {
+		if start >= 0 && depth == 0 {
+			words = append(words, strings.ToUpper(query[start:end]))
+		}
+		start = -1
+	}
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case strings.HasPrefix(query[i:], "--"):
+			flush(i)
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(query)
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			flush(i)
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(query)
+			}
+		case c == '\'' || c == '"':
+			flush(i)
+			if end := strings.IndexByte(query[i+1:], c); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case c == '(':
+			flush(i)
+			// Parentheses around the whole statement are not a subquery.
+			if len(words) > 0 {
+				depth++
+			}
+		case c == ')':
+			flush(i)
+			if depth > 0 {
+				depth--
+			}
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || start >= 0 && '0' <= c && c <= '9':
+			if start < 0 {
+				start = i
+			}
+		default:
+			flush(i)
+		}
+	}
+	flush(len(query))
+	return words
+}
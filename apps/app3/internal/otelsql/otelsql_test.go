@@ -0,0 +1,89 @@
+package otelsql
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestOperation(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"select * from books", "SELECT"},
+		{"  (SELECT 1) UNION (SELECT 2)", "SELECT"},
+		{"INSERT INTO books VALUES ($1); ", "INSERT"},
+		{"-- Original table created by setupDB.\n-- IF NOT EXISTS keeps it working.\nCREATE TABLE IF NOT EXISTS books (id INT)", "CREATE"},
+		{"/* leading */ /* twice */ UPDATE books SET stock = stock - 1", "UPDATE"},
+		{"SELECT 1 /*route='%2Freserve'*/", "SELECT"},
+		{"WITH popular AS (SELECT id FROM books) SELECT * FROM popular", "SELECT"},
+		{"WITH RECURSIVE t(n) AS (SELECT 1), gone AS (DELETE FROM outbox RETURNING id) UPDATE books SET name = '(select'", "UPDATE"},
+		{"-- WITH comment only\n", "UNKNOWN"},
+		{"", "UNKNOWN"},
+	} {
+		if got := Operation(tc.query); got != tc.want {
+			t.Errorf("Operation(%q) = %s, want %s", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM books WHERE id IN (1, 2, $3) AND name = 'x'", "SELECT * FROM books WHERE id IN (?) AND name = ?"},
+		{"SELECT * FROM books WHERE id = $1", "SELECT * FROM books WHERE id = ?"},
+		{"SELECT * FROM books WHERE id = 42", "SELECT * FROM books WHERE id = ?"},
+		{"UPDATE books SET price = 9.99 WHERE name = 'It''s'", "UPDATE books SET price = ? WHERE name = ?"},
+		{"INSERT INTO books (name, stock) VALUES ($1, $2)", "INSERT INTO books (name, stock) VALUES (?)"},
+		{"SELECT id FROM table2 WHERE col1 = ?", "SELECT id FROM table2 WHERE col1 = ?"},
+		{"SELECT 1 -- the comment\n  FROM   books\n\t;", "SELECT ? FROM books"},
+		{"SELECT /* hint */ name FROM books /*route='%2Freserve'*/", "SELECT name FROM books"},
+		{"", ""},
+	} {
+		if got := Fingerprint(tc.query); got != tc.want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestComment(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	spanID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	spanCtx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+	traceparent := "traceparent='00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'"
+
+	for _, tc := range []struct {
+		name  string
+		t     *tracer
+		ctx   context.Context
+		query string
+		want  string
+	}{
+		{"disabled", &tracer{service: "app3"}, spanCtx, "SELECT 1", "SELECT 1"},
+		{"nothing to tag", &tracer{sqlComment: true}, context.Background(), "SELECT 1", "SELECT 1"},
+		{"service", &tracer{sqlComment: true, service: "app3"}, context.Background(), "SELECT 1", "SELECT 1 /*service='app3'*/"},
+		{
+			"sorted tags",
+			&tracer{sqlComment: true, service: "app3"},
+			ContextWithRoute(spanCtx, "/reserve"),
+			"SELECT 1",
+			"SELECT 1 /*route='%2Freserve',service='app3'," + traceparent + "*/",
+		},
+		{"before the semicolon", &tracer{sqlComment: true, service: "app3"}, context.Background(), "SELECT 1;\n", "SELECT 1 /*service='app3'*/;\n"},
+		{"escaped values", &tracer{sqlComment: true, service: "app 3's"}, context.Background(), "SELECT 1", "SELECT 1 /*service='app%203%27s'*/"},
+		{"block comment kept", &tracer{sqlComment: true, service: "app3"}, spanCtx, "SELECT /* hint */ 1", "SELECT /* hint */ 1"},
+		{"line comment kept", &tracer{sqlComment: true, service: "app3"}, spanCtx, "SELECT 1 -- hint", "SELECT 1 -- hint"},
+	} {
+		if got := tc.t.comment(tc.ctx, tc.query); got != tc.want {
+			t.Errorf("%s: comment(%q) = %q, want %q", tc.name, tc.query, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package otelsql
+
+import (
+	"context"
+	"database/sql"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// RecordStats exports db.Stats() through meter on every collection. attrs
+// should identify the pool, e.g. attribute.String("pool.name", "library").
+func RecordStats(db *sql.DB, meter metric.Meter, attrs ...attribute.KeyValue) error {
+	open, err := meter.Int64ObservableGauge(
+		"db.client.connections.open",
+		metric.WithDescription("Established connections, both in use and idle"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	usage, err := meter.Int64ObservableGauge(
+		"db.client.connections.usage",
+		metric.WithDescription("Connections by state, used or idle"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	max, err := meter.Int64ObservableGauge(
+		"db.client.connections.max",
+		metric.WithDescription("Maximum number of open connections allowed, 0 is unlimited"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	waitCount, err := meter.Int64ObservableCounter(
+		"db.client.connections.wait_count",
+		metric.WithDescription("Total number of connections waited for"),
+		metric.WithUnit("{wait}"),
+	)
+	if err != nil {
+		return err
+	}
+	waitDuration, err := meter.Float64ObservableCounter(
+		"db.client.connections.wait_duration",
+		metric.WithDescription("Total time blocked waiting for a new connection"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return err
+	}
+	closed, err := meter.Int64ObservableCounter(
+		"db.client.connections.closed",
+		metric.WithDescription("Total number of connections closed by the pool, by reason"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+
+	with := func(extra ...attribute.KeyValue) metric.ObserveOption {
+		return metric.WithAttributes(append(append([]attribute.KeyValue{}, attrs...), extra...)...)
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		s := db.Stats()
+		o.ObserveInt64(open, int64(s.OpenConnections), with())
+		o.ObserveInt64(usage, int64(s.InUse), with(attribute.String("state", "used")))
+		o.ObserveInt64(usage, int64(s.Idle), with(attribute.String("state", "idle")))
+		o.ObserveInt64(max, int64(s.MaxOpenConnections), with())
+		o.ObserveInt64(waitCount, s.WaitCount, with())
+		o.ObserveFloat64(waitDuration, s.WaitDuration.Seconds(), with())
+		o.ObserveInt64(closed, s.MaxIdleClosed, with(attribute.String("reason", "max_idle")))
+		o.ObserveInt64(closed, s.MaxIdleTimeClosed, with(attribute.String("reason", "max_idle_time")))
+		o.ObserveInt64(closed, s.MaxLifetimeClosed, with(attribute.String("reason", "max_lifetime")))
+		return nil
+	}, open, usage, max, waitCount, waitDuration, closed)
+	return err
+}
@@ -0,0 +1,295 @@
+// Package outbox implements the transactional outbox pattern: events are
+// written in the same transaction as the change they describe, together with
+// the trace context of the producing span, and a Relay publishes them to a
+// Sink afterwards.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const RESERVATION_CREATED = "reservation.created"
+
+var PROPAGATOR = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+type Event struct {
+	ID          int64             `json:"id"`
+	Type        string            `json:"type"`
+	AggregateID int64             `json:"aggregate_id"`
+	Payload     json.RawMessage   `json:"payload"`
+	Headers     map[string]string `json:"headers"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Attempts    int               `json:"attempts"`
+}
+
+// Write builds an event for payload and hands it to store under a PRODUCER
+// span, recording the trace context of that span in the event headers so the
+// relay can link its consumer span to it. store typically inserts the event in
+// the transaction of the change it describes.
+func Write(ctx context.Context, eventType string, aggregateID int64, payload any, store func(ctx context.Context, e Event) error) error {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer("opentelemetry.io/sdk")
+	ctx, span := tracer.Start(ctx,
+		fmt.Sprintf("%s send", eventType),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("outbox"),
+			semconv.MessagingDestinationKey.String(eventType),
+			attribute.Int64("outbox.aggregate_id", aggregateID),
+		),
+	)
+	defer span.End()
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	headers := propagation.MapCarrier{}
+	PROPAGATOR.Inject(ctx, headers)
+	err = store(ctx, Event{
+		Type:        eventType,
+		AggregateID: aggregateID,
+		Payload:     raw,
+		Headers:     headers,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// ProducerContext returns the span context recorded in the event headers.
+func (e Event) ProducerContext() trace.SpanContext {
+	ctx := PROPAGATOR.Extract(context.Background(), propagation.MapCarrier(e.Headers))
+	return trace.SpanContextFromContext(ctx)
+}
+
+// Insert writes e in tx.
+func Insert(ctx context.Context, tx *sql.Tx, e Event) error {
+	headers, err := json.Marshal(e.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO outbox (event_type, aggregate_id, payload, headers) VALUES ($1, $2, $3, $4)",
+		e.Type, e.AggregateID, []byte(e.Payload), headers,
+	)
+	return err
+}
+
+// MAX_ATTEMPTS is how many times an event is published before it is given
+// up on. Failed attempts are retried after Backoff.
+var (
+	MAX_ATTEMPTS      = 10
+	RETRY_BACKOFF     = time.Second
+	MAX_RETRY_BACKOFF = 5 * time.Minute
+	// CLAIM_TIMEOUT is how long an event handed to a relay is hidden from the
+	// other relays. A relay dying while publishing it delays it that long.
+	CLAIM_TIMEOUT = time.Minute
+)
+
+// Backoff returns how long to wait before publishing an event again after
+// its attempts-th failed attempt: RETRY_BACKOFF doubled for every previous
+// failure, up to MAX_RETRY_BACKOFF.
+func Backoff(attempts int) time.Duration {
+	d := RETRY_BACKOFF
+	for i := 1; i < attempts && d < MAX_RETRY_BACKOFF; i++ {
+		d *= 2
+	}
+	return min(d, MAX_RETRY_BACKOFF)
+}
+
+// Store hands pending events to the relay.
+type Store interface {
+	// Process calls fn for up to limit pending events, oldest first. Events
+	// fn succeeds for are marked sent, the others have their attempt count
+	// and last error updated and are retried after Backoff, or given up on
+	// after MAX_ATTEMPTS attempts. It returns how many were sent.
+	Process(ctx context.Context, limit int, fn func(ctx context.Context, e Event) error) (int, error)
+}
+
+// PostgresStore reads the outbox table. Pending rows are claimed with SKIP
+// LOCKED in a statement of their own, so several relays can run side by side
+// and no transaction stays open while the sink is called.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) Process(ctx context.Context, limit int, fn func(ctx context.Context, e Event) error) (int, error) {
+	events, err := s.claim(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	// Once published, the outcome must be recorded even if ctx is done, or
+	// the event would be published again after CLAIM_TIMEOUT.
+	storeCtx := context.WithoutCancel(ctx)
+	sent := 0
+	for _, e := range events {
+		if err := fn(ctx, e); err != nil {
+			_, err = s.DB.ExecContext(storeCtx, `
+				UPDATE outbox SET attempts = attempts + 1, last_error = $2,
+					next_attempt_at = now() + $3::float8 * interval '1 second',
+					failed_at = CASE WHEN $4::boolean THEN now() END
+				WHERE id = $1`,
+				e.ID, err.Error(), Backoff(e.Attempts+1).Seconds(), e.Attempts+1 >= MAX_ATTEMPTS)
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+		_, err = s.DB.ExecContext(storeCtx,
+			"UPDATE outbox SET sent_at = now(), attempts = attempts + 1, last_error = NULL WHERE id = $1", e.ID)
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// claim returns up to limit events due for publishing, hiding them from the
+// other relays for CLAIM_TIMEOUT.
+func (s *PostgresStore) claim(ctx context.Context, limit int) ([]Event, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		UPDATE outbox SET next_attempt_at = now() + $2::float8 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= now()
+			ORDER BY id LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, event_type, aggregate_id, payload, headers, created_at, attempts`,
+		limit, CLAIM_TIMEOUT.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		e := Event{}
+		var payload, headers []byte
+		if err := rows.Scan(&e.ID, &e.Type, &e.AggregateID, &payload, &headers, &e.CreatedAt, &e.Attempts); err != nil {
+			return nil, err
+		}
+		e.Payload = payload
+		if err := json.Unmarshal(headers, &e.Headers); err != nil {
+			return nil, fmt.Errorf("outbox event %d has invalid headers: %w", e.ID, err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the subquery.
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// MemoryStore is an in-process outbox used by the in-memory repository.
+type MemoryStore struct {
+	mu      sync.Mutex
+	pending []Event
+	failed  []Event
+	nextID  int64
+	// claimed holds the ids of the events being delivered, which other
+	// Process calls skip like the Postgres store skips claimed rows.
+	claimed map[int64]bool
+	// retryAt holds when the events that failed are due again.
+	retryAt map[int64]time.Time
+	now     func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{claimed: map[int64]bool{}, retryAt: map[int64]time.Time{}, now: time.Now}
+}
+
+// Add appends e to the outbox.
+func (m *MemoryStore) Add(ctx context.Context, e Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	e.ID = m.nextID
+	m.pending = append(m.pending, e)
+	return nil
+}
+
+// Failed returns the events given up on after MAX_ATTEMPTS attempts.
+func (m *MemoryStore) Failed() []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Event{}, m.failed...)
+}
+
+// Process delivers the batch without holding the lock, so a slow sink does
+// not block the reservations adding events meanwhile.
+func (m *MemoryStore) Process(ctx context.Context, limit int, fn func(ctx context.Context, e Event) error) (int, error) {
+	m.mu.Lock()
+	now := m.now()
+	batch := []Event{}
+	for _, e := range m.pending {
+		if len(batch) >= limit {
+			break
+		}
+		if m.claimed[e.ID] || now.Before(m.retryAt[e.ID]) {
+			continue
+		}
+		m.claimed[e.ID] = true
+		batch = append(batch, e)
+	}
+	m.mu.Unlock()
+
+	// delivered maps the id of every event of the batch to whether fn
+	// succeeded for it.
+	delivered := map[int64]bool{}
+	for _, e := range batch {
+		delivered[e.ID] = fn(ctx, e) == nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now = m.now()
+	sent := 0
+	kept := m.pending[:0]
+	for _, e := range m.pending {
+		ok, inBatch := delivered[e.ID]
+		if !inBatch {
+			kept = append(kept, e)
+			continue
+		}
+		delete(m.claimed, e.ID)
+		delete(m.retryAt, e.ID)
+		e.Attempts++
+		switch {
+		case ok:
+			sent++
+		case e.Attempts >= MAX_ATTEMPTS:
+			m.failed = append(m.failed, e)
+		default:
+			m.retryAt[e.ID] = now.Add(Backoff(e.Attempts))
+			kept = append(kept, e)
+		}
+	}
+	m.pending = kept
+	return sent, nil
+}
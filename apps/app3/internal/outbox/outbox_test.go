@@ -0,0 +1,211 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/baggage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestWrite(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "POST /reservations")
+	member, _ := baggage.NewMemberRaw("enduser.id", "user-1")
+	b, _ := baggage.New(member)
+	ctx = baggage.ContextWithBaggage(ctx, b)
+
+	var written Event
+	err := Write(ctx, RESERVATION_CREATED, 7, map[string]int{"book_id": 1}, func(ctx context.Context, e Event) error {
+		written = e
+		return nil
+	})
+	parent.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if written.Type != RESERVATION_CREATED || written.AggregateID != 7 || string(written.Payload) != `{"book_id":1}` {
+		t.Errorf("expected the reservation event, got %+v", written)
+	}
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "reservation.created send" || spans[0].SpanKind() != trace.SpanKindProducer {
+		t.Fatalf("expected a PRODUCER span, got %v", spans)
+	}
+	producer := written.ProducerContext()
+	if producer.SpanID() != spans[0].SpanContext().SpanID() || producer.TraceID() != parent.SpanContext().TraceID() {
+		t.Errorf("expected the headers to carry the PRODUCER span, got %v", written.Headers)
+	}
+	if written.Headers["baggage"] != "enduser.id=user-1" {
+		t.Errorf("expected the baggage in the headers, got %v", written.Headers)
+	}
+
+	// A failing store fails the span and the write.
+	failed := errors.New("insert failed")
+	err = Write(context.Background(), RESERVATION_CREATED, 7, nil, func(context.Context, Event) error { return failed })
+	if !errors.Is(err, failed) {
+		t.Errorf("expected the store error, got %v", err)
+	}
+	if err := Write(context.Background(), RESERVATION_CREATED, 7, func() {}, nil); err == nil {
+		t.Error("expected a payload that is not JSON to fail")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{9, 256 * time.Second},
+		{10, MAX_RETRY_BACKOFF},
+		{1000, MAX_RETRY_BACKOFF},
+	} {
+		if got := Backoff(tc.attempts); got != tc.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+// add writes n events to store.
+func add(t *testing.T, store *MemoryStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := store.Add(context.Background(), Event{Type: RESERVATION_CREATED, Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryStoreProcess(t *testing.T) {
+	store := NewMemoryStore()
+	add(t, store, 5)
+
+	ids := []int64{}
+	sent, err := store.Process(context.Background(), 3, func(ctx context.Context, e Event) error {
+		ids = append(ids, e.ID)
+		if e.ID == 2 {
+			return errors.New("sink down")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || len(ids) != 3 || ids[0] != 1 || ids[2] != 3 {
+		t.Errorf("expected events 1 to 3 processed and 2 sent, got %v and %d sent", ids, sent)
+	}
+
+	// Event 2 waits for its backoff, 4 and 5 are next.
+	ids = ids[:0]
+	sent, _ = store.Process(context.Background(), 10, func(ctx context.Context, e Event) error {
+		ids = append(ids, e.ID)
+		return nil
+	})
+	if sent != 2 || len(ids) != 2 || ids[0] != 4 {
+		t.Errorf("expected events 4 and 5 sent, got %v", ids)
+	}
+}
+
+func TestMemoryStoreRetry(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	add(t, store, 1)
+
+	attempts := []int{}
+	fail := func(ctx context.Context, e Event) error {
+		attempts = append(attempts, e.Attempts)
+		return errors.New("sink down")
+	}
+	for i := 1; i <= MAX_ATTEMPTS; i++ {
+		store.Process(context.Background(), 10, fail)
+		if i == MAX_ATTEMPTS {
+			break
+		}
+		// Not due again before its backoff.
+		now = now.Add(Backoff(i) - time.Millisecond)
+		store.Process(context.Background(), 10, fail)
+		if len(attempts) != i {
+			t.Fatalf("expected the event to wait %s after attempt %d", Backoff(i), i)
+		}
+		now = now.Add(time.Millisecond)
+	}
+	for i, n := range attempts {
+		if n != i {
+			t.Errorf("expected attempt %d to see %d previous attempts, got %d", i+1, i, n)
+		}
+	}
+
+	// Given up on after MAX_ATTEMPTS.
+	now = now.Add(MAX_RETRY_BACKOFF)
+	store.Process(context.Background(), 10, fail)
+	if len(attempts) != MAX_ATTEMPTS {
+		t.Errorf("expected %d attempts, got %d", MAX_ATTEMPTS, len(attempts))
+	}
+	failed := store.Failed()
+	if len(failed) != 1 || failed[0].Attempts != MAX_ATTEMPTS {
+		t.Errorf("expected the event to be given up on, got %+v", failed)
+	}
+}
+
+func TestMemoryStoreConcurrentProcess(t *testing.T) {
+	store := NewMemoryStore()
+	add(t, store, 2)
+
+	// The sink blocks while holding the first batch. Events can still be
+	// added, and a concurrent Process skips the claimed events.
+	started, unblock := make(chan struct{}), make(chan struct{})
+	done := make(chan int)
+	go func() {
+		sent, _ := store.Process(context.Background(), 10, func(ctx context.Context, e Event) error {
+			if e.ID == 1 {
+				close(started)
+				<-unblock
+			}
+			return nil
+		})
+		done <- sent
+	}()
+	<-started
+
+	added := make(chan struct{})
+	go func() {
+		add(t, store, 1)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("expected Add not to wait for the sink")
+	}
+
+	mu := sync.Mutex{}
+	ids := []int64{}
+	sent, _ := store.Process(context.Background(), 10, func(ctx context.Context, e Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, e.ID)
+		return nil
+	})
+	if sent != 1 || len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("expected only the new event 3 to be processed, got %v", ids)
+	}
+
+	close(unblock)
+	if sent := <-done; sent != 2 {
+		t.Errorf("expected the first batch to send 2 events, got %d", sent)
+	}
+	if sent, _ := store.Process(context.Background(), 10, func(context.Context, Event) error { return nil }); sent != 0 {
+		t.Errorf("expected nothing left to send, got %d", sent)
+	}
+}
@@ -0,0 +1,209 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	myotel "app3/internal/otel"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var SINKS = []string{"log", "webhook", "memory"}
+
+// Sink is where the relay publishes events.
+type Sink interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// LogSink writes every event to the logger.
+type LogSink struct {
+	Logger *slog.Logger
+}
+
+func (s LogSink) Publish(ctx context.Context, e Event) error {
+	span := trace.SpanFromContext(ctx)
+	s.Logger.Info(
+		fmt.Sprintf("Published %s event %d: %s", e.Type, e.ID, e.Payload),
+		slog.String("TraceId", span.SpanContext().TraceID().String()),
+		slog.String("SpanId", span.SpanContext().SpanID().String()),
+	)
+	return nil
+}
+
+// WebhookSink POSTs every event as JSON to URL. The consumer span is passed on
+// in the trace headers, any non 2xx answer is an error and the event is retried.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s WebhookSink) Publish(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	span := trace.SpanFromContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", e.Type)
+	req.Header.Set("X-Event-Id", strconv.FormatInt(e.ID, 10))
+	req.Header.Set(myotel.OTEL_TRACE_HEADER, span.SpanContext().TraceID().String())
+	req.Header.Set(myotel.OTEL_SPAN_HEADER, span.SpanContext().SpanID().String())
+	PROPAGATOR.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// MemorySink keeps the published events, for tests and local runs.
+type MemorySink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *MemorySink) Publish(ctx context.Context, e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+// Events returns the events published so far.
+func (s *MemorySink) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event{}, s.events...)
+}
+
+// Relay polls a Store and publishes the pending events to a Sink. Each event
+// is published under a CONSUMER span of its own, linked to the span that
+// produced it.
+type Relay struct {
+	Store     Store
+	Sink      Sink
+	Otc       *myotel.OtelClient
+	Interval  time.Duration
+	BatchSize int
+
+	relayed metric.Int64Counter
+	lag     metric.Float64Histogram
+}
+
+func NewRelay(store Store, sink Sink, otc *myotel.OtelClient, interval time.Duration, batchSize int) (*Relay, error) {
+	meter := otc.Metrics.Meter("asdsda")
+	relayed, err := meter.Int64Counter("outbox.events.relayed.total",
+		metric.WithDescription("Outbox events handed to the sink, by type and outcome"))
+	if err != nil {
+		return nil, err
+	}
+	lag, err := meter.Float64Histogram("outbox.events.lag",
+		metric.WithDescription("Time between an event being written and being published"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	return &Relay{
+		Store:     store,
+		Sink:      sink,
+		Otc:       otc,
+		Interval:  interval,
+		BatchSize: batchSize,
+		relayed:   relayed,
+		lag:       lag,
+	}, nil
+}
+
+// Run relays events every Interval until ctx is done.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := r.RelayOnce(ctx); err != nil {
+			r.Otc.Logger.Error(fmt.Sprintf("Outbox relay failed: %s", err))
+		}
+	}
+}
+
+// RelayOnce publishes one batch of pending events and returns how many were
+// sent.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	return r.Store.Process(ctx, r.BatchSize, r.publish)
+}
+
+func (r *Relay) publish(ctx context.Context, e Event) error {
+	start := time.Now()
+	tracer := r.Otc.Tracer.Tracer("opentelemetry.io/sdk")
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		// A new trace per event: the producing request may be long gone, so it
+		// is linked rather than used as the parent.
+		trace.WithNewRoot(),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("outbox"),
+			semconv.MessagingDestinationKey.String(e.Type),
+			semconv.MessagingOperationProcess,
+			semconv.MessagingMessageIDKey.String(strconv.FormatInt(e.ID, 10)),
+			attribute.Int64("outbox.aggregate_id", e.AggregateID),
+			attribute.Int("outbox.attempt", e.Attempts+1),
+		),
+	}
+	if producer := e.ProducerContext(); producer.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+	// Baggage written by the producer travels with the event.
+	ctx = PROPAGATOR.Extract(ctx, propagation.MapCarrier(e.Headers))
+	ctx, span := tracer.Start(ctx, fmt.Sprintf("%s process", e.Type), opts...)
+	defer span.End()
+
+	err := r.Sink.Publish(ctx, e)
+	elapsed := time.Since(start)
+	outcome := "sent"
+	if err != nil {
+		outcome = "failed"
+		msg := fmt.Sprintf("Publishing %s event %d failed in %d miliseconds with [%s]", e.Type, e.ID, elapsed.Milliseconds(), err)
+		if e.Attempts+1 >= MAX_ATTEMPTS {
+			outcome = "abandoned"
+			msg += fmt.Sprintf(", giving up after %d attempts", e.Attempts+1)
+		}
+		span.SetStatus(codes.Error, err.Error())
+		r.Otc.Logger.Error(msg,
+			slog.String("TraceId", span.SpanContext().TraceID().String()),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		)
+	} else {
+		r.lag.Record(r.Otc.Ctx, time.Since(e.CreatedAt).Seconds(), metric.WithAttributes(attribute.String("type", e.Type)))
+	}
+	r.relayed.Add(r.Otc.Ctx, 1, metric.WithAttributes(
+		attribute.String("type", e.Type),
+		attribute.String("outcome", outcome),
+	))
+	return err
+}
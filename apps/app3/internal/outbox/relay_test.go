@@ -0,0 +1,243 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	myotel "app3/internal/otel"
+
+	"go.opentelemetry.io/otel/codes"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// failingSink fails every publish.
+type failingSink struct{}
+
+func (failingSink) Publish(context.Context, Event) error {
+	return errors.New("sink down")
+}
+
+// newRelay returns a relay publishing store to sink, with its spans, metrics
+// and logs going to the returned recorder, reader and buffer.
+func newRelay(t *testing.T, store Store, sink Sink) (*Relay, *tracetest.SpanRecorder, *metricsdk.ManualReader, *bytes.Buffer) {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	reader := metricsdk.NewManualReader()
+	logs := &bytes.Buffer{}
+	relay, err := NewRelay(store, sink, &myotel.OtelClient{
+		Ctx:     context.Background(),
+		Tracer:  sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+		Metrics: metricsdk.NewMeterProvider(metricsdk.WithReader(reader)),
+		Logger:  slog.New(slog.NewTextHandler(logs, nil)),
+	}, time.Millisecond, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relay, recorder, reader, logs
+}
+
+// written adds an event written under a span of its own to store and
+// returns that span.
+func written(t *testing.T, store *MemoryStore) trace.SpanContext {
+	t.Helper()
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "POST /reservations")
+	defer span.End()
+	if err := Write(ctx, RESERVATION_CREATED, 1, map[string]int{"book_id": 1}, store.Add); err != nil {
+		t.Fatal(err)
+	}
+	return span.SpanContext()
+}
+
+// relayed returns outbox.events.relayed.total by outcome.
+func relayed(t *testing.T, reader *metricsdk.ManualReader) map[string]int64 {
+	t.Helper()
+	rm := metricdata.ResourceMetrics{}
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "outbox.events.relayed.total" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				outcome, _ := dp.Attributes.Value("outcome")
+				counts[outcome.AsString()] += dp.Value
+			}
+		}
+	}
+	return counts
+}
+
+func TestRelay(t *testing.T) {
+	store := NewMemoryStore()
+	producer := written(t, store)
+	sink := &MemorySink{}
+	relay, recorder, reader, _ := newRelay(t, store, sink)
+
+	sent, err := relay.RelayOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || len(sink.Events()) != 1 {
+		t.Fatalf("expected the event published, got %d sent and %v", sent, sink.Events())
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "reservation.created process" || span.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("expected a CONSUMER span, got %s %s", span.Name(), span.SpanKind())
+	}
+	if span.Parent().IsValid() || span.SpanContext().TraceID() == producer.TraceID() {
+		t.Error("expected the CONSUMER span to start a new trace")
+	}
+	if links := span.Links(); len(links) != 1 || links[0].SpanContext.TraceID() != producer.TraceID() {
+		t.Errorf("expected a link to the producing trace, got %v", links)
+	}
+	for _, kv := range span.Attributes() {
+		if kv.Key == "outbox.attempt" && kv.Value.AsInt64() != 1 {
+			t.Errorf("expected the first attempt, got %d", kv.Value.AsInt64())
+		}
+	}
+	if counts := relayed(t, reader); counts["sent"] != 1 {
+		t.Errorf("expected 1 sent event counted, got %v", counts)
+	}
+	if sent, _ := relay.RelayOnce(context.Background()); sent != 0 {
+		t.Errorf("expected the event to be published once, got %d", sent)
+	}
+}
+
+func TestRelayFailure(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	written(t, store)
+	relay, recorder, reader, logs := newRelay(t, store, failingSink{})
+
+	for i := 0; i < MAX_ATTEMPTS; i++ {
+		if sent, _ := relay.RelayOnce(context.Background()); sent != 0 {
+			t.Fatalf("expected nothing sent, got %d", sent)
+		}
+		now = now.Add(MAX_RETRY_BACKOFF)
+	}
+
+	for _, span := range recorder.Ended() {
+		if span.Status().Code != codes.Error || span.Status().Description != "sink down" {
+			t.Errorf("expected the failed publishes to be errors, got %+v", span.Status())
+		}
+	}
+	counts := relayed(t, reader)
+	if counts["failed"] != int64(MAX_ATTEMPTS-1) || counts["abandoned"] != 1 {
+		t.Errorf("expected %d failures then the event abandoned, got %v", MAX_ATTEMPTS-1, counts)
+	}
+	if !strings.Contains(logs.String(), "giving up after 10 attempts") {
+		t.Errorf("expected the abandoned event to be logged, got %s", logs)
+	}
+	if len(store.Failed()) != 1 {
+		t.Errorf("expected the event to be given up on, got %v", store.Failed())
+	}
+}
+
+func TestRelayRun(t *testing.T) {
+	store := NewMemoryStore()
+	sink := &MemorySink{}
+	relay, _, _, _ := newRelay(t, store, sink)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		relay.Run(ctx)
+		close(done)
+	}()
+
+	written(t, store)
+	deadline := time.Now().Add(time.Second)
+	for len(sink.Events()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if len(sink.Events()) != 1 {
+		t.Errorf("expected the running relay to publish the event, got %v", sink.Events())
+	}
+}
+
+func TestLogSink(t *testing.T) {
+	logs := &bytes.Buffer{}
+	sink := LogSink{Logger: slog.New(slog.NewTextHandler(logs, nil))}
+	err := sink.Publish(context.Background(), Event{ID: 3, Type: RESERVATION_CREATED, Payload: json.RawMessage(`{"id":3}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), `Published reservation.created event 3: {\"id\":3}`) {
+		t.Errorf("expected the event to be logged, got %s", logs)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	status := atomic.Int32{}
+	status.Store(http.StatusNoContent)
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+	sink := WebhookSink{URL: server.URL, Client: server.Client()}
+
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "reservation.created process")
+	defer span.End()
+	e := Event{ID: 3, Type: RESERVATION_CREATED, Payload: json.RawMessage(`{"id":3}`)}
+	if err := sink.Publish(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-received
+	if r.Method != http.MethodPost || r.Header.Get("X-Event-Type") != RESERVATION_CREATED || r.Header.Get("X-Event-Id") != "3" {
+		t.Errorf("expected a POST with the event headers, got %s %v", r.Method, r.Header)
+	}
+	if r.Header.Get(myotel.OTEL_TRACE_HEADER) != span.SpanContext().TraceID().String() || !strings.Contains(r.Header.Get("traceparent"), span.SpanContext().SpanID().String()) {
+		t.Errorf("expected the trace headers of the consumer span, got %v", r.Header)
+	}
+	got := Event{}
+	if err := json.Unmarshal(<-bodies, &got); err != nil || got.ID != 3 || string(got.Payload) != `{"id":3}` {
+		t.Errorf("expected the event as JSON, got %+v %v", got, err)
+	}
+
+	status.Store(http.StatusBadGateway)
+	if err := sink.Publish(ctx, e); err == nil || err.Error() != "webhook answered 502" {
+		t.Errorf("expected a non 2xx answer to fail, got %v", err)
+	}
+}
+
+func TestMemorySink(t *testing.T) {
+	sink := &MemorySink{}
+	sink.Publish(context.Background(), Event{ID: 1})
+	events := sink.Events()
+	events[0].ID = 2
+	if sink.Events()[0].ID != 1 {
+		t.Error("expected Events to return a copy")
+	}
+}
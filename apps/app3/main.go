@@ -1,190 +1,256 @@
 package main
 
 import (
+	"app3/internal/chaos"
+	"app3/internal/config"
+	"app3/internal/faults"
+	"app3/internal/health"
+	"app3/internal/idempotency"
+	"app3/internal/library"
+	"app3/internal/messaging"
+	"app3/internal/migrate"
 	myotel "app3/internal/otel"
+	"app3/internal/otelsql"
+	"app3/internal/outbox"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/lib/pq"
-	_ "github.com/lib/pq"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel/metric"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
-	"go.opentelemetry.io/otel/trace"
 )
 
+// RESERVATIONS_TOPIC is where app1 submits asynchronous reservations.
+var RESERVATIONS_TOPIC = "reservations"
+
 type LibraryClient struct {
-	DbClient   *sql.DB
 	OtelClient *myotel.OtelClient
+	Faults     *faults.Registry
 }
 
-var (
-	BROKEN = false
-)
+// toggleFailure keeps the original /toggle endpoint working by flipping the
+// synthetic error mode of the fault registry.
+func (l *LibraryClient) toggleFailure(w http.ResponseWriter, r *http.Request) {
+	enabled, err := l.Faults.Toggle(faults.SyntheticError)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	fmt.Printf("Toggle switched to: [%t]\n", enabled)
+	io.WriteString(w, fmt.Sprintf("%t", enabled))
+}
 
-const (
-	CONN_STRING = "host=postgres port=5432 user=app3 password=S3cret dbname=library sslmode=disable"
-)
+// runMigrate implements `app3 migrate up|down [steps]|status` and returns the
+// process exit code.
+func runMigrate(ctx context.Context, migrator *migrate.Migrator, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: app3 migrate up|down [steps]|status")
+		return 2
+	}
 
-func runRawQuery(db *sql.DB, query string) (*sql.Rows, *pq.Error, error) {
-	rows, err := db.Query(query)
-	if err != nil {
-		var pqErr *pq.Error
-		if errors.As(err, &pqErr) {
-			return nil, pqErr, nil
-		} else {
-			return nil, nil, err
+	var err error
+	switch args[0] {
+	case "up":
+		err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				fmt.Fprintf(os.Stderr, "invalid steps [%s]\n", args[1])
+				return 2
+			}
+		}
+		err = migrator.Down(ctx, steps)
+	case "status":
+		var statuses []migrate.Status
+		statuses, err = migrator.Status(ctx)
+		for _, s := range statuses {
+			fmt.Println(s)
 		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command [%s]\n", args[0])
+		return 2
 	}
-	return rows, nil, nil
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
 }
 
-func queryDB(db *sql.DB, otc *myotel.OtelClient, traceId string, spanId string) (int, error) {
-	QUERY := "SELECT * FROM books"
-	start := time.Now()
+// configHandler serves the effective configuration with secrets redacted.
+func configHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg.Redacted())
+	}
+}
 
-	traceID, _ := trace.TraceIDFromHex(traceId)
-	spanID, _ := trace.SpanIDFromHex(spanId)
-	parentSpanContext := trace.NewSpanContext(trace.SpanContextConfig{
-		TraceID:    traceID,
-		SpanID:     spanID,
-		TraceFlags: trace.FlagsSampled,
-	})
-	ctx := trace.ContextWithSpanContext(context.Background(), parentSpanContext)
+// DB_RETRY is how often app3 tries to reach Postgres until it answers.
+var DB_RETRY = 2 * time.Second
 
-	tracer := otc.Tracer.Tracer("opentelemetry.io/sdk")
-	_, span := tracer.Start(
-		ctx,
-		"POSTGRESQL",
-		trace.WithAttributes(
-			attribute.String("db", "/check-reservation"),
-			attribute.String("query", QUERY),
-		),
-	)
-	defer span.End()
-
-	if BROKEN {
-		errorMsg := fmt.Errorf("too many open connections")
-		span.SetStatus(codes.Error, errorMsg.Error())
-		otc.PostgreSqlQueriesTotal.Add(otc.Ctx, 1, metric.WithAttributes(
-			attribute.String("type", "select"),
-			attribute.String("status", "failed"),
-		))
-		otc.Logger.Error(
-			fmt.Sprintf("Database query [%s] failed in %d miliseconds with [%s]", QUERY, time.Since(start), errorMsg),
-			slog.String("TraceId", traceId),
-			slog.String("SpanId", span.SpanContext().TraceID().String()),
-		)
-		return 0, errorMsg
-	}
-
-	time.Sleep(300 * time.Millisecond)
-
-	rows, pgErr, err := runRawQuery(db, QUERY)
-	if pgErr != nil || err != nil {
-		span.SetStatus(codes.Error, err.Error())
-		otc.PostgreSqlQueriesTotal.Add(otc.Ctx, 1, metric.WithAttributes(
-			attribute.String("type", "select"),
-			attribute.String("status", "failed"),
-		))
-		return -1, err
-	}
-	defer rows.Close()
-
-	// Iterate through results
-	i := 0
-	for rows.Next() {
-		i++
-	}
-
-	elapsed := time.Since(start)
-	if err != nil || BROKEN {
-		otc.Logger.Error(
-			fmt.Sprintf("Database query [%s] failed in %d miliseconds", QUERY, elapsed.Milliseconds()),
-			slog.String("TraceId", traceId),
-			slog.String("SpanId", span.SpanContext().TraceID().String()),
-		)
-	} else {
-		otc.Logger.Info(
-			fmt.Sprintf("Database query [%s] succeded in %d miliseconds", QUERY, elapsed.Milliseconds()),
-			slog.String("TraceId", traceId),
-			slog.String("SpanId", span.SpanContext().TraceID().String()),
-		)
+// openDB connects to Postgres. When args hold a `migrate` subcommand it runs
+// it and exits instead. Otherwise it does not wait for Postgres: pending
+// migrations are applied in the background once it answers, and the returned
+// readiness check fails until then, or with the migration error if they
+// could not be applied.
+func openDB(ctx context.Context, cfg *config.Config, otelClient *myotel.OtelClient, faultRegistry *faults.Registry, args []string) (*sql.DB, health.Check) {
+	otelsql.Register("postgres-otel", &pq.Driver{}, otelsql.Config{
+		TracerProvider:     otelClient.Tracer,
+		System:             semconv.DBSystemPostgreSQL,
+		DBName:             cfg.DB.Name,
+		User:               cfg.DB.User,
+		Host:               cfg.DB.Host,
+		Port:               cfg.DB.Port,
+		MeterProvider:      otelClient.Metrics,
+		Logger:             otelClient.Logger,
+		SlowQueryThreshold: time.Duration(cfg.DB.SlowQueryThreshold),
+		SQLComment:         cfg.DB.SQLComment,
+		Service:            "app3",
+		// The slow query fault delays reads inside their statement span.
+		BeforeStatement: func(ctx context.Context, query string) error {
+			if otelsql.Operation(query) != "SELECT" {
+				return nil
+			}
+			return faultRegistry.Slow(ctx)
+		},
+	})
+	db, err := sql.Open("postgres-otel", cfg.DB.DSN())
+	if err != nil {
+		panic(err)
 	}
 
-	otc.PostgreSqlQueriesTotal.Add(otc.Ctx, 1, metric.WithAttributes(
-		attribute.String("type", "select"),
-		attribute.String("status", "success"),
-	))
-
-	return i, nil
-}
+	cfg.DB.Pool.Apply(db)
+	err = otelsql.RecordStats(db, otelClient.Metrics.Meter("asdsda"), attribute.String("pool.name", cfg.DB.Name))
+	if err != nil {
+		panic(err)
+	}
 
-func setupDB(db *sql.DB) error {
-	// Test connection
-	if err := db.Ping(); err != nil {
-		log.Fatal("Failed to connect to database:", err)
-	}
-	fmt.Println("Connected to the database successfully!")
-
-	// setup database
-	_, qErr, err := runRawQuery(db, `
-	CREATE TABLE books (
-		name VARCHAR(255),
-		author VARCHAR(255),
-		year INT
-		); 
-	`)
+	migrator, err := migrate.New(db, otelClient.Tracer.Tracer("opentelemetry.io/sdk"), otelClient.Logger)
 	if err != nil {
-		return err
+		panic(err)
 	}
-	if qErr != nil && qErr.Code == "42P07" {
-		fmt.Println("DB already setup all good")
+	if len(args) > 0 && args[0] == "migrate" {
+		code := runMigrate(ctx, migrator, args[1:])
+		db.Close()
+		os.Exit(code)
 	}
 
-	// setup database
-	_, qErr, err = runRawQuery(db, `
-		INSERT INTO books (name, author, year)
-		VALUES ('Harry Potter', 'J.K. Rowling', 1997);`)
-	if qErr != nil || err != nil {
-		return err
+	var migrated atomic.Bool
+	var failed atomic.Pointer[error]
+	go func() {
+		for {
+			err := db.PingContext(otelsql.WithoutSpans(ctx))
+			if err == nil {
+				break
+			}
+			otelClient.Logger.Warn(fmt.Sprintf("Database is not reachable, retrying in %s: %s", DB_RETRY, err))
+			time.Sleep(DB_RETRY)
+		}
+		fmt.Println("Connected to the database successfully!")
+		if err := migrator.Up(ctx); err != nil {
+			// app3 keeps serving /readyz and /faults so the failure can be
+			// seen, but never becomes ready on a schema it does not know.
+			otelClient.Logger.Error(fmt.Sprintf("Could not apply the migrations: %s", err))
+			failed.Store(&err)
+			return
+		}
+		migrated.Store(true)
+	}()
+
+	return db, func(ctx context.Context) error {
+		if err := failed.Load(); err != nil {
+			return fmt.Errorf("migrations failed: %w", *err)
+		}
+		if !migrated.Load() {
+			return errors.New("waiting for the database and its migrations")
+		}
+		return db.PingContext(otelsql.WithoutSpans(ctx))
 	}
+}
 
-	return nil
+// newSink returns the outbox sink selected by the configuration.
+func newSink(cfg *config.Config, otelClient *myotel.OtelClient) outbox.Sink {
+	switch cfg.Outbox.Sink {
+	case "webhook":
+		return outbox.WebhookSink{
+			URL:    cfg.Outbox.WebhookURL,
+			Client: &http.Client{Transport: otelClient, Timeout: 5 * time.Second},
+		}
+	case "memory":
+		return &outbox.MemorySink{}
+	}
+	return outbox.LogSink{Logger: otelClient.Logger}
 }
 
-func (l *LibraryClient) GetBook(w http.ResponseWriter, r *http.Request) {
-	count, err := queryDB(l.DbClient, l.OtelClient, r.Header.Get(myotel.OTEL_TRACE_HEADER), r.Header.Get(myotel.OTEL_SPAN_HEADER))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		io.WriteString(w, err.Error())
-		return
-	} else {
-		io.WriteString(w, fmt.Sprintf("{\"books\": %d}", count))
-		return
+// subscribe takes messages from topic in the background, retrying every
+// DB_RETRY until the bus accepts the subscription: the Postgres subscriber
+// blocks until the database answers. The returned readiness check fails until
+// then, with the last error if any.
+func subscribe(ctx context.Context, subscriber messaging.Subscriber, topic string, handler messaging.Handler, otelClient *myotel.OtelClient) health.Check {
+	var subscribed atomic.Bool
+	var failed atomic.Pointer[error]
+	go func() {
+		for {
+			err := subscriber.Subscribe(ctx, topic, handler)
+			if err == nil {
+				break
+			}
+			failed.Store(&err)
+			otelClient.Logger.Warn(fmt.Sprintf("Could not subscribe to [%s], retrying in %s: %s", topic, DB_RETRY, err))
+			time.Sleep(DB_RETRY)
+		}
+		subscribed.Store(true)
+		fmt.Printf("Taking reservations from [%s]\n", topic)
+	}()
+
+	return func(ctx context.Context) error {
+		if subscribed.Load() {
+			return nil
+		}
+		if err := failed.Load(); err != nil {
+			return fmt.Errorf("not subscribed to [%s]: %w", topic, *err)
+		}
+		return fmt.Errorf("waiting for the subscription to [%s]", topic)
 	}
 }
 
-func toggleFailure(w http.ResponseWriter, r *http.Request) {
-	BROKEN = !BROKEN
-	fmt.Println("Toggle switched to: [%s]", BROKEN)
-	io.WriteString(w, fmt.Sprintf("%s", BROKEN))
+// newSubscriber returns the instrumented message bus subscriber selected by
+// the configuration, or nil when asynchronous reservations are disabled.
+func newSubscriber(cfg *config.Config, otelClient *myotel.OtelClient) messaging.Subscriber {
+	switch cfg.Bus {
+	case "memory":
+		return messaging.NewSubscriber(messaging.NewMemoryBus(otelClient.Logger), "memory", otelClient.Tracer)
+	case "postgres":
+		return messaging.NewSubscriber(messaging.NewPostgresSubscriber(cfg.DB.DSN(), otelClient.Logger), "postgresql", otelClient.Tracer)
+	}
+	return nil
 }
 
 func main() {
 	fmt.Println("Starting app")
+	cfg, args, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	ctx := context.TODO()
 	otelClient, err := myotel.NewOtelClient(
 		ctx,
-		"collector:14317",
+		cfg.CollectorURL,
 		semconv.ServiceNameKey.String("app3"),
 		attribute.String("version", "1.0.0"),
 	)
@@ -192,25 +258,88 @@ func main() {
 		panic(err)
 	}
 
-	db, err := sql.Open("postgres", CONN_STRING)
+	faultRegistry, err := faults.NewRegistry(otelClient)
 	if err != nil {
-		log.Fatal(err)
+		panic(err)
+	}
+
+	checker, err := health.NewChecker(otelClient.Metrics.Meter("asdsda"))
+	if err != nil {
+		panic(err)
+	}
+	checker.Add("collector", otelClient.PingExporter)
+	checker.Add("faults", faultRegistry.Ping)
+
+	var books library.BookRepository
+	var reservations library.ReservationRepository
+	var idempotencyStore idempotency.Store
+	var outboxStore outbox.Store
+	if cfg.Repository == "memory" {
+		if len(args) > 0 && args[0] == "migrate" {
+			fmt.Fprintln(os.Stderr, "migrate needs the postgres repository")
+			os.Exit(2)
+		}
+		memoryOutbox := outbox.NewMemoryStore()
+		memory := library.NewMemoryRepository(library.MemoryOptions{
+			Latency: time.Duration(cfg.Memory.Latency),
+			Outbox:  memoryOutbox,
+			// The slow query fault delays reads, as with Postgres.
+			Err: func(ctx context.Context, op string) error {
+				if !library.ReadOperation(op) {
+					return nil
+				}
+				return faultRegistry.Slow(ctx)
+			},
+		})
+		books, reservations = memory, memory
+		idempotencyStore = idempotency.NewMemoryStore()
+		outboxStore = memoryOutbox
+		fmt.Println("Using the in-memory repository")
+	} else {
+		db, ping := openDB(ctx, cfg, otelClient, faultRegistry, args)
+		defer db.Close()
+		checker.Add("postgres", ping)
+		postgres := library.NewPostgresRepository(db, otelClient)
+		books, reservations = postgres, postgres
+		idempotencyStore = idempotency.NewPostgresStore(db)
+		outboxStore = outbox.NewPostgresStore(db)
 	}
-	defer db.Close()
 
-	err = setupDB(db)
+	handlers, err := library.NewHandlers(books, reservations, otelClient, faultRegistry)
 	if err != nil {
 		panic(err)
 	}
+	handlers.Idempotency, err = idempotency.NewMiddleware(idempotencyStore, time.Duration(cfg.IdempotencyTTL), otelClient)
+	if err != nil {
+		panic(err)
+	}
+	// Background pollers would otherwise start a trace per statement.
+	go handlers.Idempotency.PurgeEvery(otelsql.WithoutSpans(ctx), time.Minute)
+
+	relay, err := outbox.NewRelay(outboxStore, newSink(cfg, otelClient), otelClient, time.Duration(cfg.Outbox.Interval), cfg.Outbox.BatchSize)
+	if err != nil {
+		panic(err)
+	}
+	go relay.Run(otelsql.WithoutSpans(ctx))
+
+	if subscriber := newSubscriber(cfg, otelClient); subscriber != nil {
+		checker.Add("bus", subscribe(ctx, subscriber, RESERVATIONS_TOPIC, func(ctx context.Context, topic string, msg messaging.Message) error {
+			_, err := handlers.ReserveMessage(ctx, msg.Body)
+			return err
+		}, otelClient))
+	}
+	handlers.RegisterRoutes(http.DefaultServeMux)
 
 	lib := LibraryClient{
-		DbClient:   db,
 		OtelClient: otelClient,
+		Faults:     faultRegistry,
 	}
-	http.HandleFunc("/reserve", lib.GetBook)
-	http.HandleFunc("/toggle", toggleFailure)
+	http.HandleFunc("/toggle", lib.toggleFailure)
+	faultRegistry.RegisterRoutes(http.DefaultServeMux)
+	http.HandleFunc("GET /config", configHandler(cfg))
+	checker.RegisterRoutes(http.DefaultServeMux)
 
-	err = http.ListenAndServe(":8083", nil)
+	err = http.ListenAndServe(cfg.ListenAddr, chaos.Middleware("app3", otelClient, http.DefaultServeMux))
 	if err != nil {
 		panic(err)
 	}
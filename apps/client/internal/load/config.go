@@ -0,0 +1,327 @@
+// Package load generates HTTP traffic at a controlled rate. Settings come
+// from command line flags, falling back to CLIENT_* environment variables and
+// then to the defaults.
+package load
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EXECUTOR_CLOSED = "closed"
+	EXECUTOR_OPEN   = "open"
+)
+
+var EXECUTORS = []string{EXECUTOR_CLOSED, EXECUTOR_OPEN}
+
+type Config struct {
+	// URL is requested on every iteration when there is no ScenarioFile.
+	URL          string
+	ScenarioFile string
+	CollectorURL string
+	// RPS is the constant request rate, 0 sends as fast as the workers
+	// can. It is ignored when Stages are set.
+	RPS float64
+	// Executor is one of EXECUTORS.
+	Executor string
+	// Workers run the iterations of the closed executor.
+	Workers int
+	// MaxInFlight bounds the iterations of the open executor running at
+	// once, those due beyond it are dropped.
+	MaxInFlight int
+	// Duration stops the run after that long, 0 runs until Requests are
+	// sent, the stages are over or the process is interrupted.
+	Duration time.Duration
+	// Requests stops the run after that many iterations, 0 is unlimited.
+	// RPS, Stages and Requests count iterations, which only send one request
+	// each when the scenario has no journeys.
+	Requests int64
+	Stages   Stages
+	Timeout  time.Duration
+	// Progress is how often a progress line is printed, 0 disables them.
+	Progress time.Duration
+	// SummaryFile receives the JSON summary of the run, "" disables it.
+	SummaryFile string
+	// RecordFile, when set, gets a JSONL record of every request appended.
+	RecordFile string
+	// ReplayFile replaces the scenario with the requests of a RecordFile,
+	// sent at their recorded offsets divided by ReplaySpeed, or as fast as
+	// possible when ReplaySpeed is 0.
+	ReplayFile   string
+	ReplaySpeed  float64
+	ReplayTarget string
+	// Users and Books size the synthetic population iterations run for, 0
+	// users sends requests without an identity. Seed makes the identities
+	// of a run repeatable.
+	Users int
+	Books int
+	Seed  int64
+	// UserDist and BookDist are one of DISTRIBUTIONS, ZipfS is the exponent
+	// of the Zipf ones.
+	UserDist string
+	BookDist string
+	ZipfS    float64
+	// ConnTrace adds DNS, connect, TLS, connection reuse and first byte
+	// events to the request spans.
+	ConnTrace bool
+}
+
+// Stage ramps the request rate linearly from the target of the previous
+// stage, or 0 for the first one, to Target over Duration. A Hold stage keeps
+// the rate at Target for the whole Duration.
+type Stage struct {
+	Duration time.Duration
+	Target   float64
+	Hold     bool
+}
+
+// Stages are written as a comma separated list of duration:target pairs,
+// e.g. "30s:10,2m:10,30s:0" ramps up to 10 rps, holds it and ramps down, or
+// duration=target for steps, e.g. "1m=10,1m=20,1m=40".
+type Stages []Stage
+
+func (s *Stages) String() string {
+	if s == nil {
+		return ""
+	}
+	parts := make([]string, len(*s))
+	for i, stage := range *s {
+		sep := ":"
+		if stage.Hold {
+			sep = "="
+		}
+		parts[i] = fmt.Sprintf("%s%s%s", stage.Duration, sep, strconv.FormatFloat(stage.Target, 'f', -1, 64))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *Stages) Set(v string) error {
+	stages := Stages{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		hold := false
+		d, t, ok := strings.Cut(part, ":")
+		if !ok {
+			d, t, ok = strings.Cut(part, "=")
+			hold = true
+		}
+		if !ok {
+			return fmt.Errorf("stage [%s] is not duration:target or duration=target", part)
+		}
+		duration, err := time.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("stage [%s] needs a positive duration", part)
+		}
+		target, err := strconv.ParseFloat(t, 64)
+		if err != nil || target < 0 || math.IsInf(target, 0) {
+			return fmt.Errorf("stage [%s] needs a target rate >= 0", part)
+		}
+		stages = append(stages, Stage{Duration: duration, Target: target, Hold: hold})
+	}
+	*s = stages
+	return nil
+}
+
+// Total is the time it takes to run every stage.
+func (s Stages) Total() time.Duration {
+	total := time.Duration(0)
+	for _, stage := range s {
+		total += stage.Duration
+	}
+	return total
+}
+
+// Rate returns the request rate elapsed into the run, +Inf when the rate is
+// unlimited. ok is false once the stages are over.
+func (c *Config) Rate(elapsed time.Duration) (rate float64, ok bool) {
+	if len(c.Stages) == 0 {
+		if c.RPS == 0 {
+			return math.Inf(1), true
+		}
+		return c.RPS, true
+	}
+	from := 0.0
+	for _, stage := range c.Stages {
+		if elapsed < stage.Duration && stage.Hold {
+			return stage.Target, true
+		}
+		if elapsed < stage.Duration {
+			progress := float64(elapsed) / float64(stage.Duration)
+			return from + (stage.Target-from)*progress, true
+		}
+		elapsed -= stage.Duration
+		from = stage.Target
+	}
+	return 0, false
+}
+
+func Default() Config {
+	return Config{
+		URL:          "http://app1:8081/reserve",
+		CollectorURL: "collector:14317",
+		Executor:     EXECUTOR_CLOSED,
+		Workers:      1,
+		MaxInFlight:  500,
+		Timeout:      4 * time.Second,
+		Progress:     10 * time.Second,
+		SummaryFile:  "summary.json",
+		ReplaySpeed:  1,
+		Users:        1000,
+		Books:        100,
+		Seed:         1,
+		UserDist:     DISTRIBUTION_UNIFORM,
+		BookDist:     DISTRIBUTION_ZIPF,
+		ZipfS:        1.1,
+		ConnTrace:    true,
+	}
+}
+
+// Load resolves the configuration from args (without the program name) and
+// the environment.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	c := Default()
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.StringVar(&c.URL, "url", c.URL, "URL requested by the workers (env CLIENT_URL)")
+	fs.StringVar(&c.ScenarioFile, "scenario", c.ScenarioFile, "scenario file (.yaml, .yml or .json) run instead of -url (env CLIENT_SCENARIO)")
+	fs.StringVar(&c.CollectorURL, "collector", c.CollectorURL, "OTLP gRPC collector address (env CLIENT_COLLECTOR_URL)")
+	fs.Float64Var(&c.RPS, "rps", c.RPS, "requests per second, 0 is unlimited (env CLIENT_RPS)")
+	fs.StringVar(&c.Executor, "executor", c.Executor, "how iterations are run: "+strings.Join(EXECUTORS, ", ")+" (env CLIENT_EXECUTOR)")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "concurrent workers of the closed executor (env CLIENT_WORKERS)")
+	fs.IntVar(&c.MaxInFlight, "max-in-flight", c.MaxInFlight, "iterations of the open executor running at once (env CLIENT_MAX_IN_FLIGHT)")
+	fs.DurationVar(&c.Duration, "duration", c.Duration, "stop after this long, 0 runs until interrupted (env CLIENT_DURATION)")
+	fs.Int64Var(&c.Requests, "requests", c.Requests, "stop after this many iterations, 0 is unlimited (env CLIENT_REQUESTS)")
+	fs.Var(&c.Stages, "stages", "ramp stages as duration:rps pairs, e.g. 30s:10,1m:10,30s:0 (env CLIENT_STAGES)")
+	fs.DurationVar(&c.Timeout, "timeout", c.Timeout, "timeout of each request (env CLIENT_TIMEOUT)")
+	fs.DurationVar(&c.Progress, "progress", c.Progress, "interval between progress lines, 0 disables them (env CLIENT_PROGRESS)")
+	fs.StringVar(&c.SummaryFile, "summary", c.SummaryFile, "file the JSON run summary is written to, empty disables it (env CLIENT_SUMMARY)")
+	fs.StringVar(&c.RecordFile, "record", c.RecordFile, "JSONL file every request is appended to (env CLIENT_RECORD)")
+	fs.StringVar(&c.ReplayFile, "replay", c.ReplayFile, "JSONL file of recorded requests to replay instead of the scenario (env CLIENT_REPLAY)")
+	fs.Float64Var(&c.ReplaySpeed, "replay-speed", c.ReplaySpeed, "replay speed factor, 2 is twice as fast, 0 is as fast as possible (env CLIENT_REPLAY_SPEED)")
+	fs.StringVar(&c.ReplayTarget, "replay-target", c.ReplayTarget, "scheme and host replacing those of the replayed requests, e.g. http://localhost:8081 (env CLIENT_REPLAY_TARGET)")
+	fs.IntVar(&c.Users, "users", c.Users, "synthetic users, 0 sends requests without an identity (env CLIENT_USERS)")
+	fs.IntVar(&c.Books, "books", c.Books, "synthetic books (env CLIENT_BOOKS)")
+	fs.Int64Var(&c.Seed, "seed", c.Seed, "seed of the synthetic identities (env CLIENT_SEED)")
+	fs.StringVar(&c.UserDist, "user-dist", c.UserDist, "how users are picked: "+strings.Join(DISTRIBUTIONS, ", ")+" (env CLIENT_USER_DIST)")
+	fs.StringVar(&c.BookDist, "book-dist", c.BookDist, "how books are picked: "+strings.Join(DISTRIBUTIONS, ", ")+" (env CLIENT_BOOK_DIST)")
+	fs.Float64Var(&c.ZipfS, "zipf-s", c.ZipfS, "exponent of the zipf distributions, > 1 (env CLIENT_ZIPF_S)")
+	fs.BoolVar(&c.ConnTrace, "conn-trace", c.ConnTrace, "add connection lifecycle events to the request spans (env CLIENT_CONN_TRACE)")
+
+	env := map[string]string{
+		"url":           "CLIENT_URL",
+		"scenario":      "CLIENT_SCENARIO",
+		"collector":     "CLIENT_COLLECTOR_URL",
+		"rps":           "CLIENT_RPS",
+		"executor":      "CLIENT_EXECUTOR",
+		"workers":       "CLIENT_WORKERS",
+		"max-in-flight": "CLIENT_MAX_IN_FLIGHT",
+		"duration":      "CLIENT_DURATION",
+		"requests":      "CLIENT_REQUESTS",
+		"stages":        "CLIENT_STAGES",
+		"timeout":       "CLIENT_TIMEOUT",
+		"progress":      "CLIENT_PROGRESS",
+		"summary":       "CLIENT_SUMMARY",
+		"record":        "CLIENT_RECORD",
+		"replay":        "CLIENT_REPLAY",
+		"replay-speed":  "CLIENT_REPLAY_SPEED",
+		"replay-target": "CLIENT_REPLAY_TARGET",
+		"users":         "CLIENT_USERS",
+		"books":         "CLIENT_BOOKS",
+		"seed":          "CLIENT_SEED",
+		"user-dist":     "CLIENT_USER_DIST",
+		"book-dist":     "CLIENT_BOOK_DIST",
+		"zipf-s":        "CLIENT_ZIPF_S",
+		"conn-trace":    "CLIENT_CONN_TRACE",
+	}
+	// The environment is applied before parsing so flags take precedence.
+	for name, key := range env {
+		if v := getenv(key); v != "" {
+			if err := fs.Set(name, v); err != nil {
+				return nil, fmt.Errorf("invalid %s [%s]: %w", key, v, err)
+			}
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Config) Validate() error {
+	errs := []error{}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		errs = append(errs, fmt.Errorf("url [%s] must be http or https", c.URL))
+	}
+	if c.RPS < 0 || math.IsInf(c.RPS, 0) || math.IsNaN(c.RPS) {
+		errs = append(errs, errors.New("rps must be >= 0"))
+	}
+	if c.RPS > 0 && len(c.Stages) > 0 {
+		errs = append(errs, errors.New("rps and stages are mutually exclusive"))
+	}
+	if c.Duration < 0 {
+		errs = append(errs, errors.New("duration must be >= 0"))
+	}
+	if c.Requests < 0 {
+		errs = append(errs, errors.New("requests must be >= 0"))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, errors.New("timeout must be positive"))
+	}
+	if c.Progress < 0 {
+		errs = append(errs, errors.New("progress must be >= 0"))
+	}
+	if c.Users < 0 || c.Books <= 0 {
+		errs = append(errs, errors.New("users must be >= 0 and books positive"))
+	}
+	for _, dist := range []string{c.UserDist, c.BookDist} {
+		if !slices.Contains(DISTRIBUTIONS, dist) {
+			errs = append(errs, fmt.Errorf("invalid distribution [%s], expected %s", dist, strings.Join(DISTRIBUTIONS, " or ")))
+		}
+	}
+	if c.ZipfS <= 1 || math.IsInf(c.ZipfS, 0) || math.IsNaN(c.ZipfS) {
+		errs = append(errs, errors.New("zipf exponent must be > 1"))
+	}
+	if c.ReplayFile != "" {
+		if c.ScenarioFile != "" {
+			errs = append(errs, errors.New("replay and scenario are mutually exclusive"))
+		}
+		if c.ReplaySpeed < 0 || math.IsInf(c.ReplaySpeed, 0) || math.IsNaN(c.ReplaySpeed) {
+			errs = append(errs, errors.New("replay speed must be >= 0"))
+		}
+		if c.ReplayTarget != "" && !strings.HasPrefix(c.ReplayTarget, "http://") && !strings.HasPrefix(c.ReplayTarget, "https://") {
+			errs = append(errs, fmt.Errorf("replay target [%s] must be http or https", c.ReplayTarget))
+		}
+		if c.MaxInFlight <= 0 {
+			errs = append(errs, errors.New("max in flight must be positive"))
+		}
+	} else {
+		switch c.Executor {
+		case EXECUTOR_CLOSED:
+			if c.Workers <= 0 {
+				errs = append(errs, errors.New("workers must be positive"))
+			}
+		case EXECUTOR_OPEN:
+			if c.MaxInFlight <= 0 {
+				errs = append(errs, errors.New("max in flight must be positive"))
+			}
+			if c.RPS == 0 && len(c.Stages) == 0 {
+				errs = append(errs, errors.New("the open executor needs rps or stages"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("invalid executor [%s], expected %s", c.Executor, strings.Join(EXECUTORS, " or ")))
+		}
+	}
+	return errors.Join(errs...)
+}
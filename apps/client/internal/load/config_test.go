@@ -0,0 +1,63 @@
+package load
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// env returns a getenv looking up vars.
+func env(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load([]string{"-workers", "4"}, env(map[string]string{"CLIENT_WORKERS": "2", "CLIENT_RPS": "50", "CLIENT_STAGES": ""}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags take precedence over the environment.
+	if c.Workers != 4 || c.RPS != 50 || c.Timeout != 4*time.Second {
+		t.Errorf("expected 4 workers at 50 rps, got %+v", c)
+	}
+	if _, err := Load(nil, env(map[string]string{"CLIENT_RPS": "fast"})); err == nil || !strings.Contains(err.Error(), "CLIENT_RPS") {
+		t.Errorf("expected an invalid CLIENT_RPS, got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"default", func(c *Config) {}, ""},
+		{"bad url", func(c *Config) { c.URL = "app1:8081" }, "must be http or https"},
+		{"rps and stages", func(c *Config) { c.RPS = 1; c.Stages.Set("1s:1") }, "mutually exclusive"},
+		{"no workers", func(c *Config) { c.Workers = 0 }, "workers must be positive"},
+		{"open without rate", func(c *Config) { c.Executor = EXECUTOR_OPEN }, "needs rps or stages"},
+		{"unknown executor", func(c *Config) { c.Executor = "ramping" }, "invalid executor [ramping]"},
+		{"no timeout", func(c *Config) { c.Timeout = 0 }, "timeout must be positive"},
+		{"negative requests", func(c *Config) { c.Requests = -1 }, "requests must be >= 0"},
+		{"bad distribution", func(c *Config) { c.BookDist = "normal" }, "invalid distribution [normal]"},
+		{"bad exponent", func(c *Config) { c.ZipfS = 1 }, "zipf exponent must be > 1"},
+		{"replay", func(c *Config) { c.ReplayFile = "requests.jsonl"; c.Workers = 0 }, ""},
+		{"replay with scenario", func(c *Config) { c.ReplayFile = "requests.jsonl"; c.ScenarioFile = "library.yaml" }, "replay and scenario"},
+		{"replay speed", func(c *Config) { c.ReplayFile = "requests.jsonl"; c.ReplaySpeed = -1 }, "replay speed must be >= 0"},
+		{"replay target", func(c *Config) { c.ReplayFile = "requests.jsonl"; c.ReplayTarget = "localhost" }, "replay target [localhost]"},
+		// The shared settings apply to replays too.
+		{"replay timeout", func(c *Config) { c.ReplayFile = "requests.jsonl"; c.Timeout = 0 }, "timeout must be positive"},
+		{"replay duration", func(c *Config) { c.ReplayFile = "requests.jsonl"; c.Duration = -1 }, "duration must be >= 0"},
+		{"replay progress", func(c *Config) { c.ReplayFile = "requests.jsonl"; c.Progress = -1 }, "progress must be >= 0"},
+	} {
+		c := Default()
+		tc.change(&c)
+		err := c.Validate()
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: expected to be valid, got %v", tc.name, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
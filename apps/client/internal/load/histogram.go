@@ -0,0 +1,130 @@
+package load
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// SUB_BUCKET_BITS sets the precision of Histogram: values are grouped by
+// power of two, and each power of two is split in 2^(SUB_BUCKET_BITS-1)
+// linear buckets, so a recorded value is off by less than 1/64.
+const SUB_BUCKET_BITS = 7
+
+const (
+	subBuckets     = 1 << SUB_BUCKET_BITS
+	halfSubBuckets = subBuckets / 2
+)
+
+// Histogram records durations in microseconds with a bounded relative error,
+// in the manner of HdrHistogram. Memory grows with the log of the largest
+// value, not with the number of values. It is not safe for concurrent use.
+type Histogram struct {
+	counts []int64
+	count  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+func bucket(v int64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - SUB_BUCKET_BITS
+	return subBuckets + (shift-1)*halfSubBuckets + int(v>>shift) - halfSubBuckets
+}
+
+// highest returns the largest value recorded in bucket i.
+func highest(i int) int64 {
+	if i < subBuckets {
+		return int64(i)
+	}
+	shift := (i-subBuckets)/halfSubBuckets + 1
+	sub := int64((i-subBuckets)%halfSubBuckets + halfSubBuckets)
+	return (sub+1)<<shift - 1
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	v := d.Microseconds()
+	if v < 0 {
+		v = 0
+	}
+	i := bucket(v)
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i]++
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+}
+
+// Merge adds the values recorded in o to h.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.count == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		counts := make([]int64, len(o.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max) * time.Microsecond
+}
+
+func (h *Histogram) Min() time.Duration {
+	return time.Duration(h.min) * time.Microsecond
+}
+
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.sum/h.count) * time.Microsecond
+}
+
+// Percentile returns the value below which q percent of the recorded values
+// fall.
+func (h *Histogram) Percentile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(q / 100 * float64(h.count)))
+	if target < 1 {
+		target = 1
+	}
+	seen := int64(0)
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			return time.Duration(min(highest(i), h.max)) * time.Microsecond
+		}
+	}
+	return h.Max()
+}
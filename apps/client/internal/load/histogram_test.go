@@ -0,0 +1,120 @@
+package load
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// within reports whether got is off from want by less than the precision of
+// Histogram.
+func within(got time.Duration, want time.Duration) bool {
+	return math.Abs(float64(got-want)) <= float64(want)/64
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := &Histogram{}
+	for v := 1; v <= 10000; v++ {
+		h.Record(time.Duration(v) * time.Microsecond)
+	}
+
+	if h.Count() != 10000 || h.Min() != time.Microsecond || h.Max() != 10*time.Millisecond {
+		t.Errorf("expected 10000 values from 1us to 10ms, got %d from %s to %s", h.Count(), h.Min(), h.Max())
+	}
+	if h.Mean() != 5000*time.Microsecond {
+		t.Errorf("expected a mean of 5ms, got %s", h.Mean())
+	}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Microsecond},
+		{1, 100 * time.Microsecond},
+		{50, 5 * time.Millisecond},
+		{90, 9 * time.Millisecond},
+		{99, 9900 * time.Microsecond},
+		{99.9, 9990 * time.Microsecond},
+		{100, 10 * time.Millisecond},
+	} {
+		if got := h.Percentile(tc.q); !within(got, tc.want) {
+			t.Errorf("p%g: expected about %s, got %s", tc.q, tc.want, got)
+		}
+	}
+}
+
+func TestHistogramExactBelowSubBuckets(t *testing.T) {
+	h := &Histogram{}
+	for _, v := range []int{3, 1, 2, 100} {
+		h.Record(time.Duration(v) * time.Microsecond)
+	}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{25, time.Microsecond},
+		{50, 2 * time.Microsecond},
+		{75, 3 * time.Microsecond},
+		{100, 100 * time.Microsecond},
+	} {
+		if got := h.Percentile(tc.q); got != tc.want {
+			t.Errorf("p%g: expected %s, got %s", tc.q, tc.want, got)
+		}
+	}
+}
+
+func TestHistogramLargeValues(t *testing.T) {
+	h := &Histogram{}
+	for _, d := range []time.Duration{time.Second, time.Minute, time.Hour} {
+		h.Record(d)
+	}
+	// A percentile never exceeds the largest value recorded.
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{33, time.Second},
+		{66, time.Minute},
+		{100, time.Hour},
+	} {
+		if got := h.Percentile(tc.q); !within(got, tc.want) || got > h.Max() {
+			t.Errorf("p%g: expected about %s, got %s", tc.q, tc.want, got)
+		}
+	}
+}
+
+func TestHistogramEmptyAndNegative(t *testing.T) {
+	h := &Histogram{}
+	if h.Percentile(99) != 0 || h.Mean() != 0 || h.Max() != 0 {
+		t.Error("expected an empty histogram to report zeros")
+	}
+	h.Record(-time.Second)
+	if h.Count() != 1 || h.Max() != 0 || h.Percentile(50) != 0 {
+		t.Errorf("expected a negative duration to count as 0, got max %s", h.Max())
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	all, a, b := &Histogram{}, &Histogram{}, &Histogram{}
+	for v := 1; v <= 1000; v++ {
+		d := time.Duration(v*v) * time.Microsecond
+		all.Record(d)
+		if v%2 == 0 {
+			a.Record(d)
+		} else {
+			b.Record(d)
+		}
+	}
+	merged := &Histogram{}
+	merged.Merge(a)
+	merged.Merge(&Histogram{})
+	merged.Merge(b)
+
+	if merged.Count() != all.Count() || merged.Min() != all.Min() || merged.Max() != all.Max() || merged.Mean() != all.Mean() {
+		t.Errorf("expected the merge to match, got %d %s %s", merged.Count(), merged.Min(), merged.Max())
+	}
+	for _, q := range []float64{50, 90, 99} {
+		if merged.Percentile(q) != all.Percentile(q) {
+			t.Errorf("p%g: expected %s, got %s", q, all.Percentile(q), merged.Percentile(q))
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package load
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is one request sent by the client, written as one JSON object per
+// line by a Recorder.
+type Record struct {
+	Step    string            `json:"step"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	// OffsetMs is when the request was sent, from the start of the run.
+	OffsetMs  float64 `json:"offset_ms"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	TraceID   string  `json:"trace_id"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Recorder appends records to a JSONL file. It is safe for concurrent use.
+type Recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *Recorder) Write(rec Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(rec)
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// LoadRecords reads a file written by a Recorder.
+func LoadRecords(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []Record{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), MAX_ASSERTED_BODY)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s has no records", path)
+	}
+	return records, nil
+}
+
+// ReplayScenario turns records into a scenario with one step per record, and
+// returns the offset each step was sent at. target, when set, replaces the
+// scheme and host of every record, e.g. to replay against another build.
+func ReplayScenario(name string, records []Record, target string) (*Scenario, []time.Duration, error) {
+	s := &Scenario{Name: name, Targets: map[string]string{}}
+	offsets := make([]time.Duration, len(records))
+	for i, rec := range records {
+		u, err := url.Parse(rec.URL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		origin := u.Scheme + "://" + u.Host
+		if target != "" {
+			origin = target
+		}
+		s.Targets[origin] = origin
+		s.Steps = append(s.Steps, Step{
+			Name:    rec.Step,
+			Target:  origin,
+			Method:  rec.Method,
+			Path:    u.RequestURI(),
+			Headers: rec.Headers,
+			Body:    rec.Body,
+		})
+		offsets[i] = time.Duration(rec.OffsetMs * float64(time.Millisecond))
+	}
+	return s, offsets, s.Validate()
+}
+
+// Replay sends the steps of Scenario in order, step i at offsets[i] divided
+// by speed from the start of the replay. With speed 0 the steps are sent as
+// fast as Config.MaxInFlight allows. Unlike the open executor, steps are
+// never dropped: they wait for a free slot and are counted as late.
+func (r *Runner) Replay(ctx context.Context, offsets []time.Duration, speed float64) Summary {
+	r.start = time.Now()
+	r.stats = NewStats(r.start)
+	done := make(chan struct{})
+	if r.Config.Progress > 0 {
+		go r.progress(done)
+	}
+
+	wg := sync.WaitGroup{}
+	inFlight := make(chan struct{}, r.Config.MaxInFlight)
+	for i := range r.Scenario.Steps {
+		due := time.Now()
+		if speed > 0 {
+			due = r.start.Add(time.Duration(float64(offsets[i]) / speed))
+			if !sleep(ctx, time.Until(due)) {
+				break
+			}
+		}
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			// Every record is a journey of its own.
+			r.iterate(ctx, &r.Scenario.journeys()[i], nil, due, false)
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	summary := r.stats.Summary(r.Config, r.Scenario)
+	summary.Executor = "replay"
+	summary.URL = ""
+	summary.RPS = 0
+	summary.Stages = ""
+	summary.Workers = 0
+	summary.MaxInFlight = r.Config.MaxInFlight
+	return summary
+}
+
+// sentBody returns the body of req as sent, with the step variables expanded.
+func sentBody(req *http.Request) string {
+	if req.GetBody == nil {
+		return ""
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	raw, _ := io.ReadAll(body)
+	return string(raw)
+}
+
+// record writes the request of step to the recorder, if any.
+func (r *Runner) record(step *Step, req *http.Request, headers http.Header, sent time.Time, status int, latency time.Duration, traceID string, err error) {
+	if r.Recorder == nil {
+		return
+	}
+	rec := Record{
+		Step:      step.Name,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Body:      sentBody(req),
+		OffsetMs:  float64(sent.Sub(r.start).Microseconds()) / 1000,
+		Status:    status,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+		TraceID:   traceID,
+	}
+	if len(headers) > 0 {
+		rec.Headers = make(map[string]string, len(headers))
+		for k := range headers {
+			rec.Headers[k] = headers.Get(k)
+		}
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := r.Recorder.Write(rec); err != nil {
+		r.Logger.Error(fmt.Sprintf("Could not record the request of step [%s]: %s", step.Name, err))
+	}
+}
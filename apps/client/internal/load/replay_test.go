@@ -0,0 +1,159 @@
+package load
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	var mu sync.Mutex
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make([]byte, r.ContentLength)
+		r.Body.Read(body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cfg := Default()
+	cfg.Requests = 2
+	r, _ := newRunner(t, server, cfg, "/books")
+	r.Scenario.Steps[0].Method = "POST"
+	r.Scenario.Steps[0].Body = `{"title": "${iteration_id}"}`
+	r.Scenario.Steps[0].Headers = map[string]string{"x-run": "test"}
+	r.Population, _ = NewPopulation(1, 10, DISTRIBUTION_UNIFORM, 10, DISTRIBUTION_UNIFORM, 1.1)
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Recorder = recorder
+	r.Run(context.Background())
+	recorder.Close()
+
+	records, err := LoadRecords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	for _, rec := range records {
+		if rec.Step != "GET /books" || rec.Method != "POST" || rec.URL != server.URL+"/books" || rec.Status != 201 {
+			t.Errorf("expected the request and its status recorded, got %+v", rec)
+		}
+		if rec.Headers["X-Run"] != "test" || len(rec.TraceID) != 32 || rec.OffsetMs < 0 || rec.LatencyMs <= 0 {
+			t.Errorf("expected the headers, trace and timings recorded, got %+v", rec)
+		}
+	}
+	// The body is recorded as it was sent, with the variables expanded.
+	for _, rec := range records {
+		if strings.Contains(rec.Body, "${") || (rec.Body != bodies[0] && rec.Body != bodies[1]) {
+			t.Errorf("expected the body sent, got %q and %v", rec.Body, bodies)
+		}
+	}
+}
+
+func TestLoadRecords(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		content string
+		want    string
+	}{
+		{"{\"step\": \"a\"}\n\n{\"step\": \"b\"}\n", ""},
+		{"", "has no records"},
+		{"{\"step\": \"a\"}\nnot json\n", "requests.jsonl:2"},
+	} {
+		path := filepath.Join(dir, "requests.jsonl")
+		os.WriteFile(path, []byte(tc.content), 0o644)
+		records, err := LoadRecords(path)
+		switch {
+		case tc.want == "" && (err != nil || len(records) != 2):
+			t.Errorf("%q: expected 2 records, got %v %v", tc.content, records, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%q: expected an error containing %q, got %v", tc.content, tc.want, err)
+		}
+	}
+	if _, err := LoadRecords(filepath.Join(dir, "missing.jsonl")); err == nil {
+		t.Error("expected a missing file to fail")
+	}
+}
+
+func TestReplayScenario(t *testing.T) {
+	records := []Record{
+		{Step: "list", Method: "GET", URL: "http://app1:8081/books?limit=5", OffsetMs: 0},
+		{Step: "reserve", Method: "POST", URL: "http://app2:8082/reserve", Body: `{"book_id": 1}`, Headers: map[string]string{"X-Enduser-Id": "user-1"}, OffsetMs: 1500.5},
+	}
+	s, offsets, err := ReplayScenario("replay", records, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Targets) != 2 || s.Steps[0].Target != "http://app1:8081" || s.Steps[0].Path != "/books?limit=5" {
+		t.Errorf("expected a target per origin, got %+v", s)
+	}
+	if s.Steps[1].Body != `{"book_id": 1}` || s.Steps[1].Headers["X-Enduser-Id"] != "user-1" {
+		t.Errorf("expected the body and headers replayed, got %+v", s.Steps[1])
+	}
+	if offsets[0] != 0 || offsets[1] != 1500500*time.Microsecond {
+		t.Errorf("expected the recorded offsets, got %v", offsets)
+	}
+
+	// A target replaces the origin of every record.
+	s, _, err = ReplayScenario("replay", records, "http://localhost:9000")
+	if err != nil || len(s.Targets) != 1 || s.Steps[1].Target != "http://localhost:9000" {
+		t.Errorf("expected every step sent to the target, got %+v %v", s, err)
+	}
+
+	if _, _, err := ReplayScenario("replay", []Record{{URL: "http://app1/\x7f"}}, ""); err == nil || !strings.Contains(err.Error(), "record 1") {
+		t.Errorf("expected an invalid URL to fail, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string]time.Time{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent[r.URL.Path] = time.Now()
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	records := []Record{
+		{Step: "first", Method: "GET", URL: server.URL + "/first", OffsetMs: 0},
+		{Step: "second", Method: "GET", URL: server.URL + "/second", OffsetMs: 200},
+	}
+	s, offsets, err := ReplayScenario("replay", records, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Default()
+	r, _ := newRunner(t, server, cfg, "/")
+	r.Scenario = s
+
+	// Twice as fast, the second request is sent 100ms after the first.
+	summary := r.Replay(context.Background(), offsets, 2)
+	if summary.Executor != "replay" || summary.Requests != 2 || summary.Failures != 0 {
+		t.Errorf("expected 2 replayed requests, got %+v", summary)
+	}
+	if gap := sent["/second"].Sub(sent["/first"]); gap < 90*time.Millisecond || gap > 180*time.Millisecond {
+		t.Errorf("expected the requests 100ms apart, got %s", gap)
+	}
+
+	// As fast as possible, the offsets are ignored.
+	start := time.Now()
+	r.Replay(context.Background(), offsets, 0)
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("expected the replay not to wait, took %s", elapsed)
+	}
+}
@@ -0,0 +1,355 @@
+package load
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MAX_ASSERTED_BODY is how much of a response body JSON assertions look at.
+const MAX_ASSERTED_BODY = 1 << 20
+
+// LATE_THRESHOLD is how far behind schedule an iteration of the open executor
+// can start before it is counted as late.
+var LATE_THRESHOLD = 10 * time.Millisecond
+
+// Runner runs iterations, each one a step of Scenario, with the executor
+// selected by Config.Executor.
+//
+// In both, a single pacer hands out one token per iteration at the configured
+// rate. The closed executor runs them from Config.Workers workers: a worker
+// only sends when it holds a token, so the offered load drops when the
+// workers are all busy. The open executor starts every iteration on time, up
+// to Config.MaxInFlight at once, and measures latency from the time it was
+// due, so slow responses do not hide the queueing they cause.
+type Runner struct {
+	Client   *http.Client
+	Config   *Config
+	Scenario *Scenario
+	Tracer   trace.Tracer
+	Logger   *slog.Logger
+	// Out receives a progress line every Config.Progress.
+	Out io.Writer
+	// Recorder, when set, gets a record of every request.
+	Recorder *Recorder
+	// Population, when set, gives every iteration a synthetic identity.
+	Population *Population
+
+	start time.Time
+	stats *Stats
+}
+
+// Run runs iterations until the run is over or ctx is done. Requests already
+// sent when ctx is done are allowed to complete.
+func (r *Runner) Run(ctx context.Context) Summary {
+	r.start = time.Now()
+	r.stats = NewStats(r.start)
+	open := r.Config.Executor == EXECUTOR_OPEN
+	tokens := make(chan time.Time)
+	go r.pace(ctx, r.start, tokens, open)
+
+	done := make(chan struct{})
+	if r.Config.Progress > 0 {
+		go r.progress(done)
+	}
+
+	wg := sync.WaitGroup{}
+	if open {
+		inFlight := make(chan struct{}, r.Config.MaxInFlight)
+		for due := range tokens {
+			select {
+			case inFlight <- struct{}{}:
+			default:
+				r.stats.Drop()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				r.iterate(ctx, r.Scenario.Pick(), r.identity(), due, false)
+			}()
+		}
+	} else {
+		for range r.Config.Workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range tokens {
+					r.iterate(ctx, r.Scenario.Pick(), r.identity(), time.Time{}, true)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(done)
+
+	return r.stats.Summary(r.Config, r.Scenario)
+}
+
+func (r *Runner) progress(done <-chan struct{}) {
+	ticker := time.NewTicker(r.Config.Progress)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.stats.Progress(r.Out)
+		}
+	}
+}
+
+// pace sends on tokens the time every iteration is due and closes it when the
+// run is over. With catchUp, iterations that could not be handed out on time
+// are all sent as soon as possible, otherwise the schedule restarts from now.
+func (r *Runner) pace(ctx context.Context, start time.Time, tokens chan<- time.Time, catchUp bool) {
+	defer close(tokens)
+	last := start
+	sent := int64(0)
+	for r.Config.Requests == 0 || sent < r.Config.Requests {
+		elapsed := time.Since(start)
+		if r.Config.Duration > 0 && elapsed >= r.Config.Duration {
+			return
+		}
+		rate, ok := r.Config.Rate(elapsed)
+		if !ok {
+			return
+		}
+		if rate <= 0 {
+			// Ramping from or to 0, check again shortly.
+			if !sleep(ctx, 100*time.Millisecond) {
+				return
+			}
+			last = time.Now()
+			continue
+		}
+		due := time.Now()
+		if !math.IsInf(rate, 1) {
+			next := last.Add(time.Duration(float64(time.Second) / rate))
+			if wait := time.Until(next); wait > 0 {
+				// The rate changes during a ramp, so it is read again at
+				// least every 100ms.
+				if !sleep(ctx, min(wait, 100*time.Millisecond)) {
+					return
+				}
+				continue
+			}
+			// Closed workers that fell behind do not catch up with a burst.
+			if !catchUp && time.Since(next) > time.Second {
+				next = time.Now()
+			}
+			last = next
+			due = next
+		}
+		select {
+		case tokens <- due:
+			sent++
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sleep waits for d and reports whether ctx is still alive.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// identity returns the identity of a new iteration, nil without a
+// Population.
+func (r *Runner) identity() *Identity {
+	if r.Population == nil {
+		return nil
+	}
+	return r.Population.Next()
+}
+
+// Outcomes of an iteration, recorded as the journey.outcome attribute of its
+// span and counted in the summary.
+const (
+	OUTCOME_SUCCESS = "success"
+	// OUTCOME_FAILED is a response failing its assertions.
+	OUTCOME_FAILED = "failed"
+	// OUTCOME_ERROR is a request that could not be built or got no response.
+	OUTCOME_ERROR       = "error"
+	OUTCOME_INTERRUPTED = "interrupted"
+)
+
+// iterate runs the steps of journey for id, when set, under the root span of
+// the iteration, parent of the step and think time spans. The latency of the
+// first step of an iteration of the open executor is measured from due, the
+// time it was scheduled at, rather than from when it started. With thinkLast
+// the think time of the last step is waited for too, to space the iterations
+// of a closed worker.
+func (r *Runner) iterate(ctx context.Context, journey *Journey, id *Identity, due time.Time, thinkLast bool) {
+	start := time.Now()
+	delay := time.Duration(0)
+	if !due.IsZero() {
+		delay = start.Sub(due)
+		if delay > LATE_THRESHOLD {
+			r.stats.Late()
+		}
+		start = due
+	}
+
+	// In flight requests outlive ctx, they are bounded by the client timeout.
+	spanCtx, span := r.Tracer.Start(context.WithoutCancel(ctx),
+		journey.Name,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("scenario.name", r.Scenario.Name),
+			attribute.String("journey.name", journey.Name),
+			attribute.Int("journey.steps", len(journey.steps)),
+			attribute.Int64("load.schedule_delay_ms", delay.Milliseconds()),
+		),
+	)
+	if id != nil {
+		span.SetAttributes(id.Attributes()...)
+	}
+
+	outcome := OUTCOME_SUCCESS
+	completed := 0
+	stepStart := start
+	for i, step := range journey.steps {
+		if outcome = r.run(spanCtx, step, id, stepStart); outcome != OUTCOME_SUCCESS {
+			span.SetAttributes(attribute.String("journey.failed_step", step.Name))
+			break
+		}
+		completed++
+		if step.Think > 0 && (thinkLast || i < len(journey.steps)-1) {
+			if !r.think(ctx, spanCtx, step) {
+				outcome = OUTCOME_INTERRUPTED
+				break
+			}
+		}
+		if i < len(journey.steps)-1 && ctx.Err() != nil {
+			outcome = OUTCOME_INTERRUPTED
+			break
+		}
+		stepStart = time.Now()
+	}
+
+	elapsed := time.Since(start)
+	span.SetAttributes(
+		attribute.String("journey.outcome", outcome),
+		attribute.Int("journey.completed_steps", completed),
+	)
+	if outcome == OUTCOME_FAILED || outcome == OUTCOME_ERROR {
+		span.SetStatus(codes.Error, fmt.Sprintf("journey %s", outcome))
+	}
+	span.End()
+	r.stats.Journey(journey.Name, outcome, elapsed)
+}
+
+// think waits for the think time of step under a span of its own, child of
+// the iteration span in parent, and reports whether ctx is still alive.
+func (r *Runner) think(ctx context.Context, parent context.Context, step *Step) bool {
+	_, span := r.Tracer.Start(parent, "think",
+		trace.WithAttributes(
+			attribute.String("scenario.step", step.Name),
+			attribute.Int64("load.think_ms", time.Duration(step.Think).Milliseconds()),
+		),
+	)
+	defer span.End()
+	return sleep(ctx, time.Duration(step.Think))
+}
+
+// run sends the request of step, made for id when set, under a span of its
+// own and records the assertions the response fails as events of that span.
+// Its latency is measured from start.
+func (r *Runner) run(ctx context.Context, step *Step, id *Identity, start time.Time) string {
+	var vars map[string]string
+	if id != nil {
+		vars = id.Vars()
+	}
+	req, err := r.Scenario.Request(step, vars)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("Step [%s] could not build its request: %s", step.Name, err))
+		return OUTCOME_ERROR
+	}
+	if id != nil {
+		id.Apply(req)
+	}
+	key := Key{Step: step.Name, Method: req.Method, Path: req.URL.Path}
+
+	ctx, span := r.Tracer.Start(ctx,
+		step.Name,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("scenario.name", r.Scenario.Name),
+			attribute.String("scenario.step", step.Name),
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.String()),
+		),
+	)
+	defer span.End()
+
+	// The trace headers the transport adds are not recorded.
+	headers := req.Header.Clone()
+	resp, err := r.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		key.Status = "error"
+		r.stats.Record(key, time.Since(start), true)
+		r.record(step, req, headers, start, 0, time.Since(start), span.SpanContext().TraceID().String(), err)
+		span.SetStatus(codes.Error, err.Error())
+		r.Logger.Error(
+			fmt.Sprintf("Step [%s] failed: %s", step.Name, err),
+			slog.String("TraceId", span.SpanContext().TraceID().String()),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		)
+		return OUTCOME_ERROR
+	}
+	// The body is read to the end so the connection goes back to the pool,
+	// and so the latency covers the whole response.
+	var body []byte
+	if len(step.Assert.JSON) > 0 {
+		body, _ = io.ReadAll(io.LimitReader(resp.Body, MAX_ASSERTED_BODY))
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+	key.Status = strconv.Itoa(resp.StatusCode)
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	failures := step.Check(resp.StatusCode, body, elapsed)
+	for _, f := range failures {
+		r.stats.Fail(step.Name, f.Assertion)
+		span.AddEvent("assertion failed", trace.WithAttributes(
+			attribute.String("assertion", f.Assertion),
+			attribute.String("assertion.message", f.Message),
+		))
+		r.Logger.Warn(
+			fmt.Sprintf("Step [%s] assertion %s failed: %s", step.Name, f.Assertion, f.Message),
+			slog.String("TraceId", span.SpanContext().TraceID().String()),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		)
+	}
+	if len(failures) > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d assertions failed", len(failures)))
+	}
+	r.stats.Record(key, elapsed, len(failures) > 0)
+	r.record(step, req, headers, start, resp.StatusCode, elapsed, span.SpanContext().TraceID().String(), nil)
+	if len(failures) > 0 {
+		return OUTCOME_FAILED
+	}
+	return OUTCOME_SUCCESS
+}
@@ -0,0 +1,284 @@
+package load
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newRunner returns a runner sending cfg's iterations of a GET of every path
+// to server, with its spans going to the returned recorder.
+func newRunner(t *testing.T, server *httptest.Server, cfg Config, paths ...string) (*Runner, *tracetest.SpanRecorder) {
+	t.Helper()
+	s := &Scenario{Name: "test", Targets: map[string]string{"app": server.URL}}
+	for _, path := range paths {
+		s.Steps = append(s.Steps, Step{Name: "GET " + path, Target: "app", Path: path})
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Progress = 0
+	recorder := tracetest.NewSpanRecorder()
+	return &Runner{
+		Client:   server.Client(),
+		Config:   &cfg,
+		Scenario: s,
+		Tracer:   sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Out:      io.Discard,
+	}, recorder
+}
+
+// slowServer answers 200 after delay and counts the requests it got.
+func slowServer(t *testing.T, delay time.Duration) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	calls := &atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		time.Sleep(delay)
+	}))
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func TestRate(t *testing.T) {
+	stages := Stages{}
+	if err := stages.Set("10s:10, 10s=20,10s:0"); err != nil {
+		t.Fatal(err)
+	}
+	if stages.String() != "10s:10,10s=20,10s:0" || stages.Total() != 30*time.Second {
+		t.Errorf("expected the stages to round trip, got %s over %s", stages.String(), stages.Total())
+	}
+	cfg := Config{Stages: stages}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    float64
+		ok      bool
+	}{
+		{0, 0, true},
+		{5 * time.Second, 5, true},
+		{10 * time.Second, 20, true},
+		{19 * time.Second, 20, true},
+		{25 * time.Second, 10, true},
+		{30 * time.Second, 0, false},
+	} {
+		if got, ok := cfg.Rate(tc.elapsed); got != tc.want || ok != tc.ok {
+			t.Errorf("Rate(%s) = %g %t, want %g %t", tc.elapsed, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	if rate, _ := (&Config{RPS: 5}).Rate(time.Hour); rate != 5 {
+		t.Errorf("expected a constant rate of 5, got %g", rate)
+	}
+	if rate, _ := (&Config{}).Rate(0); !math.IsInf(rate, 1) {
+		t.Errorf("expected an unlimited rate, got %g", rate)
+	}
+
+	for _, bad := range []string{"10s", "0s:1", "10s:-1", "x:1", "10s=inf"} {
+		if err := (&Stages{}).Set(bad); err == nil {
+			t.Errorf("expected stage %q to be rejected", bad)
+		}
+	}
+}
+
+func TestPace(t *testing.T) {
+	cfg := Default()
+	cfg.RPS = 100
+	cfg.Requests = 5
+	r := &Runner{Config: &cfg}
+
+	start := time.Now()
+	tokens := make(chan time.Time)
+	go r.pace(context.Background(), start, tokens, true)
+	dues := []time.Time{}
+	for due := range tokens {
+		dues = append(dues, due)
+	}
+	if len(dues) != 5 {
+		t.Fatalf("expected 5 iterations, got %d", len(dues))
+	}
+	for i, due := range dues {
+		// Every iteration is due on the schedule, however late it is read.
+		if want := start.Add(time.Duration(i+1) * 10 * time.Millisecond); !due.Equal(want) {
+			t.Errorf("expected iteration %d due at +%s, got +%s", i+1, want.Sub(start), due.Sub(start))
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected 5 iterations at 100 rps to take 50ms, took %s", elapsed)
+	}
+
+	// The pacer stops with its context.
+	cfg.Requests = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	tokens = make(chan time.Time)
+	go r.pace(ctx, time.Now(), tokens, true)
+	<-tokens
+	cancel()
+	for range tokens {
+	}
+}
+
+func TestClosedExecutor(t *testing.T) {
+	server, calls := slowServer(t, 0)
+	cfg := Default()
+	cfg.Workers = 3
+	cfg.Requests = 9
+	r, _ := newRunner(t, server, cfg, "/books")
+
+	summary := r.Run(context.Background())
+	if calls.Load() != 9 || summary.Requests != 9 || summary.Failures != 0 {
+		t.Errorf("expected 9 successful requests, got %d sent and %+v", calls.Load(), summary)
+	}
+	if summary.Executor != EXECUTOR_CLOSED || summary.Workers != 3 || summary.Dropped != 0 {
+		t.Errorf("expected the closed executor summary, got %+v", summary)
+	}
+}
+
+func TestOpenExecutor(t *testing.T) {
+	delay := 100 * time.Millisecond
+	server, calls := slowServer(t, delay)
+	cfg := Default()
+	cfg.Executor = EXECUTOR_OPEN
+	cfg.RPS = 100
+	cfg.Requests = 10
+	cfg.MaxInFlight = 2
+	r, _ := newRunner(t, server, cfg, "/books")
+
+	summary := r.Run(context.Background())
+	// The iterations due while two requests are in flight are dropped
+	// rather than delayed.
+	if summary.Dropped == 0 || calls.Load()+summary.Dropped != 10 {
+		t.Errorf("expected the iterations beyond 2 in flight to be dropped, got %d sent and %d dropped", calls.Load(), summary.Dropped)
+	}
+	if summary.MaxInFlight != 2 || summary.Workers != 0 {
+		t.Errorf("expected the open executor summary, got %+v", summary)
+	}
+	if summary.LatencyMs.Min < float64(delay.Milliseconds()) {
+		t.Errorf("expected latencies of at least %s, got %+v", delay, summary.LatencyMs)
+	}
+}
+
+func TestOpenExecutorMeasuresFromDue(t *testing.T) {
+	server, _ := slowServer(t, 0)
+	cfg := Default()
+	cfg.Executor = EXECUTOR_OPEN
+	r, _ := newRunner(t, server, cfg, "/books")
+	r.stats = NewStats(time.Now())
+
+	// An iteration starting 200ms after it was due counts those 200ms.
+	r.iterate(context.Background(), r.Scenario.Pick(), nil, time.Now().Add(-200*time.Millisecond), false)
+	summary := r.stats.Summary(r.Config, r.Scenario)
+	if summary.Late != 1 || summary.LatencyMs.Min < 200 {
+		t.Errorf("expected a late iteration measured from when it was due, got %+v", summary)
+	}
+}
+
+func TestJourneySpans(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reserve" {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer server.Close()
+	cfg := Default()
+	r, recorder := newRunner(t, server, cfg, "/")
+	r.Scenario = &Scenario{
+		Name:    "library",
+		Targets: map[string]string{"app": server.URL},
+		Steps: []Step{
+			{Name: "list", Target: "app", Path: "/books", Think: Duration(20 * time.Millisecond)},
+			{Name: "reserve", Target: "app", Path: "/reserve"},
+			{Name: "return", Target: "app", Path: "/return"},
+		},
+		Journeys: []Journey{{Name: "borrow", Steps: []string{"list", "reserve", "return"}}},
+	}
+	if err := r.Scenario.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r.stats = NewStats(time.Now())
+	id := &Identity{UserID: "user-1", SessionID: "abc", BookID: 2, MemberID: 1, IterationID: "def"}
+	r.iterate(context.Background(), r.Scenario.Pick(), id, time.Time{}, false)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	root := spans["borrow"]
+	if root == nil || len(spans) != 4 || spans["return"] != nil {
+		t.Fatalf("expected the journey to stop at the failed reserve, got %v", spans)
+	}
+	if root.Parent().IsValid() {
+		t.Error("expected the journey span to be the root of the trace")
+	}
+	for _, name := range []string{"list", "think", "reserve"} {
+		if spans[name].Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("expected %s to be a child of the journey span", name)
+		}
+	}
+	if think := spans["think"]; think.EndTime().Sub(think.StartTime()) < 20*time.Millisecond {
+		t.Errorf("expected the think span to last 20ms, got %s", think.EndTime().Sub(think.StartTime()))
+	}
+	if spans["reserve"].Status().Code != codes.Error || len(spans["reserve"].Events()) != 1 {
+		t.Errorf("expected the failed assertion on the reserve span, got %+v", spans["reserve"].Status())
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range root.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["journey.outcome"].AsString() != OUTCOME_FAILED || attrs["journey.failed_step"].AsString() != "reserve" || attrs["journey.completed_steps"].AsInt64() != 1 {
+		t.Errorf("expected a failed journey at reserve, got %v", attrs)
+	}
+	if attrs["journey.steps"].AsInt64() != 3 || attrs[attribute.Key(ENDUSER_KEY)].AsString() != "user-1" || root.Status().Code != codes.Error {
+		t.Errorf("expected the journey and identity attributes, got %v", attrs)
+	}
+
+	summary := r.stats.Summary(r.Config, r.Scenario)
+	if len(summary.Journeys) != 1 || summary.Journeys[0].Outcomes[OUTCOME_FAILED] != 1 {
+		t.Errorf("expected a failed borrow journey in the summary, got %+v", summary.Journeys)
+	}
+}
+
+func TestJourneyInterrupted(t *testing.T) {
+	server, calls := slowServer(t, 0)
+	cfg := Default()
+	r, recorder := newRunner(t, server, cfg, "/books", "/reserve")
+	r.Scenario.Steps[0].Think = Duration(time.Minute)
+	r.Scenario.Journeys = []Journey{{Name: "borrow", Steps: []string{"GET /books", "GET /reserve"}}}
+	if err := r.Scenario.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r.stats = NewStats(time.Now())
+
+	// Interrupted while thinking, the journey ends without its next step.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r.iterate(ctx, r.Scenario.Pick(), nil, time.Time{}, false)
+	if calls.Load() != 1 {
+		t.Errorf("expected a single request, got %d", calls.Load())
+	}
+	for _, s := range recorder.Ended() {
+		if s.Name() != "borrow" {
+			continue
+		}
+		for _, kv := range s.Attributes() {
+			if kv.Key == "journey.outcome" && kv.Value.AsString() != OUTCOME_INTERRUPTED {
+				t.Errorf("expected an interrupted journey, got %s", kv.Value.AsString())
+			}
+		}
+		if s.Status().Code == codes.Error {
+			t.Error("expected an interrupted journey not to be an error")
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package load
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration accepts Go duration strings such as "250ms" or "1m30s" in both
+// YAML and JSON scenario files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Scenario is a weighted mix of journeys: every iteration runs one journey
+// picked at random, in proportion to the journey weights. Without Journeys
+// every step is a journey of its own, weighted by the step weight.
+type Scenario struct {
+	Name     string            `json:"name" yaml:"name"`
+	Targets  map[string]string `json:"targets" yaml:"targets"`
+	Steps    []Step            `json:"steps" yaml:"steps"`
+	Journeys []Journey         `json:"journeys,omitempty" yaml:"journeys,omitempty"`
+
+	implicit []Journey
+	weights  []int
+	total    int
+}
+
+// Journey is what a user does in one iteration: its steps, named after the
+// scenario steps, run in order and the journey stops at the first one that
+// fails.
+type Journey struct {
+	Name   string   `json:"name" yaml:"name"`
+	Steps  []string `json:"steps" yaml:"steps"`
+	Weight int      `json:"weight,omitempty" yaml:"weight,omitempty"`
+
+	steps []*Step
+}
+
+// Step is one HTTP call against one of the scenario targets.
+type Step struct {
+	Name    string            `json:"name" yaml:"name"`
+	Target  string            `json:"target" yaml:"target"`
+	Method  string            `json:"method" yaml:"method"`
+	Path    string            `json:"path" yaml:"path"`
+	Query   map[string]string `json:"query,omitempty" yaml:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body    string            `json:"body,omitempty" yaml:"body,omitempty"`
+	// Weight is the share of the iterations running the step, 1 when unset.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+	// Think is how long the user pauses after the step.
+	Think  Duration `json:"think,omitempty" yaml:"think,omitempty"`
+	Assert Assert   `json:"assert,omitempty" yaml:"assert,omitempty"`
+}
+
+// Assert describes what a response must look like for the step to succeed.
+// Without a Status assertion any status below 400 is accepted.
+type Assert struct {
+	Status     []int           `json:"status,omitempty" yaml:"status,omitempty"`
+	MaxLatency Duration        `json:"max_latency,omitempty" yaml:"max_latency,omitempty"`
+	JSON       []JSONAssertion `json:"json,omitempty" yaml:"json,omitempty"`
+}
+
+// JSONAssertion checks the value at Path in the JSON response body, e.g.
+// "$.stock" or "$[0].id". Without Equals the value only has to exist.
+type JSONAssertion struct {
+	Path   string `json:"path" yaml:"path"`
+	Equals any    `json:"equals,omitempty" yaml:"equals,omitempty"`
+}
+
+// Failure is an assertion a response did not satisfy.
+type Failure struct {
+	// Assertion names the assertion, e.g. "status" or "json $.stock".
+	Assertion string
+	Message   string
+}
+
+// LoadScenario reads a scenario from a .yaml, .yml or .json file.
+func LoadScenario(path string) (*Scenario, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scenario{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(s)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		err = dec.Decode(s)
+	default:
+		return nil, fmt.Errorf("unsupported scenario format [%s]", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse scenario %s: %w", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// SingleURL is the scenario of a run without a scenario file: a GET of rawURL
+// on every iteration.
+func SingleURL(rawURL string) (*Scenario, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{
+		Name:    "default",
+		Targets: map[string]string{"default": u.Scheme + "://" + u.Host},
+		Steps: []Step{{
+			Name:   "GET " + u.Path,
+			Target: "default",
+			Method: http.MethodGet,
+			Path:   u.RequestURI(),
+		}},
+	}
+	return s, s.Validate()
+}
+
+func (s *Scenario) Validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	byName := map[string]*Step{}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if _, ok := byName[step.Name]; ok && len(s.Journeys) > 0 {
+			return fmt.Errorf("step %s: name used twice", step.Name)
+		}
+		byName[step.Name] = step
+		if step.Method == "" {
+			step.Method = http.MethodGet
+		}
+		if _, ok := s.Targets[step.Target]; !ok {
+			return fmt.Errorf("step %s: unknown target [%s]", step.Name, step.Target)
+		}
+		switch step.Method {
+		case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			return fmt.Errorf("step %s: unsupported method [%s]", step.Name, step.Method)
+		}
+		if !strings.HasPrefix(step.Path, "/") {
+			return fmt.Errorf("step %s: path [%s] must start with /", step.Name, step.Path)
+		}
+		if step.Weight < 0 || step.Think < 0 || step.Assert.MaxLatency < 0 {
+			return fmt.Errorf("step %s: weight, think and max_latency must be >= 0", step.Name)
+		}
+		for _, a := range step.Assert.JSON {
+			if _, err := parsePath(a.Path); err != nil {
+				return fmt.Errorf("step %s: %w", step.Name, err)
+			}
+		}
+	}
+
+	journeys := s.Journeys
+	if len(journeys) == 0 {
+		journeys = make([]Journey, len(s.Steps))
+		for i, step := range s.Steps {
+			journeys[i] = Journey{Name: step.Name, Steps: []string{step.Name}, Weight: step.Weight}
+		}
+	}
+	s.weights = make([]int, len(journeys))
+	s.total = 0
+	for i := range journeys {
+		j := &journeys[i]
+		if j.Name == "" {
+			j.Name = fmt.Sprintf("journey #%d", i+1)
+		}
+		if len(j.Steps) == 0 {
+			return fmt.Errorf("journey %s: no steps", j.Name)
+		}
+		if j.Weight < 0 {
+			return fmt.Errorf("journey %s: weight must be >= 0", j.Name)
+		}
+		j.steps = make([]*Step, len(j.Steps))
+		for k, name := range j.Steps {
+			step, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("journey %s: unknown step [%s]", j.Name, name)
+			}
+			j.steps[k] = step
+		}
+		weight := j.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		s.total += weight
+		s.weights[i] = s.total
+	}
+	// Journeys only holds the journeys of the scenario file.
+	if len(s.Journeys) == 0 {
+		s.implicit = journeys
+	}
+	return nil
+}
+
+// journeys returns the journeys iterations pick from.
+func (s *Scenario) journeys() []Journey {
+	if len(s.Journeys) == 0 {
+		return s.implicit
+	}
+	return s.Journeys
+}
+
+// Pick returns a journey at random, in proportion to the journey weights.
+func (s *Scenario) Pick() *Journey {
+	n := rand.Intn(s.total)
+	i, _ := slices.BinarySearch(s.weights, n+1)
+	return &s.journeys()[i]
+}
+
+// Request builds the HTTP request of the step. ${name} in the path, query,
+// headers and body of the step is replaced with vars[name].
+func (s *Scenario) Request(step *Step, vars map[string]string) (*http.Request, error) {
+	pairs := []string{}
+	for k, v := range vars {
+		pairs = append(pairs, "${"+k+"}", v)
+	}
+	expand := strings.NewReplacer(pairs...).Replace
+
+	u, err := url.Parse(s.Targets[step.Target] + expand(step.Path))
+	if err != nil {
+		return nil, err
+	}
+	if len(step.Query) > 0 {
+		q := u.Query()
+		for k, v := range step.Query {
+			q.Set(k, expand(v))
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	body := expand(step.Body)
+	req, err := http.NewRequest(step.Method, u.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != "" && json.Valid([]byte(body)) {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range step.Headers {
+		req.Header.Set(k, expand(v))
+	}
+	return req, nil
+}
+
+// Check returns the assertions of the step the response does not satisfy.
+// body is only read when the step has JSON assertions.
+func (s *Step) Check(status int, body []byte, latency time.Duration) []Failure {
+	failures := []Failure{}
+	if len(s.Assert.Status) > 0 {
+		if !slices.Contains(s.Assert.Status, status) {
+			failures = append(failures, Failure{"status", fmt.Sprintf("status %d is not one of %v", status, s.Assert.Status)})
+		}
+	} else if status >= 400 {
+		failures = append(failures, Failure{"status", fmt.Sprintf("status %d", status)})
+	}
+	if limit := time.Duration(s.Assert.MaxLatency); limit > 0 && latency > limit {
+		failures = append(failures, Failure{"max_latency", fmt.Sprintf("took %s, more than %s", latency.Round(time.Millisecond), limit)})
+	}
+	if len(s.Assert.JSON) == 0 {
+		return failures
+	}
+
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		for _, a := range s.Assert.JSON {
+			failures = append(failures, Failure{"json " + a.Path, "response is not JSON"})
+		}
+		return failures
+	}
+	for _, a := range s.Assert.JSON {
+		name := "json " + a.Path
+		path, _ := parsePath(a.Path)
+		v, ok := lookup(doc, path)
+		if !ok {
+			failures = append(failures, Failure{name, fmt.Sprintf("%s is missing", a.Path)})
+			continue
+		}
+		if a.Equals == nil {
+			continue
+		}
+		got, _ := json.Marshal(v)
+		want, _ := json.Marshal(normalize(a.Equals))
+		if !bytes.Equal(got, want) {
+			failures = append(failures, Failure{name, fmt.Sprintf("%s is %s, expected %s", a.Path, got, want)})
+		}
+	}
+	return failures
+}
+
+// parsePath splits a path such as $.items[0].id in its keys and indexes.
+func parsePath(path string) ([]any, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("json path [%s] must start with $", path)
+	}
+	parts := []any{}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("json path [%s] has an empty key", path)
+			}
+			parts = append(parts, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path [%s] has an unterminated index", path)
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("json path [%s] has an invalid index", path)
+			}
+			parts = append(parts, i)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("json path [%s] is invalid at [%s]", path, rest)
+		}
+	}
+	return parts, nil
+}
+
+func lookup(doc any, path []any) (any, bool) {
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			m, ok := doc.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = m[p]; !ok {
+				return nil, false
+			}
+		case int:
+			a, ok := doc.([]any)
+			if !ok || p >= len(a) {
+				return nil, false
+			}
+			doc = a[p]
+		}
+	}
+	return doc, true
+}
+
+// normalize turns the maps YAML decodes, keyed by any, into JSON objects.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalize(e)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+		return v
+	}
+	return v
+}
@@ -0,0 +1,215 @@
+package load
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadScenario(t *testing.T) {
+	s, err := LoadScenario("../../scenarios/library.yaml")
+	if err != nil {
+		t.Fatalf("expected the shipped scenario to load, got %v", err)
+	}
+	if len(s.Journeys) == 0 || s.Pick() == nil {
+		t.Errorf("expected the shipped scenario to have journeys, got %+v", s)
+	}
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		file    string
+		content string
+		want    string
+	}{
+		{"ok.json", `{"name": "json", "targets": {"app": "http://app"}, "steps": [{"target": "app", "path": "/"}]}`, ""},
+		{"ok.yml", "name: yml\ntargets: {app: 'http://app'}\nsteps: [{target: app, path: /}]\n", ""},
+		{"unknown.yaml", "name: x\nbogus: 1\n", "field bogus not found"},
+		{"unknown.json", `{"name": "x", "bogus": 1}`, `unknown field "bogus"`},
+		{"invalid.yaml", "name: x\ntargets: {}\nsteps: [{target: app, path: /}]\n", "unknown target [app]"},
+		{"scenario.toml", "name = 'x'", "unsupported scenario format [.toml]"},
+	} {
+		path := filepath.Join(dir, tc.file)
+		os.WriteFile(path, []byte(tc.content), 0o644)
+		_, err := LoadScenario(path)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: expected to load, got %v", tc.file, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: expected an error containing %q, got %v", tc.file, tc.want, err)
+		}
+	}
+}
+
+// scenario returns a valid scenario with the given steps, against the app
+// target.
+func scenario(steps ...Step) *Scenario {
+	return &Scenario{Name: "test", Targets: map[string]string{"app": "http://app:8081"}, Steps: steps}
+}
+
+func TestValidate(t *testing.T) {
+	s := scenario(Step{Target: "app", Path: "/books"}, Step{Name: "reserve", Target: "app", Path: "/reserve", Weight: 3})
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Steps[0].Name != "#1" || s.Steps[0].Method != "GET" {
+		t.Errorf("expected the defaults to be filled in, got %+v", s.Steps[0])
+	}
+	if journeys := s.journeys(); len(journeys) != 2 || journeys[1].Name != "reserve" || journeys[1].steps[0] != &s.Steps[1] {
+		t.Errorf("expected a journey per step, got %+v", journeys)
+	}
+
+	for _, tc := range []struct {
+		name string
+		s    *Scenario
+		want string
+	}{
+		{"no steps", scenario(), "no steps"},
+		{"unknown target", scenario(Step{Target: "other", Path: "/"}), "unknown target [other]"},
+		{"bad method", scenario(Step{Target: "app", Method: "TRACE", Path: "/"}), "unsupported method [TRACE]"},
+		{"relative path", scenario(Step{Target: "app", Path: "books"}), "must start with /"},
+		{"negative weight", scenario(Step{Target: "app", Path: "/", Weight: -1}), "must be >= 0"},
+		{"negative think", scenario(Step{Target: "app", Path: "/", Think: Duration(-time.Second)}), "must be >= 0"},
+		{"bad json path", scenario(Step{Target: "app", Path: "/", Assert: Assert{JSON: []JSONAssertion{{Path: "stock"}}}}), "must start with $"},
+		{
+			"duplicate step",
+			&Scenario{Targets: map[string]string{"app": "http://app"}, Steps: []Step{{Name: "a", Target: "app", Path: "/"}, {Name: "a", Target: "app", Path: "/"}}, Journeys: []Journey{{Steps: []string{"a"}}}},
+			"step a: name used twice",
+		},
+		{
+			"unknown step",
+			&Scenario{Targets: map[string]string{"app": "http://app"}, Steps: []Step{{Name: "a", Target: "app", Path: "/"}}, Journeys: []Journey{{Name: "j", Steps: []string{"b"}}}},
+			"journey j: unknown step [b]",
+		},
+		{
+			"empty journey",
+			&Scenario{Targets: map[string]string{"app": "http://app"}, Steps: []Step{{Name: "a", Target: "app", Path: "/"}}, Journeys: []Journey{{}}},
+			"journey journey #1: no steps",
+		},
+	} {
+		if err := tc.s.Validate(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	s := scenario(
+		Step{Name: "light", Target: "app", Path: "/"},
+		Step{Name: "heavy", Target: "app", Path: "/", Weight: 3},
+	)
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	picked := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		picked[s.Pick().Name]++
+	}
+	if picked["heavy"] < 2800 || picked["heavy"] > 3200 {
+		t.Errorf("expected heavy picked about 3 times out of 4, got %v", picked)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	s := scenario(Step{
+		Target:  "app",
+		Method:  "POST",
+		Path:    "/books/${book_id}",
+		Query:   map[string]string{"member_id": "${member_id}"},
+		Headers: map[string]string{"Idempotency-Key": "k-${iteration_id}"},
+		Body:    `{"book_id": ${book_id}}`,
+	})
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	req, err := s.Request(&s.Steps[0], map[string]string{"book_id": "7", "member_id": "3", "iteration_id": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "POST" || req.URL.String() != "http://app:8081/books/7?member_id=3" {
+		t.Errorf("expected the variables expanded in the URL, got %s %s", req.Method, req.URL)
+	}
+	if req.Header.Get("Idempotency-Key") != "k-abc" || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected the expanded headers and a JSON content type, got %v", req.Header)
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != `{"book_id": 7}` {
+		t.Errorf("expected the expanded body, got %s", body)
+	}
+
+	// Without vars the placeholders are sent as written.
+	req, _ = s.Request(&s.Steps[0], nil)
+	if req.URL.Path != "/books/${book_id}" {
+		t.Errorf("expected the placeholders kept, got %s", req.URL.Path)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	body := []byte(`{"id": 1, "stock": 4, "tags": ["fantasy"], "author": {"name": "Tolkien"}}`)
+	for _, tc := range []struct {
+		name    string
+		assert  Assert
+		status  int
+		body    []byte
+		latency time.Duration
+		want    []string
+	}{
+		{"any success", Assert{}, 204, nil, 0, nil},
+		{"default rejects errors", Assert{}, 404, nil, 0, []string{"status"}},
+		{"listed status", Assert{Status: []int{201, 409}}, 409, nil, 0, nil},
+		{"unlisted status", Assert{Status: []int{201}}, 200, nil, 0, []string{"status"}},
+		{"fast enough", Assert{MaxLatency: Duration(time.Second)}, 200, nil, time.Second, nil},
+		{"too slow", Assert{MaxLatency: Duration(time.Second)}, 200, nil, 2 * time.Second, []string{"max_latency"}},
+		{
+			"json values",
+			Assert{JSON: []JSONAssertion{{Path: "$.id"}, {Path: "$.stock", Equals: 4}, {Path: "$.tags[0]", Equals: "fantasy"}, {Path: "$.author", Equals: map[any]any{"name": "Tolkien"}}}},
+			200, body, 0, nil,
+		},
+		{
+			"json mismatch",
+			Assert{JSON: []JSONAssertion{{Path: "$.stock", Equals: 5}, {Path: "$.missing"}, {Path: "$.tags[3]"}}},
+			200, body, 0, []string{"json $.stock", "json $.missing", "json $.tags[3]"},
+		},
+		{"not json", Assert{JSON: []JSONAssertion{{Path: "$.id"}}}, 200, []byte("<html>"), 0, []string{"json $.id"}},
+		{"every failure", Assert{Status: []int{200}, MaxLatency: Duration(time.Millisecond), JSON: []JSONAssertion{{Path: "$.id", Equals: 2}}}, 500, body, time.Second, []string{"status", "max_latency", "json $.id"}},
+	} {
+		step := &Step{Name: tc.name, Assert: tc.assert}
+		failures := step.Check(tc.status, tc.body, tc.latency)
+		got := []string{}
+		for _, f := range failures {
+			got = append(got, f.Assertion)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: expected failures %v, got %+v", tc.name, tc.want, failures)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"$", "[]"},
+		{"$.id", "[id]"},
+		{"$[0].items[12].id", "[0 items 12 id]"},
+		{"$.a.b", "[a b]"},
+		{"id", "error"},
+		{"$.", "error"},
+		{"$[x]", "error"},
+		{"$[-1]", "error"},
+		{"$[0", "error"},
+		{"$id", "error"},
+	} {
+		parts, err := parsePath(tc.path)
+		got := "error"
+		if err == nil {
+			got = fmt.Sprint(parts)
+		}
+		if got != tc.want {
+			t.Errorf("parsePath(%q) = %s, want %s", tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package load
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Key identifies the requests a histogram is kept for.
+type Key struct {
+	Step   string
+	Method string
+	Path   string
+	// Status is the HTTP status code, or "error" when no response came back.
+	Status string
+}
+
+// Stats keeps a latency histogram per Key for the whole run, and one for all
+// the requests since the last progress line.
+type Stats struct {
+	mu       sync.Mutex
+	start    time.Time
+	total    map[Key]*Histogram
+	failures int64
+	// assertions counts the failed assertions by step and assertion.
+	assertions map[[2]string]int64
+	journeys   map[string]*journeyStats
+	dropped    int64
+	late       int64
+	// Iterations dropped and started late since the last progress line.
+	intervalDropped int64
+	intervalLate    int64
+	interval        Histogram
+	intervalOK      int64
+	lastReport      time.Time
+}
+
+func NewStats(start time.Time) *Stats {
+	return &Stats{start: start, total: map[Key]*Histogram{}, assertions: map[[2]string]int64{}, journeys: map[string]*journeyStats{}, lastReport: start}
+}
+
+// journeyStats are the outcomes and durations of the iterations of a journey.
+type journeyStats struct {
+	outcomes map[string]int64
+	duration Histogram
+}
+
+// Journey counts an iteration of journey and its outcome.
+func (s *Stats) Journey(journey string, outcome string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.journeys[journey]
+	if !ok {
+		j = &journeyStats{outcomes: map[string]int64{}}
+		s.journeys[journey] = j
+	}
+	j.outcomes[outcome]++
+	j.duration.Record(d)
+}
+
+// Drop counts an iteration of the open executor that was not started because
+// too many were in flight.
+func (s *Stats) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+	s.intervalDropped++
+}
+
+// Late counts an iteration of the open executor that started behind schedule.
+func (s *Stats) Late() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.late++
+	s.intervalLate++
+}
+
+// Fail counts a failed assertion of step.
+func (s *Stats) Fail(step string, assertion string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assertions[[2]string{step, assertion}]++
+}
+
+func (s *Stats) Record(key Key, d time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.total[key]
+	if !ok {
+		h = &Histogram{}
+		s.total[key] = h
+	}
+	h.Record(d)
+	s.interval.Record(d)
+	if failed {
+		s.failures++
+	} else {
+		s.intervalOK++
+	}
+}
+
+// Progress writes one line about the requests completed since the previous
+// call and starts a new interval.
+func (s *Stats) Progress(w io.Writer) {
+	s.mu.Lock()
+	now := time.Now()
+	h := s.interval
+	ok := s.intervalOK
+	took := now.Sub(s.lastReport)
+	dropped, late := s.intervalDropped, s.intervalLate
+	s.interval = Histogram{}
+	s.intervalOK = 0
+	s.intervalDropped, s.intervalLate = 0, 0
+	s.lastReport = now
+	s.mu.Unlock()
+
+	errorRate := 0.0
+	if h.Count() > 0 {
+		errorRate = float64(h.Count()-ok) / float64(h.Count()) * 100
+	}
+	fmt.Fprintf(w, "t+%-8s rps %7.1f  errors %5.1f%%  p50 %-8s p90 %-8s p99 %-8s max %s",
+		now.Sub(s.start).Round(100*time.Millisecond),
+		float64(h.Count())/took.Seconds(),
+		errorRate,
+		h.Percentile(50).Round(time.Millisecond),
+		h.Percentile(90).Round(time.Millisecond),
+		h.Percentile(99).Round(time.Millisecond),
+		h.Max().Round(time.Millisecond),
+	)
+	if dropped > 0 || late > 0 {
+		fmt.Fprintf(w, "  dropped %d  late %d", dropped, late)
+	}
+	fmt.Fprintln(w)
+}
+
+// Latency is a histogram summed up in milliseconds.
+type Latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func latency(h *Histogram) Latency {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return Latency{
+		Min:  ms(h.Min()),
+		Mean: ms(h.Mean()),
+		P50:  ms(h.Percentile(50)),
+		P90:  ms(h.Percentile(90)),
+		P99:  ms(h.Percentile(99)),
+		Max:  ms(h.Max()),
+	}
+}
+
+type EndpointSummary struct {
+	Step      string  `json:"step"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    string  `json:"status"`
+	Requests  int64   `json:"requests"`
+	LatencyMs Latency `json:"latency_ms"`
+}
+
+// JourneySummary counts the iterations of a journey by outcome, and sums up
+// how long they took, think times included.
+type JourneySummary struct {
+	Journey    string           `json:"journey"`
+	Iterations int64            `json:"iterations"`
+	Outcomes   map[string]int64 `json:"outcomes"`
+	DurationMs Latency          `json:"duration_ms"`
+}
+
+type AssertionSummary struct {
+	Step      string `json:"step"`
+	Assertion string `json:"assertion"`
+	Failures  int64  `json:"failures"`
+}
+
+// Summary describes a whole run. It is written as JSON at the end of the run
+// so two runs, e.g. before and after enabling a fault, can be compared.
+type Summary struct {
+	Scenario string  `json:"scenario"`
+	Executor string  `json:"executor"`
+	URL      string  `json:"url,omitempty"`
+	RPS      float64 `json:"rps_target"`
+	Stages   string  `json:"stages,omitempty"`
+	Workers  int     `json:"workers,omitempty"`
+	// MaxInFlight, Dropped and Late only apply to the open executor.
+	MaxInFlight int                `json:"max_in_flight,omitempty"`
+	Dropped     int64              `json:"dropped"`
+	Late        int64              `json:"late"`
+	Started     time.Time          `json:"started"`
+	ElapsedMs   int64              `json:"elapsed_ms"`
+	Requests    int64              `json:"requests"`
+	Failures    int64              `json:"failures"`
+	ErrorRate   float64            `json:"error_rate"`
+	Throughput  float64            `json:"rps"`
+	LatencyMs   Latency            `json:"latency_ms"`
+	Endpoints   []EndpointSummary  `json:"endpoints"`
+	Journeys    []JourneySummary   `json:"journeys"`
+	Assertions  []AssertionSummary `json:"assertions"`
+}
+
+func (s *Stats) Summary(cfg *Config, scenario *Scenario) Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.start)
+	all := &Histogram{}
+	endpoints := []EndpointSummary{}
+	for key, h := range s.total {
+		all.Merge(h)
+		endpoints = append(endpoints, EndpointSummary{
+			Step:      key.Step,
+			Method:    key.Method,
+			Path:      key.Path,
+			Status:    key.Status,
+			Requests:  h.Count(),
+			LatencyMs: latency(h),
+		})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		if a.Step != b.Step {
+			return a.Step < b.Step
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Status < b.Status
+	})
+
+	journeys := []JourneySummary{}
+	for name, j := range s.journeys {
+		journeys = append(journeys, JourneySummary{
+			Journey:    name,
+			Iterations: j.duration.Count(),
+			Outcomes:   maps.Clone(j.outcomes),
+			DurationMs: latency(&j.duration),
+		})
+	}
+	sort.Slice(journeys, func(i, j int) bool { return journeys[i].Journey < journeys[j].Journey })
+
+	assertions := []AssertionSummary{}
+	for key, n := range s.assertions {
+		assertions = append(assertions, AssertionSummary{Step: key[0], Assertion: key[1], Failures: n})
+	}
+	sort.Slice(assertions, func(i, j int) bool {
+		a, b := assertions[i], assertions[j]
+		if a.Step != b.Step {
+			return a.Step < b.Step
+		}
+		return a.Assertion < b.Assertion
+	})
+
+	summary := Summary{
+		Scenario:   scenario.Name,
+		Executor:   cfg.Executor,
+		URL:        cfg.URL,
+		RPS:        cfg.RPS,
+		Stages:     cfg.Stages.String(),
+		Workers:    cfg.Workers,
+		Started:    s.start,
+		ElapsedMs:  elapsed.Milliseconds(),
+		Requests:   all.Count(),
+		Failures:   s.failures,
+		Dropped:    s.dropped,
+		Late:       s.late,
+		Throughput: float64(all.Count()) / elapsed.Seconds(),
+		LatencyMs:  latency(all),
+		Endpoints:  endpoints,
+		Journeys:   journeys,
+		Assertions: assertions,
+	}
+	if cfg.ScenarioFile != "" {
+		summary.URL = ""
+	}
+	if cfg.Executor == EXECUTOR_OPEN {
+		summary.MaxInFlight = cfg.MaxInFlight
+		summary.Workers = 0
+	}
+	if all.Count() > 0 {
+		summary.ErrorRate = float64(s.failures) / float64(all.Count())
+	}
+	return summary
+}
+
+// WriteFile writes the summary as indented JSON to path.
+func (s Summary) WriteFile(path string) error {
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(raw, '\n'), 0o644)
+}
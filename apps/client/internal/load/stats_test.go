@@ -0,0 +1,94 @@
+package load
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestStatsSummary(t *testing.T) {
+	s := NewStats(time.Now())
+	books := Key{Step: "list books", Method: "GET", Path: "/books", Status: "200"}
+	failed := Key{Step: "reserve", Method: "GET", Path: "/reserve", Status: "500"}
+	for i := 1; i <= 8; i++ {
+		s.Record(books, time.Duration(i)*time.Millisecond, false)
+	}
+	s.Record(failed, 20*time.Millisecond, true)
+	s.Record(Key{Step: "reserve", Method: "GET", Path: "/reserve", Status: "error"}, 4*time.Second, true)
+	s.Fail("reserve", "status")
+	s.Fail("reserve", "status")
+	s.Journey("reserve", OUTCOME_FAILED, 30*time.Millisecond)
+	s.Journey("reserve", OUTCOME_SUCCESS, 10*time.Millisecond)
+	s.Drop()
+	s.Late()
+
+	cfg := Default()
+	cfg.Executor = EXECUTOR_OPEN
+	summary := s.Summary(&cfg, &Scenario{Name: "library"})
+
+	if summary.Scenario != "library" || summary.Requests != 10 || summary.Failures != 2 || summary.ErrorRate != 0.2 {
+		t.Errorf("expected 10 requests with 2 failures, got %d and %d (%g)", summary.Requests, summary.Failures, summary.ErrorRate)
+	}
+	if summary.Dropped != 1 || summary.Late != 1 || summary.MaxInFlight != cfg.MaxInFlight || summary.Workers != 0 {
+		t.Errorf("expected the open executor counters, got %+v", summary)
+	}
+	if summary.LatencyMs.Max != 4000 || summary.LatencyMs.Min != 1 {
+		t.Errorf("expected latencies from 1ms to 4s, got %+v", summary.LatencyMs)
+	}
+
+	if len(summary.Endpoints) != 3 {
+		t.Fatalf("expected 3 endpoints, got %+v", summary.Endpoints)
+	}
+	first := summary.Endpoints[0]
+	if first.Step != "list books" || first.Requests != 8 || first.LatencyMs.P50 < 4 || first.LatencyMs.P50 > 4.0625 || first.LatencyMs.Max != 8 {
+		t.Errorf("expected list books first with 8 requests, got %+v", first)
+	}
+	if summary.Endpoints[1].Status != "500" || summary.Endpoints[2].Status != "error" {
+		t.Errorf("expected the endpoints sorted by status, got %+v", summary.Endpoints)
+	}
+
+	if len(summary.Assertions) != 1 || summary.Assertions[0].Failures != 2 {
+		t.Errorf("expected 2 failed status assertions, got %+v", summary.Assertions)
+	}
+	if len(summary.Journeys) != 1 || summary.Journeys[0].Iterations != 2 || summary.Journeys[0].Outcomes[OUTCOME_FAILED] != 1 {
+		t.Errorf("expected 2 iterations of reserve, got %+v", summary.Journeys)
+	}
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	if err := summary.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(path)
+	read := Summary{}
+	if err := json.Unmarshal(raw, &read); err != nil || read.Requests != 10 || read.Executor != EXECUTOR_OPEN {
+		t.Errorf("expected the summary written as JSON, got %+v %v", read, err)
+	}
+}
+
+func TestStatsProgress(t *testing.T) {
+	s := NewStats(time.Now().Add(-time.Second))
+	s.lastReport = s.start
+	for i := 0; i < 3; i++ {
+		s.Record(Key{Step: "s", Status: "200"}, 10*time.Millisecond, false)
+	}
+	s.Record(Key{Step: "s", Status: "500"}, 30*time.Millisecond, true)
+	s.Drop()
+
+	out := &bytes.Buffer{}
+	s.Progress(out)
+	line := regexp.MustCompile(`^t\+1s +rps +4\.0  errors  25\.0%  p50 10ms +p90 30ms +p99 30ms +max 30ms  dropped 1  late 0\n$`)
+	if !line.MatchString(out.String()) {
+		t.Errorf("unexpected progress line %q", out)
+	}
+
+	// Every line covers the requests since the previous one.
+	out.Reset()
+	s.Progress(out)
+	if !regexp.MustCompile(`rps +0\.0  errors   0\.0%  p50 0s`).MatchString(out.String()) {
+		t.Errorf("expected an empty interval, got %q", out)
+	}
+}
@@ -0,0 +1,173 @@
+package load
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+const (
+	DISTRIBUTION_UNIFORM = "uniform"
+	DISTRIBUTION_ZIPF    = "zipf"
+)
+
+var DISTRIBUTIONS = []string{DISTRIBUTION_UNIFORM, DISTRIBUTION_ZIPF}
+
+// The identity of an iteration is sent in these headers, and as the
+// ENDUSER_KEY, SESSION_KEY and BOOK_KEY members of the baggage header. The
+// services record it under the same keys on their spans and logs.
+var (
+	ENDUSER_HEADER = "x-enduser-id"
+	SESSION_HEADER = "x-session-id"
+	BOOK_HEADER    = "x-book-id"
+	BAGGAGE_HEADER = "baggage"
+
+	ENDUSER_KEY = "enduser.id"
+	SESSION_KEY = "session.id"
+	BOOK_KEY    = "book.id"
+)
+
+// SESSION_ITERATIONS is how many iterations a user runs before starting a
+// new session.
+var SESSION_ITERATIONS = 20
+
+// Identity is the synthetic user, session and book an iteration runs for.
+type Identity struct {
+	UserID    string
+	SessionID string
+	BookID    int64
+	// MemberID is the library member of the user: user-n is member n, as
+	// seeded by app3.
+	MemberID int64
+	// IterationID is unique to the iteration, e.g. to build Idempotency-Key
+	// headers that no other iteration sends.
+	IterationID string
+}
+
+// Vars are the values scenario steps can refer to as ${user_id},
+// ${session_id}, ${book_id}, ${member_id} and ${iteration_id}.
+func (i *Identity) Vars() map[string]string {
+	return map[string]string{
+		"user_id":      i.UserID,
+		"session_id":   i.SessionID,
+		"book_id":      strconv.FormatInt(i.BookID, 10),
+		"member_id":    strconv.FormatInt(i.MemberID, 10),
+		"iteration_id": i.IterationID,
+	}
+}
+
+func (i *Identity) Attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(ENDUSER_KEY, i.UserID),
+		attribute.String(SESSION_KEY, i.SessionID),
+		attribute.Int64(BOOK_KEY, i.BookID),
+	}
+}
+
+// Apply sets the identity headers of req and adds the identity to its baggage
+// header, keeping the members already there, e.g. chaos directives.
+func (i *Identity) Apply(req *http.Request) {
+	req.Header.Set(ENDUSER_HEADER, i.UserID)
+	req.Header.Set(SESSION_HEADER, i.SessionID)
+	req.Header.Set(BOOK_HEADER, strconv.FormatInt(i.BookID, 10))
+
+	b, err := baggage.Parse(req.Header.Get(BAGGAGE_HEADER))
+	if err != nil {
+		b = baggage.Baggage{}
+	}
+	members := map[string]string{
+		ENDUSER_KEY: i.UserID,
+		SESSION_KEY: i.SessionID,
+		BOOK_KEY:    strconv.FormatInt(i.BookID, 10),
+	}
+	for key, value := range members {
+		m, err := baggage.NewMemberRaw(key, value)
+		if err != nil {
+			continue
+		}
+		if next, err := b.SetMember(m); err == nil {
+			b = next
+		}
+	}
+	req.Header.Set(BAGGAGE_HEADER, b.String())
+}
+
+// Population hands out the identities of iterations: users and books are
+// picked from a seeded random source, uniformly or following a Zipf
+// distribution where a few of them get most of the traffic. It is safe for
+// concurrent use, but with several workers the order iterations pick in, and
+// so which identity each gets, is not deterministic.
+type Population struct {
+	mu       sync.Mutex
+	rng      *rand.Rand
+	users    func() int
+	books    func() int
+	sessions []session
+}
+
+type session struct {
+	id   string
+	left int
+}
+
+// NewPopulation creates users users and books books. s is the exponent of the
+// Zipf distributions, it must be greater than 1.
+func NewPopulation(seed int64, users int, userDist string, books int, bookDist string, s float64) (*Population, error) {
+	p := &Population{
+		rng:      rand.New(rand.NewSource(seed)),
+		sessions: make([]session, users),
+	}
+	var err error
+	if p.users, err = p.picker(users, userDist, s); err != nil {
+		return nil, err
+	}
+	if p.books, err = p.picker(books, bookDist, s); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// picker returns a function picking an index below n from dist. With Zipf the
+// lowest indexes are the most popular.
+func (p *Population) picker(n int, dist string, s float64) (func() int, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("population sizes must be positive")
+	}
+	switch dist {
+	case DISTRIBUTION_UNIFORM:
+		return func() int { return p.rng.Intn(n) }, nil
+	case DISTRIBUTION_ZIPF:
+		if s <= 1 {
+			return nil, fmt.Errorf("zipf exponent must be > 1")
+		}
+		z := rand.NewZipf(p.rng, s, 1, uint64(n-1))
+		return func() int { return int(z.Uint64()) }, nil
+	}
+	return nil, fmt.Errorf("invalid distribution [%s]", dist)
+}
+
+// Next returns the identity of the next iteration.
+func (p *Population) Next() *Identity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	user := p.users()
+	sess := &p.sessions[user]
+	if sess.left == 0 {
+		sess.id = fmt.Sprintf("%016x", p.rng.Uint64())
+		sess.left = SESSION_ITERATIONS
+	}
+	sess.left--
+	return &Identity{
+		UserID:      fmt.Sprintf("user-%d", user+1),
+		SessionID:   sess.id,
+		BookID:      int64(p.books() + 1),
+		MemberID:    int64(user + 1),
+		IterationID: fmt.Sprintf("%016x", p.rng.Uint64()),
+	}
+}
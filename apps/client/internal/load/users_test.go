@@ -0,0 +1,127 @@
+package load
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+func TestPopulationSeed(t *testing.T) {
+	a, _ := NewPopulation(42, 100, DISTRIBUTION_UNIFORM, 10, DISTRIBUTION_ZIPF, 1.1)
+	b, _ := NewPopulation(42, 100, DISTRIBUTION_UNIFORM, 10, DISTRIBUTION_ZIPF, 1.1)
+	other, _ := NewPopulation(43, 100, DISTRIBUTION_UNIFORM, 10, DISTRIBUTION_ZIPF, 1.1)
+	same := 0
+	for i := 0; i < 100; i++ {
+		x, y, z := a.Next(), b.Next(), other.Next()
+		if *x != *y {
+			t.Fatalf("expected the same seed to give the same identities, got %+v and %+v", x, y)
+		}
+		if *x == *z {
+			same++
+		}
+		if x.BookID < 1 || x.BookID > 10 || x.MemberID < 1 || x.MemberID > 100 || x.UserID != "user-"+x.Vars()["member_id"] {
+			t.Errorf("expected ids within the population, got %+v", x)
+		}
+	}
+	if same == 100 {
+		t.Error("expected another seed to give other identities")
+	}
+}
+
+func TestPopulationZipf(t *testing.T) {
+	p, _ := NewPopulation(1, 100, DISTRIBUTION_ZIPF, 100, DISTRIBUTION_UNIFORM, 1.1)
+	picked := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		picked[p.Next().UserID]++
+	}
+	// The first users get most of the traffic, the last ones little of it.
+	if picked["user-1"] < 10*picked["user-100"] || picked["user-1"] < picked["user-2"] || picked["user-2"] < picked["user-10"] {
+		t.Errorf("expected the traffic skewed toward the first users, got user-1 %d, user-2 %d, user-10 %d, user-100 %d",
+			picked["user-1"], picked["user-2"], picked["user-10"], picked["user-100"])
+	}
+
+	p, _ = NewPopulation(1, 100, DISTRIBUTION_UNIFORM, 100, DISTRIBUTION_UNIFORM, 1.1)
+	picked = map[string]int{}
+	for i := 0; i < 10000; i++ {
+		picked[p.Next().UserID]++
+	}
+	if len(picked) != 100 || picked["user-1"] > 200 {
+		t.Errorf("expected the traffic spread over every user, got %d users and user-1 %d", len(picked), picked["user-1"])
+	}
+}
+
+func TestPopulationSessions(t *testing.T) {
+	p, _ := NewPopulation(1, 1, DISTRIBUTION_UNIFORM, 1, DISTRIBUTION_UNIFORM, 1.1)
+	sessions := map[string]int{}
+	iterations := map[string]bool{}
+	for i := 0; i < 3*SESSION_ITERATIONS; i++ {
+		id := p.Next()
+		sessions[id.SessionID]++
+		iterations[id.IterationID] = true
+	}
+	if len(sessions) != 3 {
+		t.Errorf("expected a new session every %d iterations, got %v", SESSION_ITERATIONS, sessions)
+	}
+	for session, n := range sessions {
+		if n != SESSION_ITERATIONS {
+			t.Errorf("expected session %s to last %d iterations, got %d", session, SESSION_ITERATIONS, n)
+		}
+	}
+	if len(iterations) != 3*SESSION_ITERATIONS {
+		t.Errorf("expected an iteration id per iteration, got %d", len(iterations))
+	}
+}
+
+func TestNewPopulationErrors(t *testing.T) {
+	for _, tc := range []struct {
+		users int
+		dist  string
+		s     float64
+		want  string
+	}{
+		{0, DISTRIBUTION_UNIFORM, 1.1, "must be positive"},
+		{10, "normal", 1.1, "invalid distribution [normal]"},
+		{10, DISTRIBUTION_ZIPF, 1, "zipf exponent must be > 1"},
+	} {
+		_, err := NewPopulation(1, tc.users, tc.dist, 10, DISTRIBUTION_UNIFORM, tc.s)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%d %s users with exponent %g: expected an error containing %q, got %v", tc.users, tc.dist, tc.s, tc.want, err)
+		}
+	}
+}
+
+func TestIdentityApply(t *testing.T) {
+	id := &Identity{UserID: "user-7", SessionID: "abc", BookID: 3, MemberID: 7, IterationID: "def"}
+	req, _ := http.NewRequest("GET", "http://app1:8081/books", nil)
+	req.Header.Set(BAGGAGE_HEADER, "chaos.delay=100ms,enduser.id=user-1")
+	id.Apply(req)
+
+	if req.Header.Get(ENDUSER_HEADER) != "user-7" || req.Header.Get(SESSION_HEADER) != "abc" || req.Header.Get(BOOK_HEADER) != "3" {
+		t.Errorf("expected the identity headers, got %v", req.Header)
+	}
+	b, err := baggage.Parse(req.Header.Get(BAGGAGE_HEADER))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The members already there are kept, the identity replaces its own.
+	if b.Member("chaos.delay").Value() != "100ms" || b.Member(ENDUSER_KEY).Value() != "user-7" || b.Member(SESSION_KEY).Value() != "abc" || b.Member(BOOK_KEY).Value() != "3" {
+		t.Errorf("expected the identity added to the baggage, got %s", b)
+	}
+
+	// An invalid baggage header is replaced.
+	req.Header.Set(BAGGAGE_HEADER, "=;=")
+	id.Apply(req)
+	if b, err := baggage.Parse(req.Header.Get(BAGGAGE_HEADER)); err != nil || b.Len() != 3 {
+		t.Errorf("expected only the identity in the baggage, got %q", req.Header.Get(BAGGAGE_HEADER))
+	}
+
+	vars := id.Vars()
+	if vars["user_id"] != "user-7" || vars["book_id"] != "3" || vars["member_id"] != "7" || vars["iteration_id"] != "def" || vars["session_id"] != "abc" {
+		t.Errorf("expected the identity vars, got %v", vars)
+	}
+	if attrs := id.Attributes(); len(attrs) != 3 || attrs[2].Value.AsInt64() != 3 {
+		t.Errorf("expected the identity attributes, got %v", attrs)
+	}
+}
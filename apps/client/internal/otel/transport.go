@@ -0,0 +1,173 @@
+package otel
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MAX_DRAIN is how much of an unread response body is discarded when it is
+// closed, so the connection can go back to the idle pool. Connections with
+// more left to read are closed instead.
+var MAX_DRAIN int64 = 64 << 10
+
+// TransportConfig tunes the pooled transport RoundTrip sends requests with
+// when no Base is injected. A zero duration or limit means none.
+type TransportConfig struct {
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	HTTP2                 bool
+}
+
+// DefaultTransportConfig is http.DefaultTransport with a larger idle pool per
+// host, so concurrent requests to the same service reuse their connections.
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		DialTimeout:         30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		HTTP2:               true,
+	}
+}
+
+// TransportConfigFromEnv overrides the defaults with the HTTP_* variables of
+// the environment, e.g. HTTP_MAX_CONNS_PER_HOST=10 or HTTP_HTTP2=false.
+func TransportConfigFromEnv(getenv func(string) string) (TransportConfig, error) {
+	c := DefaultTransportConfig()
+	errs := []error{}
+	durations := map[string]*time.Duration{
+		"HTTP_DIAL_TIMEOUT":            &c.DialTimeout,
+		"HTTP_KEEP_ALIVE":              &c.KeepAlive,
+		"HTTP_TLS_HANDSHAKE_TIMEOUT":   &c.TLSHandshakeTimeout,
+		"HTTP_RESPONSE_HEADER_TIMEOUT": &c.ResponseHeaderTimeout,
+		"HTTP_IDLE_CONN_TIMEOUT":       &c.IdleConnTimeout,
+	}
+	for key, d := range durations {
+		if v := getenv(key); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed < 0 {
+				errs = append(errs, fmt.Errorf("invalid %s [%s], expected a duration >= 0", key, v))
+				continue
+			}
+			*d = parsed
+		}
+	}
+	limits := map[string]*int{
+		"HTTP_MAX_IDLE_CONNS":          &c.MaxIdleConns,
+		"HTTP_MAX_IDLE_CONNS_PER_HOST": &c.MaxIdleConnsPerHost,
+		"HTTP_MAX_CONNS_PER_HOST":      &c.MaxConnsPerHost,
+	}
+	for key, n := range limits {
+		if v := getenv(key); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				errs = append(errs, fmt.Errorf("invalid %s [%s], expected an integer >= 0", key, v))
+				continue
+			}
+			*n = parsed
+		}
+	}
+	if v := getenv("HTTP_HTTP2"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid HTTP_HTTP2 [%s], expected true or false", v))
+		} else {
+			c.HTTP2 = enabled
+		}
+	}
+	return c, errors.Join(errs...)
+}
+
+// NewTransport returns a pooled transport configured by cfg whose connections
+// are counted in http.client.open_connections.
+func (otc *OtelClient) NewTransport(cfg TransportConfig) *http.Transport {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.KeepAlive}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+	}
+	if !cfg.HTTP2 {
+		// A non-nil empty map keeps the transport from upgrading to HTTP/2.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if otc.conns != nil {
+		t.DialContext = otc.conns.countingDial(t.DialContext)
+	}
+	return t
+}
+
+// endWithBody ends span once the body of resp has been read to the end or
+// closed, so the span covers the whole response, or right away when there is
+// no body to wait for.
+func endWithBody(span trace.Span, resp *http.Response) {
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+		span.End()
+		return
+	}
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+}
+
+// spanBody ends its span when it is read to the end or closed. Closing it
+// first drains up to MAX_DRAIN bytes.
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+	read int64
+	once sync.Once
+}
+
+func (b *spanBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.end(nil)
+	} else if err != nil {
+		b.end(err)
+	}
+	return n, err
+}
+
+func (b *spanBody) Close() error {
+	n, _ := io.CopyN(io.Discard, b.ReadCloser, MAX_DRAIN)
+	b.read += n
+	err := b.ReadCloser.Close()
+	b.end(nil)
+	return err
+}
+
+func (b *spanBody) end(err error) {
+	b.once.Do(func() {
+		b.span.SetAttributes(attribute.Int64("http.response_body_size", b.read))
+		if err != nil {
+			b.span.SetStatus(codes.Error, err.Error())
+		}
+		b.span.End()
+	})
+}
@@ -3,25 +3,30 @@ package main
 import (
 	"context"
 	"fmt"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"client/internal/load"
+	"client/internal/myhttp"
 	myotel "client/internal/otel"
 
 	"go.opentelemetry.io/otel/attribute"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 )
 
-var (
-	APP1_URL = "http://app1:8081/reserve"
-)
-
 func main() {
+	cfg, err := load.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	fmt.Println("Starting app")
-	ctx := context.TODO()
 	otelClient, err := myotel.NewOtelClient(
-		ctx,
-		"collector:14317",
+		context.TODO(),
+		cfg.CollectorURL,
 		semconv.ServiceNameKey.String("client"),
 		attribute.String("version", "1.0.0"),
 	)
@@ -29,14 +34,130 @@ func main() {
 		panic(err)
 	}
 
-	x := http.Client{
-		Transport: otelClient,
+	otelClient.ConnTrace = cfg.ConnTrace
+	client, err := myhttp.NewHttpClient(otelClient)
+	if err != nil {
+		panic(err)
+	}
+	client.Timeout = cfg.Timeout
+
+	scenario, err := load.SingleURL(cfg.URL)
+	if cfg.ScenarioFile != "" {
+		scenario, err = load.LoadScenario(cfg.ScenarioFile)
+	}
+	var offsets []time.Duration
+	if cfg.ReplayFile != "" {
+		var records []load.Record
+		records, err = load.LoadRecords(cfg.ReplayFile)
+		if err == nil {
+			scenario, offsets, err = load.ReplayScenario("replay "+cfg.ReplayFile, records, cfg.ReplayTarget)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Replayed requests keep the identities they were recorded with.
+	var population *load.Population
+	if cfg.Users > 0 && cfg.ReplayFile == "" {
+		population, err = load.NewPopulation(cfg.Seed, cfg.Users, cfg.UserDist, cfg.Books, cfg.BookDist, cfg.ZipfS)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		fmt.Printf("Simulating %d users (%s) and %d books (%s), seed %d\n", cfg.Users, cfg.UserDist, cfg.Books, cfg.BookDist, cfg.Seed)
 	}
-	for {
-		_, err := x.Get(APP1_URL)
+
+	var recorder *load.Recorder
+	if cfg.RecordFile != "" {
+		recorder, err = load.NewRecorder(cfg.RecordFile)
 		if err != nil {
-			fmt.Println(err)
-			time.Sleep(1 * time.Millisecond)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
 	}
+
+	// The first SIGINT stops sending and lets the requests in flight finish,
+	// a second one kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	concurrency := fmt.Sprintf("%d workers", cfg.Workers)
+	if cfg.Executor == load.EXECUTOR_OPEN {
+		concurrency = fmt.Sprintf("up to %d iterations in flight", cfg.MaxInFlight)
+	}
+	if cfg.ReplayFile != "" {
+		fmt.Printf("Replaying %d requests from %s at speed %s, up to %d in flight\n", len(scenario.Steps), cfg.ReplayFile, speed(cfg), cfg.MaxInFlight)
+	} else {
+		journeys := ""
+		if len(scenario.Journeys) > 0 {
+			journeys = fmt.Sprintf(" in %d journeys", len(scenario.Journeys))
+		}
+		fmt.Printf("Running scenario [%s] with %d steps%s, %s executor, %s, rps %s\n", scenario.Name, len(scenario.Steps), journeys, cfg.Executor, concurrency, rate(cfg))
+	}
+	runner := load.Runner{
+		Client:     client,
+		Config:     cfg,
+		Scenario:   scenario,
+		Tracer:     otelClient.Tracer.Tracer("opentelemetry.io/sdk"),
+		Logger:     otelClient.Logger,
+		Out:        os.Stdout,
+		Recorder:   recorder,
+		Population: population,
+	}
+	var summary load.Summary
+	if cfg.ReplayFile != "" {
+		summary = runner.Replay(ctx, offsets, cfg.ReplaySpeed)
+	} else {
+		summary = runner.Run(ctx)
+	}
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not close %s: %s\n", cfg.RecordFile, err)
+		} else {
+			fmt.Printf("Requests recorded to %s\n", cfg.RecordFile)
+		}
+	}
+	if len(scenario.Journeys) > 0 {
+		for _, j := range summary.Journeys {
+			fmt.Printf("Journey [%s] ran %d times, %d succeeded, p50 %gms\n", j.Journey, j.Iterations, j.Outcomes[load.OUTCOME_SUCCESS], j.DurationMs.P50)
+		}
+	}
+	for _, a := range summary.Assertions {
+		fmt.Printf("Step [%s] failed assertion %s %d times\n", a.Step, a.Assertion, a.Failures)
+	}
+	fmt.Printf("Sent %d requests, %d failed, in %s: p50 %gms p90 %gms p99 %gms max %gms\n",
+		summary.Requests, summary.Failures, time.Duration(summary.ElapsedMs)*time.Millisecond,
+		summary.LatencyMs.P50, summary.LatencyMs.P90, summary.LatencyMs.P99, summary.LatencyMs.Max)
+	if cfg.SummaryFile != "" {
+		if err := summary.WriteFile(cfg.SummaryFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write the run summary: %s\n", err)
+		} else {
+			fmt.Printf("Run summary written to %s\n", cfg.SummaryFile)
+		}
+	}
+
+	otelClient.Tracer.ForceFlush(context.Background())
+	otelClient.Metrics.ForceFlush(context.Background())
+}
+
+func rate(cfg *load.Config) string {
+	switch {
+	case len(cfg.Stages) > 0:
+		return fmt.Sprintf("in stages [%s]", cfg.Stages.String())
+	case cfg.RPS == 0:
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g", cfg.RPS)
+}
+
+func speed(cfg *load.Config) string {
+	if cfg.ReplaySpeed == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%gx", cfg.ReplaySpeed)
 }
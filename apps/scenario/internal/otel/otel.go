@@ -0,0 +1,236 @@
+package otel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/log"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var (
+	OTEL_TRACE_HEADER = "x-otel-custom-id"
+	OTEL_SPAN_HEADER  = "x-otel-span-id"
+)
+
+type OtelClient struct {
+	Ctx                   context.Context
+	Tracer                *sdktrace.TracerProvider
+	Metrics               *metricsdk.MeterProvider
+	HttpRequestTotalMeter metric.Int64Counter
+	Logger                *slog.Logger
+	// ConnTrace adds the connection events of every request to its span, it
+	// is on unless CONN_TRACE_ENV is false.
+	ConnTrace bool
+	// Base sends the requests of RoundTrip. NewOtelClient sets it to a
+	// transport configured by the HTTP_* variables, see
+	// TransportConfigFromEnv; nil means http.DefaultTransport.
+	Base http.RoundTripper
+
+	conns *connMetrics
+	// exporterConn is the connection of the trace exporter to the collector.
+	exporterConn *grpc.ClientConn
+}
+
+func (otc *OtelClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	tracer := otc.Tracer.Tracer("opentelemetry.io/sdk")
+	ctx := otc.Ctx
+	parentId := req.Header.Get(OTEL_TRACE_HEADER)
+	if parentId != "" {
+		ctx = withParentHeaders(ctx, req)
+	}
+
+	_, span := tracer.Start(
+		ctx,
+		fmt.Sprintf("%s %s", req.Method, req.URL.Path),
+		trace.WithAttributes(
+			attribute.String("hostname", req.Host),
+		),
+	)
+	// The span ends with the response body, once it is read or closed.
+	var resp *http.Response
+	defer func() { endWithBody(span, resp) }()
+
+	req.Header.Set(OTEL_TRACE_HEADER, span.SpanContext().TraceID().String())
+	req.Header.Set(OTEL_SPAN_HEADER, span.SpanContext().SpanID().String())
+
+	resp, err := otc.roundTrip(req, span, start)
+	elapsed := time.Since(start)
+	status := "-1"
+	if resp != nil {
+		status = fmt.Sprintf("%d", resp.StatusCode)
+	}
+	otc.HttpRequestTotalMeter.Add(req.Context(), 1, metric.WithAttributes(
+		attribute.String("method", req.Method),
+		attribute.String("path", req.URL.Path),
+		attribute.String("code", status),
+	))
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		otc.Logger.Error(
+			fmt.Sprintf("Request for [%s] failed in %d miliseconds", req.URL.Path, elapsed.Milliseconds()),
+			slog.String("TraceId", parentId),
+			slog.String("SpanId", span.SpanContext().TraceID().String()),
+		)
+		return nil, err
+
+	}
+
+	if status != "200" {
+		span.SetStatus(codes.Error, fmt.Sprintf("Server returned [%d]", resp.StatusCode))
+		otc.Logger.Error(
+			fmt.Sprintf("Request for [%s] failed in %d miliseconds", req.URL.Path, elapsed.Milliseconds()),
+			slog.String("TraceId", parentId),
+			slog.String("SpanId", span.SpanContext().TraceID().String()),
+		)
+		return resp, nil
+	}
+
+	otc.Logger.Info(
+		fmt.Sprintf("Request for [%s] succeded in %d miliseconds", req.URL.Path, elapsed.Milliseconds()),
+		slog.String("TraceId", parentId),
+		slog.String("SpanId", span.SpanContext().TraceID().String()),
+	)
+	return resp, err
+}
+
+// withParentHeaders returns ctx with the span named by the trace headers of
+// req as the remote parent, so the request span joins the caller's trace. It
+// is local to the request, otc.Ctx is shared by every request.
+func withParentHeaders(ctx context.Context, req *http.Request) context.Context {
+	traceID, _ := trace.TraceIDFromHex(req.Header.Get(OTEL_TRACE_HEADER))
+	spanID, _ := trace.SpanIDFromHex(req.Header.Get(OTEL_SPAN_HEADER))
+	return trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+}
+
+func NewOtelClient(ctx context.Context, collectorUrl string, attr ...attribute.KeyValue) (*OtelClient, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attr...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := grpc.DialContext(ctx, collectorUrl, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+	if err != nil {
+		return nil, err
+	}
+
+	metricsExporter, err := otlpmetricgrpc.New(ctx,
+		otlpmetricgrpc.WithEndpoint("collector:14317"),
+		otlpmetricgrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create metric exporter: %w", err)
+	}
+	logExporter, err := otlploggrpc.New(ctx,
+		otlploggrpc.WithEndpoint("collector:14317"),
+		otlploggrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create metric exporter: %w", err)
+	}
+
+	periodicReader := metricsdk.NewPeriodicReader(metricsExporter, metricsdk.WithInterval(1*time.Second))
+
+	batchSpanProcessor := sdktrace.NewSimpleSpanProcessor(exporter)
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithResource(res),
+		sdktrace.WithSpanProcessor(batchSpanProcessor),
+	)
+	metricsProvider := metricsdk.NewMeterProvider(
+		metricsdk.WithResource(res),
+		metricsdk.WithReader(periodicReader),
+	)
+	metricsProvider.Meter("tracetest")
+
+	lp := log.NewLoggerProvider(
+		log.WithProcessor(
+			log.NewSimpleProcessor(logExporter),
+		),
+		log.WithResource(res),
+	)
+	global.SetLoggerProvider(lp)
+	logger := otelslog.NewLogger("asd")
+	logger.Info("Logger started")
+
+	otel.SetTracerProvider(tracerProvider)
+
+	c, err := metricsProvider.Meter("asdsda").Int64Counter("http.requests.total")
+	if err != nil {
+		return nil, err
+	}
+	conns, err := newConnMetrics(metricsProvider.Meter("asdsda"))
+	if err != nil {
+		return nil, err
+	}
+	otc := &OtelClient{
+		Ctx:                   ctx,
+		Tracer:                tracerProvider,
+		Metrics:               metricsProvider,
+		HttpRequestTotalMeter: c,
+		Logger:                logger,
+		ConnTrace:             connTraceEnabled(),
+		conns:                 conns,
+		exporterConn:          conn,
+	}
+	transportConfig, err := TransportConfigFromEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	otc.Base = otc.NewTransport(transportConfig)
+	return otc, nil
+}
+
+// PingExporter waits until the connection of the trace exporter to the
+// collector is ready, or ctx is done. The exporters retry in the background
+// rather than fail, so this is how readiness checks see a collector outage.
+func (otc *OtelClient) PingExporter(ctx context.Context) error {
+	if otc.exporterConn == nil {
+		return nil
+	}
+	state := otc.exporterConn.GetState()
+	for state != connectivity.Ready {
+		if state == connectivity.Shutdown {
+			return fmt.Errorf("collector connection is %s", state)
+		}
+		otc.exporterConn.Connect()
+		if !otc.exporterConn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("collector connection is %s", state)
+		}
+		state = otc.exporterConn.GetState()
+	}
+	return nil
+}
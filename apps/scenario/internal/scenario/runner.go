@@ -0,0 +1,222 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	OTEL_TRACE_HEADER = "x-otel-custom-id"
+	OTEL_SPAN_HEADER  = "x-otel-span-id"
+)
+
+const (
+	PhaseDo   = "do"
+	PhaseUndo = "undo"
+)
+
+// Result is one line of the timeline printed at the end of a run.
+type Result struct {
+	Step     string
+	Phase    string
+	Target   string
+	Action   Action
+	Planned  time.Duration
+	Started  time.Duration
+	Duration time.Duration
+	Status   int
+	TraceID  string
+	Err      error
+}
+
+type event struct {
+	at     time.Duration
+	step   Step
+	phase  string
+	action Action
+	index  int
+}
+
+type Runner struct {
+	Client *http.Client
+	Tracer trace.Tracer
+	Logger *slog.Logger
+	// UndoTimeout bounds the clean up calls issued after the run is cancelled.
+	UndoTimeout time.Duration
+}
+
+func schedule(s *Scenario) []event {
+	events := []event{}
+	for i, step := range s.Steps {
+		events = append(events, event{at: time.Duration(step.At), step: step, phase: PhaseDo, action: step.Do, index: i})
+		if step.Undo != nil {
+			events = append(events, event{at: time.Duration(step.At + step.For), step: step, phase: PhaseUndo, action: *step.Undo, index: i})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at < events[j].at })
+	return events
+}
+
+// Run executes every step of the scenario on schedule. If ctx is cancelled the
+// undo actions of the steps already applied are still issued, so an aborted
+// run does not leave faults enabled behind.
+func (r *Runner) Run(ctx context.Context, s *Scenario) ([]Result, error) {
+	start := time.Now()
+	results := []Result{}
+	applied := map[int]bool{}
+	events := schedule(s)
+
+	for n, ev := range events {
+		wait := time.Until(start.Add(ev.at))
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+			}
+		}
+		if ctx.Err() != nil {
+			return append(results, r.cleanup(s, start, events[n:], applied)...), ctx.Err()
+		}
+
+		res := r.execute(ctx, s, start, ev)
+		results = append(results, res)
+		switch ev.phase {
+		case PhaseDo:
+			// A call interrupted by the cancellation may have reached the
+			// app, so it is undone too.
+			applied[ev.index] = res.Err == nil || ctx.Err() != nil
+		case PhaseUndo:
+			delete(applied, ev.index)
+		}
+	}
+	return results, nil
+}
+
+func (r *Runner) cleanup(s *Scenario, start time.Time, pending []event, applied map[int]bool) []Result {
+	timeout := r.UndoTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	results := []Result{}
+	for _, ev := range pending {
+		if ev.phase != PhaseUndo || !applied[ev.index] {
+			continue
+		}
+		results = append(results, r.execute(ctx, s, start, ev))
+	}
+	return results
+}
+
+func (r *Runner) execute(ctx context.Context, s *Scenario, start time.Time, ev event) Result {
+	res := Result{
+		Step:    ev.step.Name,
+		Phase:   ev.phase,
+		Target:  ev.step.Target,
+		Action:  ev.action,
+		Planned: ev.at,
+		Started: time.Since(start),
+	}
+
+	ctx, span := r.Tracer.Start(
+		ctx,
+		fmt.Sprintf("scenario %s %s", ev.phase, ev.step.Name),
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("scenario.name", s.Name),
+			attribute.String("scenario.step", ev.step.Name),
+			attribute.String("scenario.phase", ev.phase),
+			attribute.String("scenario.target", ev.step.Target),
+			attribute.String("http.method", ev.action.Method),
+			attribute.String("http.target", ev.action.Path),
+			attribute.Int64("scenario.planned_offset_ms", ev.at.Milliseconds()),
+		),
+	)
+	defer span.End()
+	res.TraceID = span.SpanContext().TraceID().String()
+
+	callStart := time.Now()
+	status, err := r.call(ctx, s.Targets[ev.step.Target], ev.action, span)
+	res.Duration = time.Since(callStart)
+	res.Status = status
+	res.Err = err
+
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		r.Logger.Error(
+			fmt.Sprintf("Scenario step [%s] %s %s on %s failed in %d miliseconds: %s", ev.step.Name, ev.phase, ev.action, ev.step.Target, res.Duration.Milliseconds(), err),
+			slog.String("TraceId", res.TraceID),
+			slog.String("SpanId", span.SpanContext().SpanID().String()),
+		)
+		return res
+	}
+	r.Logger.Info(
+		fmt.Sprintf("Scenario step [%s] %s %s on %s succeded in %d miliseconds", ev.step.Name, ev.phase, ev.action, ev.step.Target, res.Duration.Milliseconds()),
+		slog.String("TraceId", res.TraceID),
+		slog.String("SpanId", span.SpanContext().SpanID().String()),
+	)
+	return res
+}
+
+func (r *Runner) call(ctx context.Context, baseUrl string, a Action, span trace.Span) (int, error) {
+	u, err := url.Parse(baseUrl + a.Path)
+	if err != nil {
+		return 0, err
+	}
+	q := u.Query()
+	for k, v := range a.Query {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, a.Method, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(OTEL_TRACE_HEADER, span.SpanContext().TraceID().String())
+	req.Header.Set(OTEL_SPAN_HEADER, span.SpanContext().SpanID().String())
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("server returned [%d]: %s", resp.StatusCode, body)
+	}
+	return resp.StatusCode, nil
+}
+
+// PrintTimeline writes the results as a table ordered by execution time.
+func PrintTimeline(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PLANNED\tSTARTED\tSTEP\tPHASE\tTARGET\tACTION\tSTATUS\tTOOK\tTRACE")
+	for _, r := range results {
+		status := fmt.Sprintf("%d", r.Status)
+		if r.Err != nil {
+			status = fmt.Sprintf("%d (%s)", r.Status, r.Err)
+		}
+		fmt.Fprintf(tw, "t+%s\tt+%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Planned, r.Started.Round(time.Millisecond), r.Step, r.Phase, r.Target, r.Action,
+			status, r.Duration.Round(time.Millisecond), r.TraceID)
+	}
+	tw.Flush()
+}
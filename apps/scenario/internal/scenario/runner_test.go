@@ -0,0 +1,214 @@
+package scenario
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// SLACK is how late a call may be on its offset before the test fails.
+var SLACK = 80 * time.Millisecond
+
+type hit struct {
+	path string
+	at   time.Duration
+}
+
+// standIn is an httptest stand-in of an app recording the calls it gets.
+type standIn struct {
+	*httptest.Server
+	start time.Time
+
+	mu   sync.Mutex
+	hits []hit
+	// onHit, when set, is called after every recorded hit.
+	onHit func(path string)
+}
+
+func newStandIn(t *testing.T, start time.Time) *standIn {
+	s := &standIn{start: start}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.hits = append(s.hits, hit{path: r.URL.Path, at: time.Since(s.start)})
+		onHit := s.onHit
+		s.mu.Unlock()
+		if onHit != nil {
+			onHit(r.URL.Path)
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *standIn) Hits() []hit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]hit{}, s.hits...)
+}
+
+func newRunner() *Runner {
+	return &Runner{
+		Client:      &http.Client{Timeout: time.Second},
+		Tracer:      noop.NewTracerProvider().Tracer("test"),
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		UndoTimeout: time.Second,
+	}
+}
+
+func ms(n int) Duration {
+	return Duration(time.Duration(n) * time.Millisecond)
+}
+
+func TestRunHitsFaultEndpointsOnSchedule(t *testing.T) {
+	start := time.Now()
+	app2, app3 := newStandIn(t, start), newStandIn(t, start)
+	s := &Scenario{
+		Name:    "schedule",
+		Targets: map[string]string{"app2": app2.URL, "app3": app3.URL},
+		Steps: []Step{
+			{Name: "slow", At: ms(0), Target: "app3", Do: Action{Method: "POST", Path: "/faults/slow/enable"}, For: ms(200), Undo: &Action{Method: "POST", Path: "/faults/slow/disable"}},
+			{Name: "burn", At: ms(100), Target: "app2", Do: Action{Method: "POST", Path: "/burn", Query: map[string]string{"cpus": "1"}}},
+		},
+	}
+
+	results, err := newRunner().Run(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+
+	want := map[*standIn][]hit{
+		app3: {{"/faults/slow/enable", 0}, {"/faults/slow/disable", 200 * time.Millisecond}},
+		app2: {{"/burn", 100 * time.Millisecond}},
+	}
+	for app, hits := range want {
+		got := app.Hits()
+		if len(got) != len(hits) {
+			t.Fatalf("expected %v, got %v", hits, got)
+		}
+		for i, h := range hits {
+			if got[i].path != h.path {
+				t.Errorf("call %d: expected %s, got %s", i, h.path, got[i].path)
+			}
+			if got[i].at < h.at || got[i].at > h.at+SLACK {
+				t.Errorf("%s: expected at t+%s, got t+%s", h.path, h.at, got[i].at)
+			}
+		}
+	}
+}
+
+func TestPrintTimeline(t *testing.T) {
+	app3 := newStandIn(t, time.Now())
+	s := &Scenario{
+		Name:    "timeline",
+		Targets: map[string]string{"app3": app3.URL},
+		Steps: []Step{
+			{Name: "error", At: ms(0), Target: "app3", Do: Action{Method: "POST", Path: "/faults/error/enable"}, For: ms(50), Undo: &Action{Method: "POST", Path: "/faults/error/disable"}},
+			{Name: "broken", At: ms(20), Target: "app3", Do: Action{Method: "GET", Path: "/broken"}},
+		},
+	}
+
+	results, err := newRunner().Run(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	PrintTimeline(out, results)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and 3 lines, got:\n%s", out)
+	}
+	if got := strings.Fields(lines[0]); strings.Join(got, " ") != "PLANNED STARTED STEP PHASE TARGET ACTION STATUS TOOK TRACE" {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+	// STARTED, TOOK and TRACE vary between runs.
+	want := [][]string{
+		{"t+0s", "error", "do", "app3", "POST", "/faults/error/enable", "200"},
+		{"t+20ms", "broken", "do", "app3", "GET", "/broken", "500", "(server", "returned", "[500]:", "ok)"},
+		{"t+50ms", "error", "undo", "app3", "POST", "/faults/error/disable", "200"},
+	}
+	for i, w := range want {
+		fields := strings.Fields(lines[i+1])
+		got := append([]string{fields[0]}, fields[2:len(fields)-2]...)
+		if strings.Join(got, " ") != strings.Join(w, " ") {
+			t.Errorf("line %d: expected %q, got %q", i+1, w, got)
+		}
+		if !strings.HasPrefix(fields[1], "t+") {
+			t.Errorf("line %d: expected a started offset, got %q", i+1, fields[1])
+		}
+	}
+}
+
+func TestRunUndoesAppliedFaultsWhenCancelled(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// inFlight cancels the run while the enable call is being served,
+		// otherwise shortly after it answered.
+		inFlight bool
+	}{
+		{name: "between steps"},
+		{name: "during the call", inFlight: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app3 := newStandIn(t, time.Now())
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			app3.onHit = func(path string) {
+				if path != "/faults/pool/enable" {
+					return
+				}
+				if tc.inFlight {
+					cancel()
+				} else {
+					time.AfterFunc(50*time.Millisecond, cancel)
+				}
+			}
+			s := &Scenario{
+				Name:    "cancelled",
+				Targets: map[string]string{"app3": app3.URL},
+				Steps: []Step{
+					{Name: "pool", At: ms(0), Target: "app3", Do: Action{Method: "POST", Path: "/faults/pool/enable"}, For: Duration(time.Hour), Undo: &Action{Method: "POST", Path: "/faults/pool/disable"}},
+					{Name: "never", At: Duration(time.Hour), Target: "app3", Do: Action{Method: "POST", Path: "/faults/error/enable"}, For: ms(10), Undo: &Action{Method: "POST", Path: "/faults/error/disable"}},
+				},
+			}
+
+			began := time.Now()
+			results, err := newRunner().Run(ctx, s)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected context.Canceled, got %v", err)
+			}
+			if time.Since(began) > time.Second {
+				t.Fatalf("run did not stop on cancel, took %s", time.Since(began))
+			}
+
+			var paths []string
+			for _, h := range app3.Hits() {
+				paths = append(paths, h.path)
+			}
+			if strings.Join(paths, " ") != "/faults/pool/enable /faults/pool/disable" {
+				t.Fatalf("expected the pool fault to be enabled then undone, got %v", paths)
+			}
+			last := results[len(results)-1]
+			if last.Step != "pool" || last.Phase != PhaseUndo || last.Err != nil {
+				t.Errorf("expected a successful undo of pool last, got %+v", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration accepts Go duration strings such as "90s" or "1m30s" in both YAML
+// and JSON scenario files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Action is a single HTTP call against one of the scenario targets.
+type Action struct {
+	Method string            `json:"method" yaml:"method"`
+	Path   string            `json:"path" yaml:"path"`
+	Query  map[string]string `json:"query,omitempty" yaml:"query,omitempty"`
+}
+
+func (a Action) String() string {
+	return fmt.Sprintf("%s %s", a.Method, a.Path)
+}
+
+// Step runs Do at offset At from the start of the scenario. When For is set,
+// Undo runs For after Do to revert the fault.
+type Step struct {
+	Name   string   `json:"name" yaml:"name"`
+	At     Duration `json:"at" yaml:"at"`
+	Target string   `json:"target" yaml:"target"`
+	Do     Action   `json:"do" yaml:"do"`
+	For    Duration `json:"for,omitempty" yaml:"for,omitempty"`
+	Undo   *Action  `json:"undo,omitempty" yaml:"undo,omitempty"`
+}
+
+type Scenario struct {
+	Name    string            `json:"name" yaml:"name"`
+	Targets map[string]string `json:"targets" yaml:"targets"`
+	Steps   []Step            `json:"steps" yaml:"steps"`
+}
+
+// Load reads a scenario from a .yaml, .yml or .json file.
+func Load(path string) (*Scenario, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scenario{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(s)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		err = dec.Decode(s)
+	default:
+		return nil, fmt.Errorf("unsupported scenario format [%s]", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse scenario %s: %w", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *Scenario) Validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	for i, step := range s.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if _, ok := s.Targets[step.Target]; !ok {
+			return fmt.Errorf("step %s: unknown target [%s]", name, step.Target)
+		}
+		if step.At < 0 || step.For < 0 {
+			return fmt.Errorf("step %s: negative offset", name)
+		}
+		if err := validateAction(step.Do); err != nil {
+			return fmt.Errorf("step %s: do: %w", name, err)
+		}
+		if step.Undo != nil {
+			if step.For == 0 {
+				return fmt.Errorf("step %s: undo requires for", name)
+			}
+			if err := validateAction(*step.Undo); err != nil {
+				return fmt.Errorf("step %s: undo: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateAction(a Action) error {
+	switch a.Method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete:
+	default:
+		return fmt.Errorf("unsupported method [%s]", a.Method)
+	}
+	if !strings.HasPrefix(a.Path, "/") {
+		return fmt.Errorf("path [%s] must start with /", a.Path)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	myotel "scenario/internal/otel"
+	"scenario/internal/scenario"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+func main() {
+	file := flag.String("file", "scenarios/incident.yaml", "scenario file (.yaml, .yml or .json)")
+	collector := flag.String("collector", "collector:14317", "OTLP gRPC collector address")
+	flag.Parse()
+
+	s, err := scenario.Load(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("Starting scenario [%s] with %d steps\n", s.Name, len(s.Steps))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	otelClient, err := myotel.NewOtelClient(
+		context.TODO(),
+		*collector,
+		semconv.ServiceNameKey.String("scenario"),
+		attribute.String("version", "1.0.0"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	runner := scenario.Runner{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		Tracer: otelClient.Tracer.Tracer("opentelemetry.io/sdk"),
+		Logger: otelClient.Logger,
+	}
+	results, err := runner.Run(ctx, s)
+	scenario.PrintTimeline(os.Stdout, results)
+
+	otelClient.Tracer.ForceFlush(context.Background())
+	otelClient.Metrics.ForceFlush(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Scenario aborted: %s\n", err)
+		os.Exit(1)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			os.Exit(1)
+		}
+	}
+}